@@ -0,0 +1,253 @@
+// Package admin implements the authenticated admin API for inspecting
+// and controlling a running rt-mail: the routing table, dead letters,
+// the SES certificate cache, per-provider counters and the RT backends'
+// circuit breakers.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/replay"
+	"go.askask.com/rt-mail/rt"
+)
+
+// deadLetterWindow is how far back dead letters are listed by default.
+const deadLetterWindow = 7 * 24 * time.Hour
+
+// Server serves the admin API.
+type Server struct {
+	// Token is the bearer token required for all requests.
+	Token string
+
+	// RT provides the routing table.
+	RT *rt.RT
+
+	// Client is what retried messages are posted to.
+	Client rt.Client
+
+	// Archive holds the dead letters. The dead letter endpoints return
+	// 404 if it's nil.
+	Archive *archive.Archive
+
+	// FlushCertCache flushes the SES certificate cache, if SES is enabled.
+	FlushCertCache func() int
+
+	// UI is the web dashboard, served under /ui/ if set.
+	UI http.Handler
+
+	// Ready serves the detailed readiness report at /readyz, if set.
+	Ready http.Handler
+}
+
+// UIPrefix is the path the dashboard is served under.
+const UIPrefix = "/ui"
+
+// Handler returns the admin API handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /routes", s.routes)
+	mux.HandleFunc("GET /route", s.route)
+	mux.HandleFunc("GET /dead-letters", s.deadLetters)
+	mux.HandleFunc("GET /dead-letters/{id}", s.deadLetter)
+	mux.HandleFunc("POST /dead-letters/{id}/retry", s.retry)
+	mux.HandleFunc("POST /dead-letters/{id}/discard", s.discard)
+	mux.HandleFunc("POST /ses/cert-cache/flush", s.flushCertCache)
+	mux.HandleFunc("GET /stats", s.stats)
+	mux.HandleFunc("GET /backends", s.backends)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	if s.Ready != nil {
+		mux.Handle("GET /readyz", s.Ready)
+	}
+	if s.UI != nil {
+		mux.Handle(UIPrefix+"/", s.UI)
+	}
+	return s.authenticate(mux)
+}
+
+// authenticate requires the bearer token on all requests. For browsers
+// the token is also accepted as the password of basic authentication.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, ok = r.BasicAuth()
+		}
+		if !ok || s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			if strings.HasPrefix(r.URL.Path, UIPrefix+"/") {
+				w.Header().Set("WWW-Authenticate", `Basic realm="rt-mail admin", charset="UTF-8"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rt-mail admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) routes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"routes":   s.RT.Routes(),
+		"problems": s.RT.Problems(),
+	})
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		writeError(w, http.StatusBadRequest, "address parameter missing")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"address": address,
+		"match":   s.RT.Match(address),
+	})
+}
+
+func (s *Server) deadLetters(w http.ResponseWriter, r *http.Request) {
+	if s.Archive == nil {
+		writeError(w, http.StatusNotFound, "archive not configured")
+		return
+	}
+	since := time.Now().Add(-deadLetterWindow)
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since parameter")
+			return
+		}
+		since = t
+	}
+
+	dead := []*archive.Record{}
+	err := s.Archive.Each(r.Context(), since, time.Time{}, func(rec *archive.Record) error {
+		if rec.DeadLetter() {
+			dead = append(dead, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"dead_letters": dead})
+}
+
+// record returns the dead letter for the request, or writes an error.
+func (s *Server) record(w http.ResponseWriter, r *http.Request) *archive.Record {
+	if s.Archive == nil {
+		writeError(w, http.StatusNotFound, "archive not configured")
+		return nil
+	}
+	rec, err := s.Archive.Record(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no such message")
+		return nil
+	}
+	return rec
+}
+
+func (s *Server) deadLetter(w http.ResponseWriter, r *http.Request) {
+	if rec := s.record(w, r); rec != nil {
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+func (s *Server) retry(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rec := s.record(w, r)
+	if rec == nil {
+		return
+	}
+	if !rec.DeadLetter() {
+		writeError(w, http.StatusConflict, "message was delivered or resolved")
+		return
+	}
+
+	raw, err := s.Archive.Message(ctx, rec)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	msg := &replay.Message{Source: rec.ID, Time: rec.Time, Recipient: rec.Recipient, Raw: raw, Record: rec}
+	results := replay.Replay(ctx, s.Client, s.RT, []*replay.Message{msg}, replay.Options{})
+	if err := replay.Resolve(ctx, s.Archive, results); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res := results[0]
+	log := logger.FromContext(ctx)
+	log.InfoContext(ctx, "admin retried message", "id", rec.ID, "outcome", res.Outcome, "ticket", res.Ticket)
+
+	status := http.StatusOK
+	if res.Outcome != archive.Delivered {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, map[string]any{
+		"id":      rec.ID,
+		"queue":   res.Queue,
+		"action":  res.Action,
+		"outcome": res.Outcome,
+		"ticket":  res.Ticket,
+		"error":   res.Error,
+	})
+}
+
+func (s *Server) discard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rec := s.record(w, r)
+	if rec == nil {
+		return
+	}
+	if !rec.DeadLetter() {
+		writeError(w, http.StatusConflict, "message was delivered or resolved")
+		return
+	}
+	rec.Resolution = archive.Discarded
+	if err := s.Archive.Update(ctx, rec); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log := logger.FromContext(ctx)
+	log.InfoContext(ctx, "admin discarded message", "id", rec.ID)
+	writeJSON(w, http.StatusOK, rec)
+}
+
+func (s *Server) flushCertCache(w http.ResponseWriter, r *http.Request) {
+	if s.FlushCertCache == nil {
+		writeError(w, http.StatusNotFound, "SES not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"flushed": s.FlushCertCache()})
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"providers": ProviderStats()})
+}
+
+func (s *Server) backends(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"backends": s.RT.Status()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
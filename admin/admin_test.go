@@ -0,0 +1,203 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+func newTestServer(t *testing.T, client rt.Client) (*Server, *archive.Archive) {
+	t.Helper()
+	rtClient, err := rt.NewFromConfig(&config.Config{
+		RTUrl: "http://rt.invalid/",
+		Queues: config.AddressQueue{
+			"help":             "help",
+			"help@example.com": "example",
+		},
+	})
+	testutil.AssertNoError(t, err)
+	a, err := archive.New(context.Background(), client, &config.Archive{Storage: config.Storage{Dir: t.TempDir()}})
+	testutil.AssertNoError(t, err)
+	return &Server{Token: "secret", RT: rtClient, Client: client, Archive: a}, a
+}
+
+func do(t *testing.T, h http.Handler, method, path string, v any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %s: %s", method, path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func TestAuthentication(t *testing.T) {
+	s, _ := newTestServer(t, &testutil.MockRTClient{})
+	h := s.Handler()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret", "Basic c2VjcmV0"} {
+		req := httptest.NewRequest(http.MethodGet, "/routes", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		testutil.AssertStatusCode(t, w.Code, http.StatusUnauthorized)
+	}
+
+	s.UI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h = s.Handler()
+	req := httptest.NewRequest(http.MethodGet, "/ui/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	testutil.AssertStatusCode(t, w.Code, http.StatusUnauthorized)
+	if got := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(got, "Basic ") {
+		t.Errorf("dashboard challenge = %q", got)
+	}
+	req.SetBasicAuth("support", "secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	testutil.AssertStatusCode(t, w.Code, http.StatusNoContent)
+
+	s.Token = ""
+	req = httptest.NewRequest(http.MethodGet, "/routes", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	testutil.AssertStatusCode(t, w.Code, http.StatusUnauthorized)
+}
+
+func TestRoutes(t *testing.T) {
+	s, _ := newTestServer(t, &testutil.MockRTClient{})
+	h := s.Handler()
+
+	var routes struct {
+		Routes   []rt.RouteEntry
+		Problems []rt.Problem
+	}
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/routes", &routes), http.StatusOK)
+	if len(routes.Routes) != 2 || routes.Routes[0].Target != "help" || routes.Routes[0].CommentAddress != "help-comment" {
+		t.Errorf("routes = %+v", routes.Routes)
+	}
+	if len(routes.Problems) != 1 || routes.Problems[0].Severity != "warning" {
+		t.Errorf("problems = %+v", routes.Problems)
+	}
+
+	var route struct {
+		Match rt.Match
+	}
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/route?address=help-comment@example.org", &route), http.StatusOK)
+	if route.Match.Queue != "help" || route.Match.Action != "comment" || route.Match.Rule != "comment local part" {
+		t.Errorf("match = %+v", route.Match)
+	}
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/route", nil), http.StatusBadRequest)
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	rtDown := errors.New("RT failure")
+	client := &testutil.MockRTClient{PostmailFunc: func(recipient, message string) error { return rtDown }}
+	s, a := newTestServer(t, client)
+	h := s.Handler()
+
+	for _, recipient := range []string{"help@example.com", "help@example.org"} {
+		_ = a.Postmail(ctx, recipient, "Subject: test\r\n\r\nbody")
+	}
+	client.PostmailFunc = nil
+	testutil.AssertNoError(t, a.Postmail(ctx, "help@example.net", "Subject: ok\r\n\r\nbody"))
+
+	var list struct {
+		DeadLetters []*archive.Record `json:"dead_letters"`
+	}
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/dead-letters", &list), http.StatusOK)
+	if len(list.DeadLetters) != 2 {
+		t.Fatalf("got %d dead letters, want 2", len(list.DeadLetters))
+	}
+	first, second := list.DeadLetters[0], list.DeadLetters[1]
+
+	var retried map[string]string
+	testutil.AssertStatusCode(t, do(t, h, http.MethodPost, "/dead-letters/"+first.ID+"/retry", &retried), http.StatusOK)
+	if retried["outcome"] != archive.Delivered || retried["queue"] != "example" {
+		t.Errorf("retry = %v", retried)
+	}
+
+	var discarded archive.Record
+	testutil.AssertStatusCode(t, do(t, h, http.MethodPost, "/dead-letters/"+second.ID+"/discard", &discarded), http.StatusOK)
+	if discarded.Resolution != archive.Discarded {
+		t.Errorf("discarded = %+v", discarded)
+	}
+
+	testutil.AssertStatusCode(t, do(t, h, http.MethodPost, "/dead-letters/"+first.ID+"/retry", nil), http.StatusConflict)
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/dead-letters/"+first.ID, nil), http.StatusOK)
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/dead-letters/not-an-id", nil), http.StatusNotFound)
+
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/dead-letters", &list), http.StatusOK)
+	if len(list.DeadLetters) != 0 {
+		t.Errorf("dead letters left: %+v", list.DeadLetters)
+	}
+
+	since := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/dead-letters?since="+since, nil), http.StatusOK)
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/dead-letters?since=yesterday", nil), http.StatusBadRequest)
+
+	s.Archive = nil
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/dead-letters", nil), http.StatusNotFound)
+}
+
+func TestFlushAndStats(t *testing.T) {
+	s, _ := newTestServer(t, &testutil.MockRTClient{})
+	h := s.Handler()
+
+	testutil.AssertStatusCode(t, do(t, h, http.MethodPost, "/ses/cert-cache/flush", nil), http.StatusNotFound)
+	s.FlushCertCache = func() int { return 3 }
+	var flushed map[string]int
+	testutil.AssertStatusCode(t, do(t, h, http.MethodPost, "/ses/cert-cache/flush", &flushed), http.StatusOK)
+	if flushed["flushed"] != 3 {
+		t.Errorf("flushed = %v", flushed)
+	}
+
+	client := Count(&testutil.MockRTClient{PostmailFunc: func(recipient, message string) error {
+		if strings.HasPrefix(recipient, "bad") {
+			return rt.Rejectf("no")
+		}
+		return nil
+	}})
+	ctx := rt.NewContext(context.Background(), &rt.Envelope{Provider: "statstest"})
+	_ = client.Postmail(ctx, "help@example.com", "")
+	_ = client.Postmail(ctx, "help@example.com", "")
+	_ = client.Postmail(ctx, "bad@example.com", "")
+
+	var stats struct {
+		Providers map[string]map[string]int64
+	}
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/stats", &stats), http.StatusOK)
+	if got := stats.Providers["statstest"]; got["delivered"] != 2 || got["rejected"] != 1 {
+		t.Errorf("stats = %v", stats.Providers)
+	}
+
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/debug/vars", nil), http.StatusOK)
+
+	var backends struct {
+		Backends []rt.BackendStatus
+	}
+	testutil.AssertStatusCode(t, do(t, h, http.MethodGet, "/backends", &backends), http.StatusOK)
+	if len(backends.Backends) != 1 || backends.Backends[0].Name != "default" || backends.Backends[0].Breaker != rt.BreakerClosed {
+		t.Errorf("backends = %+v", backends.Backends)
+	}
+}
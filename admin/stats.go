@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"context"
+	"expvar"
+	"strconv"
+	"strings"
+
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/rt"
+)
+
+// providerMessages counts messages by provider and outcome.
+var providerMessages = expvar.NewMap("provider_messages")
+
+type counter struct {
+	next rt.Client
+}
+
+// Count returns a client counting the messages posted through it by
+// provider and outcome.
+func Count(next rt.Client) rt.Client {
+	return &counter{next: next}
+}
+
+func (c *counter) Postmail(ctx context.Context, recipient string, message string) error {
+	err := c.next.Postmail(ctx, recipient, message)
+	provider := rt.EnvelopeFromContext(ctx).Provider
+	if provider == "" {
+		provider = "unknown"
+	}
+	providerMessages.Add(provider+":"+archive.Outcome(err), 1)
+	return err
+}
+
+// ProviderStats returns the message counts by provider and outcome.
+func ProviderStats() map[string]map[string]int64 {
+	stats := map[string]map[string]int64{}
+	providerMessages.Do(func(kv expvar.KeyValue) {
+		provider, outcome, _ := strings.Cut(kv.Key, ":")
+		n, _ := strconv.ParseInt(kv.Value.String(), 10, 64)
+		if stats[provider] == nil {
+			stats[provider] = map[string]int64{}
+		}
+		stats[provider][outcome] = n
+	})
+	return stats
+}
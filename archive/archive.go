@@ -0,0 +1,406 @@
+// Package archive keeps a copy of every inbound message with its
+// delivery metadata, for auditing and replaying messages.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/storage"
+)
+
+// archived counts archived messages by outcome, and archive errors.
+var archived = expvar.NewMap("archived_messages")
+
+// Delivery outcomes.
+const (
+	Delivered = "delivered"
+	Rejected  = "rejected"
+	NotFound  = "not-found"
+	Failed    = "failed"
+)
+
+// Record is the metadata archived with a message.
+type Record struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Provider  string    `json:"provider,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Recipient string    `json:"recipient"`
+	Backend   string    `json:"backend,omitempty"`
+	Queue     string    `json:"queue,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	Ticket    string    `json:"ticket,omitempty"`
+	Size      int       `json:"size"`
+	RequestID string    `json:"request-id,omitempty"`
+
+	// Message is the storage key of the raw message.
+	Message string `json:"message"`
+
+	// Resolution records what was done with a message that wasn't
+	// delivered: "retried" or "discarded".
+	Resolution string `json:"resolution,omitempty"`
+}
+
+// Resolutions for messages that weren't delivered.
+const (
+	Retried   = "retried"
+	Discarded = "discarded"
+)
+
+// DeadLetter reports whether posting the message failed and it hasn't
+// been retried or discarded since. Messages that were rejected or had no
+// queue aren't dead letters: posting them again would get the same
+// answer.
+func (rec *Record) DeadLetter() bool {
+	return rec.Outcome == Failed && rec.Resolution == ""
+}
+
+// Archive is an rt.Client archiving every message posted through it.
+type Archive struct {
+	Store     storage.Store
+	Compress  bool
+	Retention time.Duration
+
+	next rt.Client
+
+	mu       sync.Mutex
+	prunedTo time.Time // the days before are known to be pruned
+}
+
+// New returns an Archive posting messages to next.
+func New(ctx context.Context, next rt.Client, cfg *config.Archive) (*Archive, error) {
+	store, err := storage.New(ctx, &cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{
+		Store:     store,
+		Compress:  cfg.Compress,
+		Retention: time.Duration(cfg.Retention),
+		next:      next,
+	}, nil
+}
+
+// Postmail posts the message and archives it with the outcome. Failing
+// to archive is logged but doesn't fail the delivery.
+func (a *Archive) Postmail(ctx context.Context, recipient string, message string) error {
+	receipt := rt.ReceiptFromContext(ctx)
+	if receipt == nil {
+		receipt = &rt.Receipt{}
+		ctx = rt.WithReceipt(ctx, receipt)
+	}
+	err := a.next.Postmail(ctx, recipient, message)
+
+	env := rt.EnvelopeFromContext(ctx)
+	rec := &Record{
+		Time:      time.Now().UTC(),
+		Provider:  env.Provider,
+		From:      env.From,
+		Recipient: recipient,
+		Backend:   receipt.Backend,
+		Queue:     receipt.Queue,
+		Action:    receipt.Action,
+		Ticket:    receipt.Ticket,
+		Outcome:   Outcome(err),
+		Size:      len(message),
+		RequestID: rt.RequestIDFromContext(ctx),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	if aerr := a.Save(ctx, rec, []byte(message)); aerr != nil {
+		archived.Add("errors", 1)
+		log := logger.FromContext(ctx)
+		log.ErrorContext(ctx, "could not archive message", "recipient", recipient, "error", aerr)
+	}
+
+	return err
+}
+
+// Outcome classifies the error returned by Postmail.
+func Outcome(err error) string {
+	var rtErr *rt.Error
+	switch {
+	case err == nil:
+		return Delivered
+	case errors.As(err, &rtErr) && rtErr.Rejected:
+		return Rejected
+	case errors.As(err, &rtErr) && rtErr.NotFound:
+		return NotFound
+	}
+	return Failed
+}
+
+// Save stores the message and its record. It sets the ID and Message
+// fields of rec.
+func (a *Archive) Save(ctx context.Context, rec *Record, message []byte) error {
+	id, err := newID(rec.Time)
+	if err != nil {
+		return err
+	}
+	prefix := path.Join(rec.Time.UTC().Format("2006/01/02"), id)
+
+	rec.ID = id
+	rec.Message = prefix + ".eml"
+	data := message
+	if a.Compress {
+		rec.Message += ".gz"
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(message); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	if err := a.Store.Put(ctx, rec.Message, "message/rfc822", data); err != nil {
+		return err
+	}
+
+	if err := a.Update(ctx, rec); err != nil {
+		return err
+	}
+
+	archived.Add(rec.Outcome, 1)
+	return nil
+}
+
+// Update stores a changed record.
+func (a *Archive) Update(ctx context.Context, rec *Record) error {
+	key, err := recordKey(rec.ID)
+	if err != nil {
+		return err
+	}
+	js, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return a.Store.Put(ctx, key, "application/json", js)
+}
+
+// Record returns the record with the given ID.
+func (a *Archive) Record(ctx context.Context, id string) (*Record, error) {
+	key, err := recordKey(id)
+	if err != nil {
+		return nil, err
+	}
+	js, err := a.Store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Record{}
+	if err := json.Unmarshal(js, rec); err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return rec, nil
+}
+
+// recordKey returns the storage key of the record with the given ID.
+func recordKey(id string) (string, error) {
+	ts, suffix, ok := strings.Cut(id, "-")
+	t, err := time.Parse("20060102T150405.000000Z", ts)
+	if _, herr := hex.DecodeString(suffix); !ok || err != nil || herr != nil || suffix == "" {
+		return "", fmt.Errorf("invalid message ID %q", id)
+	}
+	return path.Join(t.Format("2006/01/02"), id+".json"), nil
+}
+
+// newID returns a unique, time ordered ID for a message.
+func newID(t time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return t.UTC().Format("20060102T150405.000000Z") + "-" + hex.EncodeToString(b), nil
+}
+
+// Records returns the records of the messages archived between since and
+// until (inclusive), oldest first. A zero time leaves that end open.
+func (a *Archive) Records(ctx context.Context, since, until time.Time) ([]*Record, error) {
+	var records []*Record
+	err := a.Each(ctx, since, until, func(rec *Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	return records, err
+}
+
+// Each calls fn with the records of the messages archived between since
+// and until (inclusive), oldest first, and stops at the first error.
+// Only the days in the window are listed; a zero since starts at the
+// oldest day in the archive and a zero until at today.
+func (a *Archive) Each(ctx context.Context, since, until time.Time, fn func(*Record) error) error {
+	first := truncateDay(since)
+	if since.IsZero() {
+		oldest, ok, err := a.oldestDay(ctx)
+		if err != nil || !ok {
+			return err
+		}
+		first = oldest
+	}
+	last := truncateDay(until)
+	if until.IsZero() {
+		// allow for clocks a little ahead of ours
+		last = truncateDay(time.Now().Add(24 * time.Hour))
+	}
+
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		objects, err := a.Store.List(ctx, day.Format("2006/01/02/"))
+		if err != nil {
+			return err
+		}
+		for _, o := range objects {
+			if !strings.HasSuffix(o.Key, ".json") {
+				continue
+			}
+			js, err := a.Store.Get(ctx, o.Key)
+			if err != nil {
+				return err
+			}
+			rec := &Record{}
+			if err := json.Unmarshal(js, rec); err != nil {
+				return fmt.Errorf("%s: %w", o.Key, err)
+			}
+			if (!since.IsZero() && rec.Time.Before(since)) || (!until.IsZero() && rec.Time.After(until)) {
+				continue
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// oldestDay returns the first day with archived files, listing the
+// whole archive. It's false if the archive is empty.
+func (a *Archive) oldestDay(ctx context.Context) (time.Time, bool, error) {
+	objects, err := a.Store.List(ctx, "")
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var oldest time.Time
+	for _, o := range objects {
+		if day, ok := keyDate(o.Key); ok && (oldest.IsZero() || day.Before(oldest)) {
+			oldest = day
+		}
+	}
+	return oldest, !oldest.IsZero(), nil
+}
+
+// Message returns the raw message archived with rec.
+func (a *Archive) Message(ctx context.Context, rec *Record) ([]byte, error) {
+	data, err := a.Store.Get(ctx, rec.Message)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(rec.Message, ".gz") {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// Prune deletes the messages archived on days before the one before is
+// in. It returns the number of files deleted. The first call finds the
+// oldest day by listing the whole archive; later ones only list the
+// days since the last cutoff.
+func (a *Archive) Prune(ctx context.Context, before time.Time) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cutoff := truncateDay(before)
+	first := a.prunedTo
+	if first.IsZero() {
+		oldest, ok, err := a.oldestDay(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			oldest = cutoff
+		}
+		first = oldest
+	}
+
+	n := 0
+	for day := first; day.Before(cutoff); day = day.AddDate(0, 0, 1) {
+		objects, err := a.Store.List(ctx, day.Format("2006/01/02/"))
+		if err != nil {
+			return n, err
+		}
+		for _, o := range objects {
+			if err := a.Store.Delete(ctx, o.Key); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	if cutoff.After(a.prunedTo) {
+		a.prunedTo = cutoff
+	}
+	return n, nil
+}
+
+// PruneLoop prunes messages older than the retention every interval
+// until ctx is cancelled. It returns immediately if there's no retention.
+func (a *Archive) PruneLoop(ctx context.Context, interval time.Duration) {
+	if a.Retention <= 0 {
+		return
+	}
+	log := logger.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := a.Prune(ctx, time.Now().Add(-a.Retention))
+		if err != nil {
+			log.ErrorContext(ctx, "could not prune archive", "error", err)
+		} else if n > 0 {
+			log.InfoContext(ctx, "pruned archive", "files", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keyDate returns the day a key is partitioned by.
+func keyDate(key string) (time.Time, bool) {
+	parts := strings.SplitN(key, "/", 4)
+	if len(parts) < 4 {
+		return time.Time{}, false
+	}
+	day, err := time.Parse("2006/01/02", strings.Join(parts[:3], "/"))
+	return day, err == nil
+}
+
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
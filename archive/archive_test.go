@@ -0,0 +1,146 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+// receiptClient fills the receipt like rt.RT does.
+type receiptClient struct {
+	err error
+}
+
+func (c *receiptClient) Postmail(ctx context.Context, recipient, message string) error {
+	if r := rt.ReceiptFromContext(ctx); r != nil {
+		r.Queue, r.Action = "help", "correspond"
+		if c.err == nil {
+			r.Ticket = "42"
+		}
+	}
+	return c.err
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	client := &receiptClient{}
+
+	for _, compress := range []bool{false, true} {
+		a, err := New(ctx, client, &config.Archive{
+			Storage:  config.Storage{Dir: filepath.Join(dir, "archive")},
+			Compress: compress,
+		})
+		testutil.AssertNoError(t, err)
+
+		env := &rt.Envelope{Provider: "mailgun", From: "alice@example.com"}
+		mctx := rt.NewContext(ctx, env)
+		message := "Subject: help\r\n\r\nplease"
+
+		client.err = nil
+		testutil.AssertNoError(t, a.Postmail(mctx, "help@example.com", message))
+
+		client.err = rt.Rejectf("sender blocked")
+		err = a.Postmail(mctx, "help@example.com", message)
+		if !errors.Is(err, client.err) {
+			t.Errorf("error not passed through: %v", err)
+		}
+
+		records, err := a.Records(ctx, time.Time{}, time.Time{})
+		testutil.AssertNoError(t, err)
+		if len(records) != 2 {
+			t.Fatalf("got %d records, want 2", len(records))
+		}
+
+		rec := records[0]
+		if rec.Provider != "mailgun" || rec.From != "alice@example.com" || rec.Recipient != "help@example.com" ||
+			rec.Queue != "help" || rec.Outcome != Delivered || rec.Ticket != "42" || rec.Size != len(message) {
+			t.Errorf("delivered record = %+v", rec)
+		}
+		if records[1].Outcome != Rejected || records[1].Ticket != "" || records[1].Error == "" {
+			t.Errorf("rejected record = %+v", records[1])
+		}
+
+		raw, err := a.Message(ctx, rec)
+		testutil.AssertNoError(t, err)
+		if string(raw) != message {
+			t.Errorf("archived message = %q", raw)
+		}
+		if compress && filepath.Ext(rec.Message) != ".gz" {
+			t.Errorf("message key %q not compressed", rec.Message)
+		}
+
+		n, err := a.Prune(ctx, time.Now().Add(48*time.Hour))
+		testutil.AssertNoError(t, err)
+		if n != 4 {
+			t.Errorf("pruned %d files, want 4", n)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "archive"))
+	if len(entries) != 0 {
+		t.Errorf("empty directories left after pruning: %v", entries)
+	}
+}
+
+func TestRecordsAndPrune(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(ctx, &receiptClient{}, &config.Archive{Storage: config.Storage{Dir: t.TempDir()}})
+	testutil.AssertNoError(t, err)
+
+	days := []time.Time{
+		time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2026, 10, 2, 8, 0, 0, 0, time.UTC),
+	}
+	for _, day := range days {
+		testutil.AssertNoError(t, a.Save(ctx, &Record{Time: day, Recipient: "help@example.com", Outcome: Delivered}, []byte("x")))
+	}
+
+	records, err := a.Records(ctx, time.Date(2026, 10, 1, 13, 0, 0, 0, time.UTC), time.Time{})
+	testutil.AssertNoError(t, err)
+	if len(records) != 1 || !records[0].Time.Equal(days[2]) {
+		t.Errorf("records since = %+v", records)
+	}
+
+	records, err = a.Records(ctx, time.Time{}, time.Date(2026, 10, 1, 23, 0, 0, 0, time.UTC))
+	testutil.AssertNoError(t, err)
+	if len(records) != 2 {
+		t.Errorf("got %d records until, want 2", len(records))
+	}
+
+	n, err := a.Prune(ctx, time.Date(2026, 10, 1, 6, 0, 0, 0, time.UTC))
+	testutil.AssertNoError(t, err)
+	if n != 2 {
+		t.Errorf("pruned %d files, want 2", n)
+	}
+	records, err = a.Records(ctx, time.Time{}, time.Time{})
+	testutil.AssertNoError(t, err)
+	if len(records) != 2 {
+		t.Errorf("%d records left, want 2", len(records))
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, Delivered},
+		{rt.Rejectf("no"), Rejected},
+		{&rt.Error{NotFound: true}, NotFound},
+		{errors.New("RT failure"), Failed},
+	}
+	for _, tt := range tests {
+		if got := Outcome(tt.err); got != tt.want {
+			t.Errorf("Outcome(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Package attachment rewrites the attachments of a MIME message while
+// keeping the rest of the message structure byte for byte intact.
+package attachment
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// maxDepth limits how deeply nested multiparts are walked.
+const maxDepth = 10
+
+// Part is an attachment in a message.
+type Part struct {
+	Header      textproto.MIMEHeader
+	ContentType string // media type, e.g. "application/pdf"
+	Filename    string
+	// Size is the size of the part's body as encoded in the message.
+	Size int
+
+	body []byte
+}
+
+// Content returns the decoded content of the attachment.
+func (p *Part) Content() ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding, &stripNewlines{r: bytes.NewReader(p.body)}))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.body)))
+	default:
+		return p.body, nil
+	}
+}
+
+// Func is called for each attachment. It returns the text to replace the
+// attachment with, or "" to keep it.
+type Func func(p *Part) (replacement string, err error)
+
+// Rewrite calls fn for every attachment in the message and replaces the
+// attachments fn returns a replacement for with a text/plain part. It
+// reports whether anything was replaced.
+func Rewrite(raw []byte, fn Func) ([]byte, bool, error) {
+	header, body, nl := splitPart(raw)
+	if header == nil {
+		return raw, false, nil
+	}
+	boundary := multipartBoundary(header)
+	if boundary == "" {
+		return raw, false, nil
+	}
+
+	newBody, changed, err := rewriteMultipart(body, boundary, nl, fn, 0)
+	if err != nil || !changed {
+		return raw, false, err
+	}
+	out := make([]byte, 0, len(raw))
+	out = append(out, raw[:len(raw)-len(body)]...)
+	out = append(out, newBody...)
+	return out, true, nil
+}
+
+// Walk calls fn for every attachment without changing the message.
+func Walk(raw []byte, fn func(p *Part)) error {
+	_, _, err := Rewrite(raw, func(p *Part) (string, error) {
+		fn(p)
+		return "", nil
+	})
+	return err
+}
+
+func rewriteMultipart(body []byte, boundary, nl string, fn Func, depth int) ([]byte, bool, error) {
+	if depth > maxDepth {
+		return body, false, nil
+	}
+
+	delim := []byte("--" + boundary)
+	parts, ok := splitMultipart(body, delim)
+	if !ok {
+		return body, false, nil
+	}
+
+	changed := false
+	var out bytes.Buffer
+	for i, seg := range parts {
+		// even segments are the preamble, delimiters and epilogue,
+		// odd ones are parts
+		if i%2 == 0 {
+			out.Write(seg)
+			continue
+		}
+		newPart, partChanged, err := rewritePart(seg, nl, fn, depth)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = changed || partChanged
+		out.Write(newPart)
+	}
+	return out.Bytes(), changed, nil
+}
+
+func rewritePart(raw []byte, nl string, fn Func, depth int) ([]byte, bool, error) {
+	header, body, _ := splitPart(raw)
+	if header == nil {
+		return raw, false, nil
+	}
+
+	if boundary := multipartBoundary(header); boundary != "" {
+		newBody, changed, err := rewriteMultipart(body, boundary, nl, fn, depth+1)
+		if err != nil || !changed {
+			return raw, false, err
+		}
+		return append(append([]byte{}, raw[:len(raw)-len(body)]...), newBody...), true, nil
+	}
+
+	p := newPart(header, body)
+	if p == nil {
+		return raw, false, nil
+	}
+	replacement, err := fn(p)
+	if err != nil || replacement == "" {
+		return raw, false, err
+	}
+
+	text := strings.ReplaceAll(strings.TrimRight(replacement, "\r\n"), "\n", nl)
+	var out strings.Builder
+	out.WriteString("Content-Type: text/plain; charset=utf-8" + nl)
+	out.WriteString("Content-Disposition: inline" + nl)
+	out.WriteString("Content-Transfer-Encoding: 8bit" + nl)
+	out.WriteString(nl)
+	out.WriteString(text)
+	return []byte(out.String()), true, nil
+}
+
+// newPart returns the Part for a leaf part, or nil if it isn't an attachment.
+func newPart(header textproto.MIMEHeader, body []byte) *Part {
+	mediaType, ctParams, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	disposition, dParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+
+	filename := dParams["filename"]
+	if filename == "" {
+		filename = ctParams["name"]
+	}
+	if disposition != "attachment" && filename == "" {
+		return nil
+	}
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+
+	return &Part{
+		Header:      header,
+		ContentType: mediaType,
+		Filename:    filename,
+		Size:        len(body),
+		body:        body,
+	}
+}
+
+// splitMultipart splits a multipart body into alternating segments:
+// preamble+delimiter, part, delimiter, part, ..., close delimiter+epilogue.
+// The line break before a delimiter belongs to the delimiter.
+func splitMultipart(body, delim []byte) ([][]byte, bool) {
+	var segs [][]byte
+	start := 0 // start of the current segment
+	pos := 0
+	inPart := false
+	closed := false
+	for pos < len(body) && !closed {
+		lineEnd := bytes.IndexByte(body[pos:], '\n')
+		next := len(body)
+		if lineEnd >= 0 {
+			next = pos + lineEnd + 1
+		}
+		line := bytes.TrimRight(body[pos:next], "\r\n")
+		if bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t")
+			isClose := bytes.Equal(rest, []byte("--"))
+			if len(rest) == 0 || isClose {
+				// the delimiter starts at the line break before it
+				delimStart := pos
+				if delimStart > start && body[delimStart-1] == '\n' {
+					delimStart--
+					if delimStart > start && body[delimStart-1] == '\r' {
+						delimStart--
+					}
+				}
+				if inPart {
+					segs = append(segs, body[start:delimStart])
+					start = delimStart
+				}
+				if isClose {
+					closed = true
+					next = len(body)
+				}
+				segs = append(segs, body[start:next])
+				start = next
+				inPart = !isClose
+			}
+		}
+		pos = next
+	}
+	if !closed {
+		return nil, false
+	}
+	return segs, true
+}
+
+// splitPart splits a message or part into its parsed header and raw body,
+// and returns the line ending it uses.
+func splitPart(raw []byte) (textproto.MIMEHeader, []byte, string) {
+	nl := "\r\n"
+	idx := bytes.Index(raw, []byte("\r\n\r\n"))
+	bodyStart := idx + 4
+	if lf := bytes.Index(raw, []byte("\n\n")); lf >= 0 && (idx < 0 || lf < idx) {
+		nl = "\n"
+		idx, bodyStart = lf, lf+2
+	}
+	if idx < 0 {
+		return nil, nil, nl
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw[:idx+len(nl)*2]))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, nil, nl
+	}
+	return header, raw[bodyStart:], nl
+}
+
+func multipartBoundary(header textproto.MIMEHeader) string {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// stripNewlines drops line breaks from base64 content.
+type stripNewlines struct {
+	r io.Reader
+}
+
+func (s *stripNewlines) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+// FormatSize formats a size in bytes for a placeholder note.
+func FormatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -0,0 +1,152 @@
+package attachment
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"go.askask.com/rt-mail/testutil"
+)
+
+const testMessage = "From: alice@example.com\r\n" +
+	"To: help@example.com\r\n" +
+	"Subject: report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>See attached.</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQKJWZha2UgcGRm\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/csv\r\n" +
+	"Content-Disposition: attachment; filename=data.csv\r\n" +
+	"\r\n" +
+	"a,b\r\n1,2\r\n" +
+	"--outer--\r\n" +
+	"epilogue\r\n"
+
+func TestWalk(t *testing.T) {
+	var parts []*Part
+	err := Walk([]byte(testMessage), func(p *Part) {
+		parts = append(parts, p)
+	})
+	testutil.AssertNoError(t, err)
+
+	if len(parts) != 2 {
+		t.Fatalf("found %d attachments, want 2", len(parts))
+	}
+	if parts[0].Filename != "report.pdf" || parts[0].ContentType != "application/pdf" {
+		t.Errorf("first attachment = %q (%s)", parts[0].Filename, parts[0].ContentType)
+	}
+	content, err := parts[0].Content()
+	testutil.AssertNoError(t, err)
+	if string(content) != "%PDF-1.4\n%fake pdf" {
+		t.Errorf("decoded content = %q", content)
+	}
+	if parts[1].Filename != "data.csv" || parts[1].Size != len("a,b\r\n1,2") {
+		t.Errorf("second attachment = %q (%d bytes)", parts[1].Filename, parts[1].Size)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	out, changed, err := Rewrite([]byte(testMessage), func(p *Part) (string, error) {
+		if p.Filename == "report.pdf" {
+			return "report.pdf was removed\n", nil
+		}
+		return "", nil
+	})
+	testutil.AssertNoError(t, err)
+	if !changed {
+		t.Fatal("message not changed")
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	testutil.AssertNoError(t, err)
+	if msg.Header.Get("Subject") != "report" {
+		t.Errorf("Subject = %q", msg.Header.Get("Subject"))
+	}
+
+	// the rewritten message must still parse as the same multipart
+	mr := multipart.NewReader(msg.Body, "outer")
+	var texts []string
+	for {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			break
+		}
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(p)
+		texts = append(texts, p.Header.Get("Content-Type")+": "+buf.String())
+	}
+	if len(texts) != 3 {
+		t.Fatalf("got %d parts, want 3: %q", len(texts), texts)
+	}
+	if texts[1] != "text/plain; charset=utf-8: report.pdf was removed" {
+		t.Errorf("replacement part = %q", texts[1])
+	}
+	if texts[2] != "text/csv: a,b\r\n1,2" {
+		t.Errorf("kept part = %q", texts[2])
+	}
+	if !strings.HasSuffix(string(out), "--outer--\r\nepilogue\r\n") {
+		t.Error("epilogue not preserved")
+	}
+
+	unchanged, changed, err := Rewrite([]byte(testMessage), func(p *Part) (string, error) {
+		return "", nil
+	})
+	testutil.AssertNoError(t, err)
+	if changed || string(unchanged) != testMessage {
+		t.Error("message changed without replacements")
+	}
+}
+
+func TestRewriteLF(t *testing.T) {
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nhi\n--b\n" +
+		"Content-Type: image/png\nContent-Disposition: attachment; filename=a.png\n" +
+		"Content-Transfer-Encoding: base64\n\n" + base64.StdEncoding.EncodeToString([]byte("png")) + "\n--b--\n"
+
+	out, changed, err := Rewrite([]byte(msg), func(p *Part) (string, error) {
+		return "removed", nil
+	})
+	testutil.AssertNoError(t, err)
+	if !changed {
+		t.Fatal("message not changed")
+	}
+	want := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nhi\n--b\n" +
+		"Content-Type: text/plain; charset=utf-8\nContent-Disposition: inline\n" +
+		"Content-Transfer-Encoding: 8bit\n\nremoved\n--b--\n"
+	if string(out) != want {
+		t.Errorf("got\n%q\nwant\n%q", out, want)
+	}
+}
+
+func TestNotMultipart(t *testing.T) {
+	msg := "Subject: hi\r\n\r\nhello\r\n"
+	out, changed, err := Rewrite([]byte(msg), func(p *Part) (string, error) {
+		t.Error("called for a message without attachments")
+		return "", nil
+	})
+	testutil.AssertNoError(t, err)
+	if changed || string(out) != msg {
+		t.Error("message changed")
+	}
+}
@@ -0,0 +1,260 @@
+// Package auth verifies the SPF, DKIM and DMARC authentication of
+// inbound messages and records the results in an Authentication-Results
+// header (RFC 8601) for RT.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+)
+
+// Result is an authentication result as used in Authentication-Results.
+type Result string
+
+// Authentication results.
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	Neutral   Result = "neutral"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Results holds the authentication results for a message.
+type Results struct {
+	SPF      Result
+	MailFrom string
+	// SPFSource is set when the SPF result came from the provider
+	// rather than being evaluated by rt-mail.
+	SPFSource string
+	DKIM      []DKIMResult
+	DMARC     DMARCResult
+}
+
+// Header formats the results as the value of an Authentication-Results
+// header, folded with the line ending eol.
+func (r *Results) Header(authservID, eol string) string {
+	var sb strings.Builder
+	sb.WriteString(authservID)
+
+	sb.WriteString(";" + eol + "\tspf=")
+	sb.WriteString(string(r.SPF))
+	if r.SPFSource != "" {
+		fmt.Fprintf(&sb, " (reported by %s)", r.SPFSource)
+	}
+	if r.MailFrom != "" {
+		sb.WriteString(" smtp.mailfrom=")
+		sb.WriteString(r.MailFrom)
+	}
+
+	if len(r.DKIM) == 0 {
+		sb.WriteString(";" + eol + "\tdkim=none")
+	}
+	for _, d := range r.DKIM {
+		fmt.Fprintf(&sb, ";%s\tdkim=%s", eol, d.Result)
+		if d.Reason != "" && d.Result != Pass {
+			fmt.Fprintf(&sb, " (%s)", d.Reason)
+		}
+		if d.Domain != "" {
+			fmt.Fprintf(&sb, " header.d=%s", d.Domain)
+		}
+		if d.Selector != "" {
+			fmt.Fprintf(&sb, " header.s=%s", d.Selector)
+		}
+	}
+
+	fmt.Fprintf(&sb, ";%s\tdmarc=%s", eol, r.DMARC.Result)
+	if r.DMARC.Policy != "" {
+		fmt.Fprintf(&sb, " (p=%s)", r.DMARC.Policy)
+	}
+	if r.DMARC.Domain != "" {
+		fmt.Fprintf(&sb, " header.from=%s", r.DMARC.Domain)
+	}
+
+	return sb.String()
+}
+
+// Verifier is a filter checking SPF, DKIM and DMARC.
+type Verifier struct {
+	Resolver   Resolver
+	AuthservID string
+
+	// Timeout bounds the checks of a message, if set.
+	Timeout time.Duration
+
+	// QuarantineQueue is the queue messages failing DMARC are routed to
+	// when the sender's policy is quarantine or reject.
+	QuarantineQueue string
+}
+
+// NewVerifier returns a Verifier configured from cfg.
+func NewVerifier(cfg *config.Auth) *Verifier {
+	timeout := cfg.Timeout.Or(5 * time.Second)
+	v := &Verifier{
+		Resolver:        NewResolver(cfg.Resolver, timeout),
+		AuthservID:      cfg.AuthservID,
+		Timeout:         timeout,
+		QuarantineQueue: cfg.QuarantineQueue,
+	}
+	if v.AuthservID == "" {
+		v.AuthservID, _ = os.Hostname()
+	}
+	if v.AuthservID == "" {
+		v.AuthservID = "rt-mail"
+	}
+	return v
+}
+
+// Check evaluates SPF, DKIM and DMARC for the message. Verdicts supplied
+// by the provider are used for checks rt-mail can't do itself (SPF
+// without the connecting IP, DMARC without SPF).
+func (v *Verifier) Check(ctx context.Context, raw []byte, env *rt.Envelope) *Results {
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+	res := &Results{SPF: None, MailFrom: env.From}
+
+	if ip := net.ParseIP(env.RemoteIP); ip != nil && env.From != "" {
+		res.SPF = CheckSPF(ctx, v.Resolver, ip, env.From, "")
+	} else if env.SPF != "" {
+		res.SPF = Result(env.SPF)
+		res.SPFSource = env.Provider
+	}
+
+	res.DKIM = VerifyDKIM(ctx, v.Resolver, raw)
+	res.DMARC = CheckDMARC(ctx, v.Resolver, FromDomain(raw), res.SPF, env.From, res.DKIM)
+
+	// Without the connecting IP and a provider SPF verdict DMARC can
+	// only pass on DKIM; trust the provider's DMARC evaluation instead.
+	if res.DMARC.Result == Fail && env.DMARC != "" && res.SPFSource == "" && env.RemoteIP == "" {
+		res.DMARC.Result = Result(env.DMARC)
+	}
+
+	return res
+}
+
+// Filter adds an Authentication-Results header to the message, renaming
+// any already in it with our authserv-id, records the results in the
+// envelope and routes messages failing DMARC to the quarantine queue.
+func (v *Verifier) Filter(ctx context.Context, msg *filter.Message) error {
+	log := logger.FromContext(ctx)
+
+	res := v.Check(ctx, msg.Raw, msg.Envelope)
+
+	dkim := None
+	for _, d := range res.DKIM {
+		if d.Result == Pass {
+			dkim = Pass
+			break
+		}
+		dkim = d.Result
+	}
+	msg.Envelope.SPF = string(res.SPF)
+	msg.Envelope.DKIM = string(dkim)
+	msg.Envelope.DMARC = string(res.DMARC.Result)
+
+	log.InfoContext(ctx, "authentication results",
+		"recipient", msg.Recipient,
+		"spf", res.SPF,
+		"dkim", dkim,
+		"dmarc", res.DMARC.Result,
+		"from_domain", res.DMARC.Domain,
+	)
+
+	var forged int
+	msg.Raw, forged = renameResults(msg.Raw, v.AuthservID)
+	if forged > 0 {
+		log.WarnContext(ctx, "renamed inbound Authentication-Results claiming to be ours",
+			"recipient", msg.Recipient,
+			"count", forged,
+		)
+	}
+	msg.AddHeader("Authentication-Results", res.Header(v.AuthservID, msg.EOL()))
+
+	if res.DMARC.Result == Fail && v.QuarantineQueue != "" &&
+		(res.DMARC.Policy == "quarantine" || res.DMARC.Policy == "reject") {
+		msg.Route(v.QuarantineQueue, "correspond")
+	}
+
+	return nil
+}
+
+// renameResults renames the Authentication-Results fields in the
+// message's header claiming to be from authservID to
+// X-Original-Authentication-Results, so only our own results carry our
+// name (RFC 8601 section 5). It returns the message and the number of
+// fields renamed.
+func renameResults(raw []byte, authservID string) ([]byte, int) {
+	const name = "authentication-results"
+	var forged []int // offsets of the fields
+	for i := 0; i < len(raw); {
+		end := len(raw)
+		if n := bytes.IndexByte(raw[i:], '\n'); n >= 0 {
+			end = i + n + 1
+		}
+		line := raw[i:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break // end of the header
+		}
+		// the field ends before the next line not starting with whitespace
+		next := end
+		for next < len(raw) && (raw[next] == ' ' || raw[next] == '\t') {
+			if n := bytes.IndexByte(raw[next:], '\n'); n >= 0 {
+				next += n + 1
+			} else {
+				next = len(raw)
+			}
+		}
+		field, value, ok := strings.Cut(string(raw[i:next]), ":")
+		if ok && strings.EqualFold(strings.TrimRight(field, " \t"), name) &&
+			strings.EqualFold(resultsAuthservID(value), authservID) {
+			forged = append(forged, i)
+		}
+		i = next
+	}
+	if len(forged) == 0 {
+		return raw, 0
+	}
+
+	out := make([]byte, 0, len(raw)+len(forged)*len("X-Original-"))
+	last := 0
+	for _, i := range forged {
+		out = append(out, raw[last:i]...)
+		out = append(out, "X-Original-"...)
+		last = i
+	}
+	out = append(out, raw[last:]...)
+	return out, len(forged)
+}
+
+// resultsAuthservID returns the authserv-id an Authentication-Results
+// value starts with, skipping comments.
+func resultsAuthservID(value string) string {
+	value = strings.TrimSpace(value)
+	for strings.HasPrefix(value, "(") {
+		_, after, ok := strings.Cut(value, ")")
+		if !ok {
+			return ""
+		}
+		value = strings.TrimSpace(after)
+	}
+	if i := strings.IndexAny(value, "; \t\r\n("); i >= 0 {
+		value = value[:i]
+	}
+	return value
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+func TestVerifierFilter(t *testing.T) {
+	resolver := &fakeResolver{txt: map[string][]string{
+		"example.com":        {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"mail.example.com":   {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=none"},
+		"_dmarc.example.org": {"v=DMARC1; p=none"},
+	}}
+
+	tests := []struct {
+		name      string
+		env       rt.Envelope
+		from      string
+		wantDMARC string
+		wantQueue string
+		wantSPF   string
+	}{
+		{
+			name:      "aligned spf",
+			env:       rt.Envelope{Provider: "sendgrid", From: "bounce@mail.example.com", RemoteIP: "192.0.2.1"},
+			from:      "alice@example.com",
+			wantDMARC: "pass",
+			wantSPF:   "spf=pass smtp.mailfrom=bounce@mail.example.com",
+		},
+		{
+			name:      "spf fail with reject policy",
+			env:       rt.Envelope{Provider: "sendgrid", From: "alice@example.com", RemoteIP: "203.0.113.1"},
+			from:      "alice@example.com",
+			wantDMARC: "fail",
+			wantQueue: "quarantine",
+		},
+		{
+			name:      "unaligned spf from provider",
+			env:       rt.Envelope{Provider: "ses", From: "alice@other.example", SPF: "pass"},
+			from:      "alice@example.com",
+			wantDMARC: "fail",
+			wantQueue: "quarantine",
+			wantSPF:   "spf=pass (reported by ses)",
+		},
+		{
+			name:      "subdomain policy none",
+			env:       rt.Envelope{Provider: "ses", From: "alice@other.example", SPF: "pass"},
+			from:      "alice@sub.example.com",
+			wantDMARC: "fail",
+		},
+		{
+			name:      "no dmarc record",
+			env:       rt.Envelope{Provider: "mailgun", From: "alice@example.net"},
+			from:      "alice@example.net",
+			wantDMARC: "none",
+			wantSPF:   "spf=none",
+		},
+		{
+			name:      "provider dmarc used without spf",
+			env:       rt.Envelope{Provider: "ses", From: "alice@example.com", DMARC: "pass"},
+			from:      "alice@example.com",
+			wantDMARC: "pass",
+		},
+	}
+
+	v := &Verifier{Resolver: resolver, AuthservID: "rt-mail.test", QuarantineQueue: "quarantine"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env
+			msg := &filter.Message{
+				Recipient: "help@example.net",
+				Raw:       []byte("From: " + tt.from + "\r\nSubject: hi\r\n\r\nbody\r\n"),
+				Envelope:  &env,
+			}
+			testutil.AssertNoError(t, v.Filter(context.Background(), msg))
+
+			if env.DMARC != tt.wantDMARC {
+				t.Errorf("dmarc = %q, want %q", env.DMARC, tt.wantDMARC)
+			}
+			if msg.Queue != tt.wantQueue {
+				t.Errorf("queue = %q, want %q", msg.Queue, tt.wantQueue)
+			}
+
+			var got string
+			mock := &testutil.MockRTClient{PostmailFunc: func(_ string, message string) error {
+				got = message
+				return nil
+			}}
+			c, err := filter.New(mock, &config.Filters{})
+			testutil.AssertNoError(t, err)
+			c.Use(v)
+			env = tt.env
+			testutil.AssertNoError(t, c.Postmail(rt.NewContext(context.Background(), &env), msg.Recipient, string(msg.Raw)))
+
+			if !strings.HasPrefix(got, "Authentication-Results: rt-mail.test;\r\n\t") {
+				t.Errorf("message doesn't start with Authentication-Results:\n%s", got)
+			}
+			if !strings.Contains(got, "dmarc="+tt.wantDMARC) {
+				t.Errorf("header doesn't contain dmarc=%s:\n%s", tt.wantDMARC, got)
+			}
+			if tt.wantSPF != "" && !strings.Contains(got, tt.wantSPF) {
+				t.Errorf("header doesn't contain %q:\n%s", tt.wantSPF, got)
+			}
+		})
+	}
+}
+
+func TestRenameResults(t *testing.T) {
+	raw := "Authentication-Results: RT-Mail.test;\n\tdkim=pass; dmarc=pass\n" +
+		"Authentication-Results: mx.example.org; spf=pass\n" +
+		"authentication-results : (forged) rt-mail.test; dmarc=pass\n" +
+		"Subject: Authentication-Results: rt-mail.test;\n\nAuthentication-Results: rt-mail.test; body\n"
+	want := "X-Original-Authentication-Results: RT-Mail.test;\n\tdkim=pass; dmarc=pass\n" +
+		"Authentication-Results: mx.example.org; spf=pass\n" +
+		"X-Original-authentication-results : (forged) rt-mail.test; dmarc=pass\n" +
+		"Subject: Authentication-Results: rt-mail.test;\n\nAuthentication-Results: rt-mail.test; body\n"
+	got, n := renameResults([]byte(raw), "rt-mail.test")
+	if string(got) != want || n != 2 {
+		t.Errorf("renamed %d:\n%s\nwant\n%s", n, got, want)
+	}
+	if got, n := renameResults([]byte(want), "rt-mail.test"); string(got) != want || n != 0 {
+		t.Errorf("renamed %d in\n%s", n, got)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	v := &Verifier{Resolver: slowResolver{}, AuthservID: "rt-mail.test", Timeout: 50 * time.Millisecond}
+	raw := []byte("From: alice@example.com\r\nDKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=s1; h=from; bh=x; b=y\r\n\r\nhi\r\n")
+	env := &rt.Envelope{From: "alice@example.com", RemoteIP: "192.0.2.1"}
+
+	start := time.Now()
+	res := v.Check(context.Background(), raw, env)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Check took %s", elapsed)
+	}
+	if res.DMARC.Result == Pass {
+		t.Errorf("DMARC = %s after the lookups timed out", res.DMARC.Result)
+	}
+}
+
+func TestResultsHeader(t *testing.T) {
+	r := &Results{
+		SPF:      Pass,
+		MailFrom: "bounce@example.com",
+		DKIM:     []DKIMResult{{Result: Pass, Domain: "example.com", Selector: "s1"}},
+		DMARC:    DMARCResult{Result: Pass, Domain: "example.com", Policy: "reject"},
+	}
+	want := "mx.example.net;\r\n\tspf=pass smtp.mailfrom=bounce@example.com;\r\n\tdkim=pass header.d=example.com header.s=s1;\r\n\tdmarc=pass (p=reject) header.from=example.com"
+	if got := r.Header("mx.example.net", "\r\n"); got != want {
+		t.Errorf("Header() =\n%q\nwant\n%q", got, want)
+	}
+	if got, want := r.Header("mx.example.net", "\n"), strings.ReplaceAll(want, "\r\n", "\n"); got != want {
+		t.Errorf("Header() with LF =\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,402 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // rsa-sha1 is still seen in the wild
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDKIMSignatures limits how many signatures are checked per message.
+const maxDKIMSignatures = 5
+
+// DKIMResult is the result of verifying one DKIM-Signature header.
+type DKIMResult struct {
+	Result   Result
+	Domain   string // d= tag
+	Selector string // s= tag
+	Reason   string
+}
+
+// header is a header field as it appears in the message, including the
+// trailing CRLF and any folding.
+type header struct {
+	name string
+	raw  string
+}
+
+// splitMessage converts line endings to CRLF and splits the message into
+// its header fields and body.
+func splitMessage(raw []byte) ([]header, []byte) {
+	raw = toCRLF(raw)
+
+	var headers []header
+	rest := raw
+	for len(rest) > 0 {
+		if bytes.HasPrefix(rest, []byte("\r\n")) {
+			return headers, rest[2:]
+		}
+		end := 0
+		for {
+			i := bytes.Index(rest[end:], []byte("\r\n"))
+			if i < 0 {
+				end = len(rest)
+				break
+			}
+			end += i + 2
+			if end >= len(rest) || (rest[end] != ' ' && rest[end] != '\t') {
+				break
+			}
+		}
+		field := string(rest[:end])
+		if name, _, ok := strings.Cut(field, ":"); ok {
+			headers = append(headers, header{name: strings.TrimSpace(name), raw: field})
+		}
+		rest = rest[end:]
+	}
+	return headers, nil
+}
+
+func toCRLF(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n")) || bytes.Count(b, []byte("\n")) == bytes.Count(b, []byte("\r\n")) {
+		return b
+	}
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// VerifyDKIM checks the DKIM signatures on a message.
+func VerifyDKIM(ctx context.Context, resolver Resolver, raw []byte) []DKIMResult {
+	headers, body := splitMessage(raw)
+
+	var results []DKIMResult
+	for _, h := range headers {
+		if !strings.EqualFold(h.name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) == maxDKIMSignatures {
+			break
+		}
+		results = append(results, verifySignature(ctx, resolver, headers, body, h))
+	}
+	return results
+}
+
+// SignedHeaders returns the names (lowercase) of the header fields
+// covered by the message's DKIM signatures. Adding a field with one of
+// these names breaks the signature if the signer listed the name more
+// times than the field appeared, as is done to stop such additions.
+func SignedHeaders(raw []byte) map[string]bool {
+	headers, _ := splitMessage(raw)
+	signed := map[string]bool{}
+	for _, h := range headers {
+		if !strings.EqualFold(h.name, "DKIM-Signature") {
+			continue
+		}
+		_, value, _ := strings.Cut(h.raw, ":")
+		tags, err := parseTags(value)
+		if err != nil {
+			continue
+		}
+		for _, name := range strings.Split(tags["h"], ":") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				signed[name] = true
+			}
+		}
+	}
+	return signed
+}
+
+func verifySignature(ctx context.Context, resolver Resolver, headers []header, body []byte, sigHeader header) DKIMResult {
+	_, value, _ := strings.Cut(sigHeader.raw, ":")
+	tags, err := parseTags(value)
+	if err != nil {
+		return DKIMResult{Result: PermError, Reason: err.Error()}
+	}
+
+	res := DKIMResult{Domain: strings.ToLower(tags["d"]), Selector: tags["s"]}
+	fail := func(r Result, format string, a ...any) DKIMResult {
+		res.Result = r
+		res.Reason = fmt.Sprintf(format, a...)
+		return res
+	}
+
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return fail(PermError, "missing %s= tag", t)
+		}
+	}
+	if tags["v"] != "1" {
+		return fail(PermError, "unsupported version %q", tags["v"])
+	}
+	// RFC 6376 section 5.4: the From field must be signed
+	signsFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		if strings.EqualFold(strings.TrimSpace(name), "from") {
+			signsFrom = true
+			break
+		}
+	}
+	if !signsFrom {
+		return fail(PermError, "From field not signed")
+	}
+	if x, ok := tags["x"]; ok {
+		exp, err := strconv.ParseInt(x, 10, 64)
+		if err == nil && time.Now().Unix() > exp {
+			return fail(Fail, "signature expired")
+		}
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	keyAlgo, hashAlgo, _ := strings.Cut(tags["a"], "-")
+	switch hashAlgo {
+	case "sha256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "sha1":
+		newHash, cryptoHash = sha1.New, crypto.SHA1
+	default:
+		return fail(PermError, "unsupported algorithm %q", tags["a"])
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		headerCanon, bodyCanon, _ = strings.Cut(c, "/")
+		if bodyCanon == "" {
+			bodyCanon = "simple"
+		}
+	}
+	if !validCanon(headerCanon) || !validCanon(bodyCanon) {
+		return fail(PermError, "unsupported canonicalization %q", tags["c"])
+	}
+
+	// Body hash
+	cbody := canonicalBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return fail(PermError, "invalid l= tag")
+		}
+		if n < len(cbody) {
+			cbody = cbody[:n]
+		}
+	}
+	h := newHash()
+	h.Write(cbody)
+	bh, err := base64.StdEncoding.DecodeString(stripWSP(tags["bh"]))
+	if err != nil {
+		return fail(PermError, "invalid bh= tag")
+	}
+	if !bytes.Equal(h.Sum(nil), bh) {
+		return fail(Fail, "body hash did not verify")
+	}
+
+	// Header hash
+	h = newHash()
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		// use the last instance not already used, going bottom up
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headers[i].name, name) {
+				used[i] = true
+				h.Write([]byte(canonicalHeader(headers[i].raw, headerCanon)))
+				break
+			}
+		}
+	}
+	sigNoB := canonicalHeader(removeBTag(sigHeader.raw), headerCanon)
+	h.Write([]byte(strings.TrimSuffix(sigNoB, "\r\n")))
+	digest := h.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return fail(PermError, "invalid b= tag")
+	}
+
+	key, err := lookupDKIMKey(ctx, resolver, res.Selector, res.Domain)
+	if err != nil {
+		if isNotFound(err) {
+			return fail(PermError, "no key for signature")
+		}
+		if _, ok := err.(permError); ok {
+			return fail(PermError, "%s", err)
+		}
+		return fail(TempError, "key lookup: %s", err)
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if keyAlgo != "rsa" {
+			return fail(PermError, "key type mismatch")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, cryptoHash, digest, sig); err != nil {
+			return fail(Fail, "signature did not verify")
+		}
+	case ed25519.PublicKey:
+		if keyAlgo != "ed25519" {
+			return fail(PermError, "key type mismatch")
+		}
+		if !ed25519.Verify(pub, digest, sig) {
+			return fail(Fail, "signature did not verify")
+		}
+	default:
+		return fail(PermError, "unsupported key type")
+	}
+
+	res.Result = Pass
+	return res
+}
+
+type permError string
+
+func (e permError) Error() string { return string(e) }
+
+func lookupDKIMKey(ctx context.Context, resolver Resolver, selector, domain string) (crypto.PublicKey, error) {
+	txts, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(txts) == 0 {
+		return nil, permError("no key for signature")
+	}
+
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, permError("invalid key record")
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permError("invalid key record version")
+	}
+	p := stripWSP(tags["p"])
+	if p == "" {
+		return nil, permError("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permError("invalid key data")
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// some records publish a bare PKCS#1 key
+			pk, err2 := x509.ParsePKCS1PublicKey(der)
+			if err2 != nil {
+				return nil, permError("invalid RSA key")
+			}
+			return pk, nil
+		}
+		return pub, nil
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, permError("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(der), nil
+	default:
+		return nil, permError("unsupported key type " + tags["k"])
+	}
+}
+
+func validCanon(c string) bool {
+	return c == "simple" || c == "relaxed"
+}
+
+// parseTags parses a DKIM/DMARC style "tag=value; tag=value" list.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %q", part)
+		}
+		name = strings.TrimSpace(name)
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// removeBTag empties the value of the b= tag, leaving everything else
+// (including whitespace) as is.
+func removeBTag(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	parts := strings.Split(value, ";")
+	for i, p := range parts {
+		tag, _, ok := strings.Cut(p, "=")
+		if ok && strings.TrimSpace(tag) == "b" {
+			eq := strings.Index(p, "=")
+			parts[i] = p[:eq+1]
+			if strings.HasSuffix(p, "\r\n") {
+				parts[i] += "\r\n"
+			}
+		}
+	}
+	return name + ":" + strings.Join(parts, ";")
+}
+
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// canonicalHeader canonicalizes a header field (RFC 6376 section 3.4.1 and 3.4.2).
+func canonicalHeader(field, canon string) string {
+	if canon == "simple" {
+		return field
+	}
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// canonicalBody canonicalizes the message body (RFC 6376 section 3.4.3 and 3.4.4).
+func canonicalBody(body []byte, canon string) []byte {
+	if canon == "relaxed" {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, line := range lines {
+			fields := bytes.FieldsFunc(line, isWSP)
+			out := bytes.Join(fields, []byte(" "))
+			if len(fields) > 0 && isWSP(rune(line[0])) {
+				out = append([]byte(" "), out...)
+			}
+			lines[i] = out
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+
+	body = bytes.TrimRight(body, "\r\n")
+	if len(body) == 0 {
+		if canon == "relaxed" {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return append(body, '\r', '\n')
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// Examples from RFC 6376 section 3.4.5.
+func TestCanonicalization(t *testing.T) {
+	headers, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	if len(headers) != 2 {
+		t.Fatalf("got %d headers, want 2", len(headers))
+	}
+
+	var relaxed string
+	for _, h := range headers {
+		relaxed += canonicalHeader(h.raw, "relaxed")
+	}
+	if want := "a:X\r\nb:Y Z\r\n"; relaxed != want {
+		t.Errorf("relaxed headers = %q, want %q", relaxed, want)
+	}
+	if got, want := string(canonicalBody(body, "relaxed")), " C\r\nD E\r\n"; got != want {
+		t.Errorf("relaxed body = %q, want %q", got, want)
+	}
+	if got, want := string(canonicalBody(body, "simple")), " C \r\nD \t E\r\n"; got != want {
+		t.Errorf("simple body = %q, want %q", got, want)
+	}
+	if got := string(canonicalBody(nil, "simple")); got != "\r\n" {
+		t.Errorf("simple empty body = %q", got)
+	}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	resolver := &fakeResolver{txt: map[string][]string{
+		"rsa._domainkey.example.com": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"ed._domainkey.example.com":  {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+		"old._domainkey.example.com": {"v=DKIM1; p="},
+	}}
+
+	body := "Hello  there \r\n\r\n"
+	// relaxed body is "Hello there\r\n"
+	bodyHash := sha256.Sum256([]byte("Hello there\r\n"))
+	bh := base64.StdEncoding.EncodeToString(bodyHash[:])
+
+	sign := func(selector, algo string, signer func(digest []byte) []byte) string {
+		sigValue := "v=1; a=" + algo + "; c=relaxed/relaxed; d=example.com; s=" + selector + "; h=from:subject; bh=" + bh + "; b="
+		// the relaxed canonical form of the signed headers, written out by hand
+		signed := "from:Alice <alice@example.com>\r\n" +
+			"subject:Test message\r\n" +
+			"dkim-signature:" + sigValue
+		digest := sha256.Sum256([]byte(signed))
+		return "DKIM-Signature: " + sigValue + base64.StdEncoding.EncodeToString(signer(digest[:])) + "\r\n" +
+			"From: Alice <alice@example.com>\r\n" +
+			"Subject:  Test\r\n message\r\n" +
+			"\r\n" + body
+	}
+	rsaSigner := func(digest []byte) []byte {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	edSigner := func(digest []byte) []byte {
+		return ed25519.Sign(edKey, digest)
+	}
+
+	tests := []struct {
+		name    string
+		message string
+		want    Result
+	}{
+		{"rsa", sign("rsa", "rsa-sha256", rsaSigner), Pass},
+		{"ed25519", sign("ed", "ed25519-sha256", edSigner), Pass},
+		{"lf line endings", strings.ReplaceAll(sign("rsa", "rsa-sha256", rsaSigner), "\r\n", "\n"), Pass},
+		{"added header above", "X-Added: yes\r\n" + sign("rsa", "rsa-sha256", rsaSigner), Pass},
+		{"modified body", sign("rsa", "rsa-sha256", rsaSigner) + "more", Fail},
+		{"modified header", strings.Replace(sign("rsa", "rsa-sha256", rsaSigner), "Alice", "Mallory", 1), Fail},
+		{"from not signed", strings.Replace(sign("rsa", "rsa-sha256", rsaSigner), "h=from:subject", "h=subject", 1), PermError},
+		{"revoked key", sign("old", "rsa-sha256", rsaSigner), PermError},
+		{"unknown selector", sign("none", "rsa-sha256", rsaSigner), PermError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := VerifyDKIM(context.Background(), resolver, []byte(tt.message))
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			if results[0].Result != tt.want {
+				t.Errorf("result = %s (%s), want %s", results[0].Result, results[0].Reason, tt.want)
+			}
+			if results[0].Domain != "example.com" {
+				t.Errorf("domain = %q", results[0].Domain)
+			}
+		})
+	}
+}
+
+func TestSignedHeaders(t *testing.T) {
+	raw := []byte("DKIM-Signature: v=1; d=example.com; s=s1;\r\n\th=From : Subject:\r\n\t subject; bh=x; b=y\r\n" +
+		"DKIM-Signature: v=1; d=example.net; s=s2; h=to; bh=x; b=y\r\n" +
+		"From: a@example.com\r\n\r\nbody\r\n")
+	got := SignedHeaders(raw)
+	for _, name := range []string{"from", "subject", "to"} {
+		if !got[name] {
+			t.Errorf("%s not signed", name)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("got %v, want from, subject and to", got)
+	}
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARCResult is the outcome of evaluating a message against the DMARC
+// policy of its From domain.
+type DMARCResult struct {
+	Result Result
+	Domain string // RFC5322.From domain
+	Policy string // p= (or sp= for subdomains) of the record, if found
+}
+
+type dmarcRecord struct {
+	policy    string
+	subPolicy string
+	adkim     string
+	aspf      string
+}
+
+// CheckDMARC evaluates DMARC (RFC 7489) for a message from fromDomain,
+// given the SPF result for the envelope sender and the DKIM results.
+func CheckDMARC(ctx context.Context, resolver Resolver, fromDomain string, spf Result, mailFrom string, dkim []DKIMResult) DMARCResult {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	res := DMARCResult{Result: None, Domain: fromDomain}
+	if fromDomain == "" {
+		return res
+	}
+
+	org := orgDomain(fromDomain)
+	rec, result := lookupDMARC(ctx, resolver, fromDomain)
+	isSub := false
+	if rec == nil && result == None && org != fromDomain {
+		rec, result = lookupDMARC(ctx, resolver, org)
+		isSub = true
+	}
+	if rec == nil {
+		res.Result = result
+		return res
+	}
+
+	res.Policy = rec.policy
+	if isSub && rec.subPolicy != "" {
+		res.Policy = rec.subPolicy
+	}
+
+	if spf == Pass {
+		_, spfDomain, _ := strings.Cut(mailFrom, "@")
+		if aligned(fromDomain, spfDomain, rec.aspf) {
+			res.Result = Pass
+			return res
+		}
+	}
+	for _, d := range dkim {
+		if d.Result == Pass && aligned(fromDomain, d.Domain, rec.adkim) {
+			res.Result = Pass
+			return res
+		}
+	}
+
+	res.Result = Fail
+	return res
+}
+
+func lookupDMARC(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, Result) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, None
+		}
+		return nil, TempError
+	}
+
+	var record string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			if record != "" {
+				return nil, None
+			}
+			record = txt
+		}
+	}
+	if record == "" {
+		return nil, None
+	}
+
+	tags, err := parseTags(record)
+	if err != nil {
+		return nil, PermError
+	}
+	rec := &dmarcRecord{
+		policy:    strings.ToLower(tags["p"]),
+		subPolicy: strings.ToLower(tags["sp"]),
+		adkim:     strings.ToLower(tags["adkim"]),
+		aspf:      strings.ToLower(tags["aspf"]),
+	}
+	switch rec.policy {
+	case "none", "quarantine", "reject":
+	default:
+		return nil, PermError
+	}
+	return rec, None
+}
+
+// aligned reports whether domain aligns with the From domain in the
+// given mode ("s" for strict, relaxed otherwise).
+func aligned(fromDomain, domain, mode string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if mode == "s" {
+		return domain == fromDomain
+	}
+	return orgDomain(domain) == orgDomain(fromDomain)
+}
+
+// orgDomain returns the organizational domain (RFC 7489 section 3.2).
+func orgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// FromDomain returns the domain of the RFC5322.From address in the
+// message headers, or "" if there isn't exactly one.
+func FromDomain(raw []byte) string {
+	headers, _ := splitMessage(raw)
+	var from string
+	for _, h := range headers {
+		if strings.EqualFold(h.name, "From") {
+			if from != "" {
+				return ""
+			}
+			_, from, _ = strings.Cut(h.raw, ":")
+		}
+	}
+	addrs, err := mail.ParseAddressList(strings.TrimSpace(from))
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	_, domain, _ := strings.Cut(addrs[0].Address, "@")
+	return strings.ToLower(domain)
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Resolver is the subset of *net.Resolver used for SPF, DKIM and DMARC
+// lookups. Tests substitute their own implementation.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// NewResolver returns a resolver using the DNS server at address
+// ("host:port"), or the system resolver if address is empty.
+func NewResolver(address string, timeout time.Duration) Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// isNotFound reports whether err means the name or record doesn't exist,
+// as opposed to a temporary failure.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"net"
+)
+
+// fakeResolver answers lookups from maps instead of DNS.
+type fakeResolver struct {
+	txt map[string][]string
+	ip  map[string][]string
+	mx  map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ip[host]
+	if !ok {
+		return nil, notFound(host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := r.mx[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	var mxs []*net.MX
+	for _, h := range hosts {
+		mxs = append(mxs, &net.MX{Host: h + ".", Pref: 10})
+	}
+	return mxs, nil
+}
+
+// slowResolver doesn't answer until the context is done.
+type slowResolver struct{}
+
+func (slowResolver) LookupTXT(ctx context.Context, _ string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (slowResolver) LookupIPAddr(ctx context.Context, _ string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (slowResolver) LookupMX(ctx context.Context, _ string) ([]*net.MX, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
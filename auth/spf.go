@@ -0,0 +1,360 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxSPFLookups is the limit on DNS-querying terms from RFC 7208 section 4.6.4.
+const maxSPFLookups = 10
+
+var errSPFLimit = errors.New("too many DNS lookups")
+
+// CheckSPF evaluates the SPF policy of the envelope sender's domain for a
+// message sent from ip. helo is used when the sender is empty (bounces).
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, sender, helo string) Result {
+	domain := helo
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		domain = sender[at+1:]
+	} else {
+		sender = "postmaster@" + helo
+	}
+	if domain == "" || ip == nil {
+		return None
+	}
+
+	c := &spfCheck{resolver: resolver, ip: ip, sender: sender, helo: helo}
+	return c.checkHost(ctx, strings.ToLower(strings.TrimSuffix(domain, ".")))
+}
+
+type spfCheck struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+func (c *spfCheck) checkHost(ctx context.Context, domain string) Result {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return None
+		}
+		return TempError
+	}
+
+	var record string
+	for _, txt := range txts {
+		if txt == "v=spf1" || strings.HasPrefix(txt, "v=spf1 ") {
+			if record != "" {
+				return PermError
+			}
+			record = txt
+		}
+	}
+	if record == "" {
+		return None
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		result := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = Fail, term[1:]
+		case '~':
+			result, term = SoftFail, term[1:]
+		case '?':
+			result, term = Neutral, term[1:]
+		}
+
+		match, err := c.mechanism(ctx, domain, term)
+		if err != nil {
+			if errors.Is(err, errSPFLimit) || errors.As(err, new(permError)) {
+				return PermError
+			}
+			return TempError
+		}
+		if match {
+			return result
+		}
+	}
+
+	if redirect != "" {
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return PermError
+		}
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return PermError
+		}
+		result := c.checkHost(ctx, target)
+		if result == None {
+			return PermError
+		}
+		return result
+	}
+
+	return Neutral
+}
+
+// mechanism reports whether the mechanism in term matches the client IP.
+func (c *spfCheck) mechanism(ctx context.Context, domain, term string) (bool, error) {
+	name := term
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name = term[:i]
+	}
+	name = strings.ToLower(name)
+	rest := term[len(name):]
+	cidr := ""
+	if name == "a" || name == "mx" {
+		// a/24, a:example.com/24//64
+		if i := strings.Index(rest, "/"); i >= 0 {
+			rest, cidr = rest[:i], rest[i:]
+		}
+	}
+	arg := strings.TrimPrefix(rest, ":")
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, permError("invalid " + term)
+		}
+		return network.Contains(c.ip), nil
+	case "include":
+		target, err := c.lookupTarget(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		switch c.checkHost(ctx, target) {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, errors.New("temporary error in include")
+		default:
+			return false, permError("include of " + target)
+		}
+	case "a":
+		target, err := c.lookupTarget(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		return c.matchHost(ctx, target, cidr)
+	case "mx":
+		target, err := c.lookupTarget(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := c.resolver.LookupMX(ctx, target)
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		for i, mx := range mxs {
+			if i == 10 {
+				return false, permError("too many MX records")
+			}
+			if ok, err := c.matchHost(ctx, strings.TrimSuffix(mx.Host, "."), cidr); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "exists":
+		target, err := c.lookupTarget(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		addrs, err := c.resolver.LookupIPAddr(ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, err
+		}
+		return len(addrs) > 0, nil
+	case "ptr":
+		// ptr is deprecated (RFC 7208 section 5.5); count it but don't match.
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return false, errSPFLimit
+		}
+		return false, nil
+	default:
+		return false, permError("unknown mechanism " + term)
+	}
+}
+
+// lookupTarget counts a DNS lookup and returns the domain it is for.
+func (c *spfCheck) lookupTarget(arg, domain string) (string, error) {
+	if c.lookups++; c.lookups > maxSPFLookups {
+		return "", errSPFLimit
+	}
+	if arg == "" {
+		return domain, nil
+	}
+	return c.expand(arg, domain)
+}
+
+func (c *spfCheck) matchHost(ctx context.Context, host, cidr string) (bool, error) {
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	bits4, bits6 := 32, 128
+	if cidr != "" {
+		v4, v6, _ := strings.Cut(strings.TrimPrefix(cidr, "/"), "//")
+		if v4 != "" {
+			if bits4, err = strconv.Atoi(v4); err != nil || bits4 > 32 {
+				return false, permError("invalid cidr " + cidr)
+			}
+		}
+		if v6 != "" {
+			if bits6, err = strconv.Atoi(v6); err != nil || bits6 > 128 {
+				return false, permError("invalid cidr " + cidr)
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		var mask net.IPMask
+		if addr.IP.To4() != nil {
+			mask = net.CIDRMask(bits4, 32)
+		} else {
+			mask = net.CIDRMask(bits6, 128)
+		}
+		n := net.IPNet{IP: addr.IP.Mask(mask), Mask: mask}
+		if n.Contains(c.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expand expands the macros in an SPF domain-spec (RFC 7208 section 7).
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+
+	var sb strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			sb.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", permError("invalid macro in " + spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			sb.WriteByte('%')
+			continue
+		case '_':
+			sb.WriteByte(' ')
+			continue
+		case '-':
+			sb.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", permError("invalid macro in " + spec)
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", permError("invalid macro in " + spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch macro[0] | 0x20 {
+		case 's':
+			value = c.sender
+		case 'l':
+			value = local
+		case 'o':
+			value = senderDomain
+		case 'd':
+			value = domain
+		case 'i':
+			if ip4 := c.ip.To4(); ip4 != nil {
+				value = ip4.String()
+			} else {
+				var parts []string
+				for _, b := range c.ip.To16() {
+					parts = append(parts, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+				}
+				value = strings.Join(parts, ".")
+			}
+		case 'v':
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		case 'h':
+			value = c.helo
+		default:
+			return "", permError("unsupported macro " + macro)
+		}
+
+		// transformers: digits, 'r', delimiters
+		rest := macro[1:]
+		digits := 0
+		for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+			digits = digits*10 + int(rest[0]-'0')
+			rest = rest[1:]
+		}
+		reverse := false
+		if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+			reverse = true
+			rest = rest[1:]
+		}
+		delims := rest
+		if delims == "" {
+			delims = "."
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		sb.WriteString(strings.Join(parts, "."))
+	}
+	return sb.String(), nil
+}
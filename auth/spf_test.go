@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestCheckSPF(t *testing.T) {
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":         {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.net mx -all"},
+			"_spf.example.net":    {"some other record", "v=spf1 ip6:2001:db8::/32 a:relay.example.net ~all"},
+			"soft.example.org":    {"v=spf1 redirect=example.com"},
+			"loop.example.org":    {"v=spf1 include:loop.example.org -all"},
+			"neutral.example.org": {"v=spf1 ?all"},
+			"macro.example.org":   {"v=spf1 exists:%{ir}.%{l1r-}.allow.%{d} -all"},
+			"double.example.org":  {"v=spf1 -all", "v=spf1 +all"},
+		},
+		ip: map[string][]string{
+			"relay.example.net":                        {"198.51.100.7"},
+			"mx.example.com":                           {"203.0.113.25"},
+			"7.100.51.198.bob.allow.macro.example.org": {"127.0.0.2"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mx.example.com"},
+		},
+	}
+
+	tests := []struct {
+		ip     string
+		sender string
+		want   Result
+	}{
+		{"192.0.2.10", "user@example.com", Pass},
+		{"2001:db8::1", "user@example.com", Pass},
+		{"198.51.100.7", "user@example.com", Pass},
+		{"203.0.113.25", "user@example.com", Pass},
+		{"203.0.113.99", "user@example.com", Fail},
+		{"192.0.2.10", "user@soft.example.org", Pass},
+		{"203.0.113.99", "user@soft.example.org", Fail},
+		{"192.0.2.10", "user@loop.example.org", PermError},
+		{"192.0.2.10", "user@neutral.example.org", Neutral},
+		{"192.0.2.10", "user@nospf.example.org", None},
+		{"198.51.100.7", "bob@macro.example.org", Pass},
+		{"198.51.100.8", "bob@macro.example.org", Fail},
+		{"192.0.2.10", "user@double.example.org", PermError},
+	}
+
+	for _, tt := range tests {
+		got := CheckSPF(context.Background(), resolver, net.ParseIP(tt.ip), tt.sender, "")
+		if got != tt.want {
+			t.Errorf("CheckSPF(%s, %s) = %s, want %s", tt.ip, tt.sender, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/limits"
+	"go.askask.com/rt-mail/policy"
+	"go.askask.com/rt-mail/proxy"
+	requesttracker "go.askask.com/rt-mail/rt"
+)
+
+// checkConfigCommand implements "rt-mail check-config". It returns the
+// exit code: 1 if errors (or, with -strict, warnings) were found.
+func checkConfigCommand(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configfile := fs.String("config", "rt-mail.json", configUsage)
+	strict := fs.Bool("strict", false, "fail on warnings too")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: rt-mail check-config [-config=rt-mail.json] [-strict]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	var problems []requesttracker.Problem
+	addError := func(format string, a ...any) {
+		problems = append(problems, requesttracker.Problem{Severity: "error", Message: fmt.Sprintf(format, a...)})
+	}
+
+	b, err := os.ReadFile(*configfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err = config.ToJSON(*configfile, b)
+	if err != nil {
+		fmt.Printf("%s: error: %s\n", *configfile, err)
+		return 1
+	}
+
+	// the schema explains values of the wrong type better than Parse
+	invalid, err := config.Validate(b)
+	if err != nil {
+		fmt.Printf("%s: error: %s\n", *configfile, err)
+		return 1
+	}
+	for _, p := range invalid {
+		addError("%s", p)
+	}
+	dups, _ := config.DuplicateKeys(b)
+	for _, key := range dups {
+		addError("duplicate key %q (only the last value is used)", key)
+	}
+
+	cfg, err := config.Parse(b)
+	if err != nil {
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", *configfile, p)
+		}
+		fmt.Printf("%s: error: %s\n", *configfile, err)
+		return 1
+	}
+	unknownEnv, err := config.ApplyEnv(cfg, os.Environ())
+	if err != nil {
+		addError("%s", err)
+	}
+	for _, name := range unknownEnv {
+		problems = append(problems, requesttracker.Problem{
+			Severity: "warning",
+			Message:  fmt.Sprintf("environment variable %s doesn't correspond to a setting", name),
+		})
+	}
+
+	if !hasQueues(cfg) {
+		addError("no queues configured")
+	}
+	problems = append(problems, checkProviders(providerSettings(cfg))...)
+	if l := cfg.Limits; l.MaxRequestSize > 0 && int64(l.MaxRequestSize) < requesttracker.MaxMessageSize(int64(l.MaxSize)) {
+		problems = append(problems, requesttracker.Problem{
+			Severity: "warning",
+			Message:  "limits.max-request-size is below max-size, so oversized messages can't be stripped",
+		})
+	}
+	if err := checkRequireAuth(cfg); err != nil {
+		addError("%s", err)
+	}
+	if o := cfg.Offload; o != nil && o.S3 != nil && o.URL == "" {
+		addError("offload.url is required with offload.s3")
+	}
+	if cfg.Proxy != nil {
+		if _, err := proxy.ParseNets(cfg.Proxy.Trusted); err != nil {
+			addError("proxy.trusted: %s", err)
+		}
+	}
+
+	router, err := requesttracker.NewFromConfig(cfg)
+	if err != nil {
+		addError("%s", err)
+	} else {
+		problems = append(problems, router.Problems()...)
+		if _, err := policy.New(cfg.Policies, router); err != nil {
+			addError("%s", err)
+		}
+		if _, err := limits.New(&cfg.Limits, cfg.Policies, router); err != nil {
+			addError("%s", err)
+		}
+	}
+
+	failed := false
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", *configfile, p)
+		if p.Severity == "error" || *strict {
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", *configfile)
+	}
+	return 0
+}
+
+// hasQueues reports whether any backend or route has a queue.
+func hasQueues(cfg *config.Config) bool {
+	if len(cfg.Queues) > 0 {
+		return true
+	}
+	for _, b := range cfg.Backends {
+		if len(b.Queues) > 0 {
+			return true
+		}
+	}
+	for _, r := range cfg.Routes {
+		if r.Queue != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// routeCommand implements "rt-mail route". It prints the queue and
+// action each address maps to, and returns 1 if any isn't mapped.
+func routeCommand(args []string) int {
+	fs := flag.NewFlagSet("route", flag.ExitOnError)
+	configfile := fs.String("config", "rt-mail.json", configUsage)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: rt-mail route [-config=rt-mail.json] address ...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(*configfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loading configuration file %q: %s\n", *configfile, err)
+		return 1
+	}
+	rt, err := requesttracker.NewFromConfig(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	code := 0
+	for _, address := range fs.Args() {
+		m := rt.Match(address)
+		if m.Queue == "" {
+			fmt.Printf("%s: no queue\n", address)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: backend=%s queue=%s action=%s (%s %q)\n", address, m.Backend, m.Queue, m.Action, m.Rule, m.Target)
+	}
+	return code
+}
+
+// schemaCommand implements "rt-mail schema", printing the JSON Schema
+// for the configuration file.
+func schemaCommand(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: rt-mail schema > %s\n", config.SchemaFile)
+	}
+	_ = fs.Parse(args)
+	if _, err := os.Stdout.Write(config.Schema()); err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,586 @@
+// Package config loads the rt-mail configuration file.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the rt-mail configuration file.
+type Config struct {
+	// RTUrl, RTAuth, RTTLS, RTRetry, RTBreaker, RTReplies and Queues
+	// configure the default RT backend.
+	RTUrl     string       `json:"rt-url"`
+	RTAuth    *RTAuth      `json:"rt-auth,omitempty"`
+	RTTLS     *TLS         `json:"rt-tls,omitempty"`
+	RTRetry   *Retry       `json:"rt-retry,omitempty"`
+	RTBreaker *Breaker     `json:"rt-breaker,omitempty"`
+	RTReplies *Replies     `json:"rt-replies,omitempty"`
+	Queues    AddressQueue `json:"queues"`
+	Filters   Filters      `json:"filters,omitempty"`
+	Auth      *Auth        `json:"auth,omitempty"`
+	Limits    Limits       `json:"limits,omitempty"`
+	Offload   *Offload     `json:"offload,omitempty"`
+	Archive   *Archive     `json:"archive,omitempty"`
+	Admin     *Admin       `json:"admin,omitempty"`
+
+	// Providers selects the email service providers. Without it
+	// SparkPost, SendGrid and Mailgun are enabled at their default
+	// paths, and SES if RT_SES_SNS_TOPIC_ARN is set.
+	Providers *Providers `json:"providers,omitempty"`
+
+	// Concurrency limits the messages posted to RT at the same time.
+	Concurrency *Concurrency `json:"concurrency,omitempty"`
+
+	// RequestIDHeader adds an X-RT-Mail-Request-ID header with the ID
+	// of the webhook request to the messages posted to RT, so tickets
+	// can be traced to the gateway's logs.
+	RequestIDHeader bool `json:"request-id-header,omitempty"`
+
+	// RecipientField posts the envelope recipient to RT in a form field
+	// of this name along with the message, for scrips to use.
+	RecipientField string `json:"recipient-field,omitempty"`
+
+	// Trace adds headers to the messages posted to RT telling how
+	// they were delivered.
+	Trace *Trace `json:"trace,omitempty"`
+
+	// Proxy configures the proxies and load balancers in front of
+	// rt-mail.
+	Proxy *Proxy `json:"proxy,omitempty"`
+
+	// RateLimits limits how fast requests and messages are accepted.
+	RateLimits *RateLimits `json:"rate-limits,omitempty"`
+
+	// Backends are additional RT instances, by name. Routes pick the
+	// backend for a recipient; the first matching route is used.
+	Backends map[string]*Backend `json:"backends,omitempty"`
+	Routes   []*Route            `json:"routes,omitempty"`
+
+	// Policies restricts who can send to a queue, keyed by queue name.
+	// The "*" policy applies to queues without their own.
+	Policies map[string]*Policy `json:"policies,omitempty"`
+}
+
+// AddressQueue contains a Address to Queue mapping
+type AddressQueue map[string]string
+
+// DefaultBackend is the name of the backend configured with rt-url.
+const DefaultBackend = "default"
+
+// Backend configures an RT instance.
+type Backend struct {
+	// Type is how messages are posted. Only "mail-gateway", RT's
+	// mail gateway (the default), is supported.
+	Type string `json:"type,omitempty" enum:"mail-gateway"`
+
+	URL  string  `json:"url"`
+	Auth *RTAuth `json:"auth,omitempty"`
+	TLS  *TLS    `json:"tls,omitempty"`
+
+	// Timeout is the time allowed for posting a message, 10s by
+	// default, and ConnectTimeout for connecting, 5s by default.
+	Timeout        Duration `json:"timeout,omitempty"`
+	ConnectTimeout Duration `json:"connect-timeout,omitempty"`
+
+	Retry   *Retry   `json:"retry,omitempty"`
+	Breaker *Breaker `json:"breaker,omitempty"`
+	Replies *Replies `json:"replies,omitempty"`
+
+	// Queues maps addresses to the backend's queues, as the top level
+	// queues do for the default backend.
+	Queues AddressQueue `json:"queues,omitempty"`
+}
+
+// RTAuth configures how rt-mail authenticates to RT: with HTTP basic
+// authentication or an RT auth token (RT::Authen::Token), and/or a
+// header with a shared secret checked by a reverse proxy.
+type RTAuth struct {
+	User     string `json:"user,omitempty"`
+	Password Secret `json:"password,omitempty"`
+
+	Token Secret `json:"token,omitempty"`
+
+	Header string `json:"header,omitempty"`
+	Value  Secret `json:"value,omitempty"`
+}
+
+// TLS configures the TLS client: a CA bundle to verify the server
+// with instead of the system roots, and a client certificate. The
+// settings are names of PEM files.
+type TLS struct {
+	CA   string `json:"ca,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// Replies configures finding the ticket a message replies to, from
+// RT's subject tag or the RT Message-IDs in In-Reply-To and References,
+// so it's posted to that ticket even if sent to another address.
+type Replies struct {
+	// RTName is RT's $rtname, as in subject tags like
+	// "[example.com #1234]".
+	RTName string `json:"rt-name,omitempty"`
+
+	// SubjectTag is a regular expression matching the subject tag,
+	// with the ticket number as its first group, for RT instances
+	// with their own $EmailSubjectTagRegex. By default it's made from
+	// RTName.
+	SubjectTag string `json:"subject-tag,omitempty"`
+
+	// Organization is RT's $Organization, the domain of the
+	// Message-IDs RT generates. Without it only subject tags are used.
+	Organization string `json:"organization,omitempty"`
+
+	// Queue is the queue replies to addresses not mapped to a queue
+	// are posted with, "General" by default. RT adds them to the
+	// ticket; the queue is only used if the ticket doesn't exist.
+	Queue string `json:"queue,omitempty"`
+}
+
+// Retry configures retrying posts that failed before RT could have
+// accepted the message: connection errors before the request was sent,
+// and 502, 503 and 504 responses.
+type Retry struct {
+	// Attempts is the most times a message is posted, 3 by default; 1
+	// disables retrying.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Backoff is the wait before the first retry, 200ms by default. It
+	// doubles for each retry, up to MaxBackoff (2s by default), and is
+	// jittered.
+	Backoff    Duration `json:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max-backoff,omitempty"`
+}
+
+// Breaker configures the circuit breaker, which fails posts right away
+// while RT looks down.
+type Breaker struct {
+	// Failures is the number of consecutive failed posts opening the
+	// breaker, 5 by default; a negative number disables it.
+	Failures int `json:"failures,omitempty"`
+
+	// Cooldown is how long the breaker stays open before a post is let
+	// through to check RT, 30s by default.
+	Cooldown Duration `json:"cooldown,omitempty"`
+}
+
+// Concurrency limits the posts to RT in progress at once, so bursts
+// from a provider don't overload RT. A post waits for a free slot; if
+// none frees up in time the provider is told to retry later.
+type Concurrency struct {
+	// Max is the most posts in progress over all backends; 0 is
+	// unlimited.
+	Max int `json:"max,omitempty"`
+
+	// Queues limits the posts in progress to a queue, by queue name.
+	// The "*" limit applies to each queue without its own.
+	Queues map[string]int `json:"queues,omitempty"`
+
+	// Wait is how long a post waits for a slot, 2s by default.
+	Wait Duration `json:"wait,omitempty"`
+
+	// RetryAfter is the Retry-After time given to providers when the
+	// limit is reached, 30s by default.
+	RetryAfter Duration `json:"retry-after,omitempty"`
+}
+
+// Trace configures the headers added to messages to trace their
+// delivery through rt-mail.
+type Trace struct {
+	// Headers selects the headers added: "received", "provider",
+	// "recipient", "queue", "backend", "delivered-to" and
+	// "original-to". All but the last two are added by default.
+	Headers []string `json:"headers,omitempty"`
+
+	// Node names this gateway in the Received header, the host name
+	// by default.
+	Node string `json:"node,omitempty"`
+}
+
+// Proxy configures the proxies and load balancers in front of rt-mail,
+// so the client's address is used for allowlists, rate limits and logs.
+type Proxy struct {
+	// Trusted are the networks (CIDRs or IP addresses) of the proxies
+	// whose X-Forwarded-For headers are believed.
+	Trusted []string `json:"trusted"`
+
+	// Protocol expects the PROXY protocol (version 1 or 2) on
+	// connections from the trusted proxies.
+	Protocol bool `json:"protocol,omitempty"`
+}
+
+// RateLimits limits how fast requests are accepted from a client IP
+// address and on a provider route, and how fast messages are accepted
+// from an envelope sender and to a recipient.
+type RateLimits struct {
+	IP        *Rate `json:"ip,omitempty"`
+	Route     *Rate `json:"route,omitempty"`
+	Sender    *Rate `json:"sender,omitempty"`
+	Recipient *Rate `json:"recipient,omitempty"`
+}
+
+// Rate is a token bucket: Rate requests per Per (a minute by default)
+// on average, in bursts of up to Burst (Rate by default).
+type Rate struct {
+	Rate  float64  `json:"rate"`
+	Per   Duration `json:"per,omitempty"`
+	Burst int      `json:"burst,omitempty"`
+}
+
+// Route sends the matching recipients to a backend.
+type Route struct {
+	// Domains and Addresses select the recipients: any address at one
+	// of the domains (or their subdomains), and the addresses or local
+	// parts (and their "-comment" variants) as in the queues.
+	Domains   []string `json:"domains,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+
+	Backend string `json:"backend"`
+
+	// Queue is the queue the recipients are posted to. When empty, the
+	// queue is looked up in the backend's queues.
+	Queue string `json:"queue,omitempty"`
+}
+
+// Filters configures the content checks run before a message is posted to RT.
+type Filters struct {
+	Spamd *Scanner `json:"spamd,omitempty"`
+	Clamd *Scanner `json:"clamd,omitempty"`
+
+	// ProviderScores makes spam and virus verdicts supplied by the
+	// email provider (SES, SendGrid, Mailgun) count as scanner results.
+	ProviderScores bool `json:"provider-scores,omitempty"`
+
+	// SpamThreshold overrides the score at which a message is spam.
+	// When zero, spamd's required score is used (5.0 for provider scores).
+	SpamThreshold float64 `json:"spam-threshold,omitempty"`
+
+	// Actions maps a verdict ("spam", "virus") to what is done with the
+	// message: "reject", "queue", "tag" or "pass".
+	Actions map[string]string `json:"actions,omitempty"`
+
+	// SpamQueue is the RT queue used for the "queue" action.
+	SpamQueue string `json:"spam-queue,omitempty"`
+}
+
+// Auth configures SPF, DKIM and DMARC verification.
+type Auth struct {
+	// AuthservID identifies rt-mail in the Authentication-Results
+	// header. Defaults to the hostname.
+	AuthservID string `json:"authserv-id,omitempty"`
+
+	// QuarantineQueue is the RT queue for messages failing DMARC from
+	// domains with a quarantine or reject policy.
+	QuarantineQueue string `json:"quarantine-queue,omitempty"`
+
+	// Resolver is the DNS server ("host:port") used for lookups. The
+	// system resolver is used if empty.
+	Resolver string `json:"resolver,omitempty"`
+
+	// Timeout is the time allowed for the SPF, DKIM and DMARC checks
+	// of a message, 5s by default.
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// Limits configures the message size limits.
+type Limits struct {
+	// MaxSize is the largest message posted to RT. Defaults to 50MB.
+	MaxSize Size `json:"max-size,omitempty"`
+
+	// MaxRequestSize is the largest request read from the providers
+	// (or message fetched from S3 for SES), larger than MaxSize so
+	// oversized messages can be stripped. Defaults to twice MaxSize.
+	MaxRequestSize Size `json:"max-request-size,omitempty"`
+
+	// Oversize is what is done with messages over the size limit of
+	// their queue: "reject" (the default) or "strip", which replaces
+	// attachments with a note saying they were removed.
+	Oversize string `json:"oversize,omitempty" enum:"reject,strip"`
+
+	// StripAbove is the size above which attachments are stripped from
+	// oversized messages. When zero the largest attachments are
+	// stripped until the message fits.
+	StripAbove Size `json:"strip-above,omitempty"`
+}
+
+// Offload configures moving large attachments out of messages into
+// storage, leaving a link in their place.
+type Offload struct {
+	// Above is the size above which attachments are offloaded.
+	// Defaults to 1MB.
+	Above Size `json:"above,omitempty"`
+
+	Storage
+}
+
+// Archive configures keeping a copy of every inbound message.
+type Archive struct {
+	Storage
+
+	// Compress gzips the archived messages.
+	Compress bool `json:"compress,omitempty"`
+
+	// Retention is how long messages are kept ("720h"). Messages are
+	// kept forever if it isn't set.
+	Retention Duration `json:"retention,omitempty"`
+}
+
+// Admin configures the admin API.
+type Admin struct {
+	// Listen is the address of the admin listener, separate from the
+	// one the providers post to.
+	Listen string `json:"listen"`
+
+	// Token is the bearer token required for all admin requests. The
+	// dashboard accepts it as the password for HTTP basic authentication.
+	Token Secret `json:"token"`
+
+	// Dashboard enables the web dashboard of recent deliveries.
+	Dashboard *Dashboard `json:"dashboard,omitempty"`
+}
+
+// Dashboard configures the web dashboard. Deliveries are kept in memory.
+type Dashboard struct {
+	// Entries is the number of deliveries kept, 1000 by default.
+	Entries int `json:"entries,omitempty"`
+
+	// MaxAge is how long deliveries are kept, 7 days by default.
+	MaxAge Duration `json:"max-age,omitempty"`
+
+	// KeepFailed is the memory used for keeping failed messages so they
+	// can be posted again, 64MB by default.
+	KeepFailed Size `json:"keep-failed,omitempty"`
+}
+
+// Providers configures the email service provider endpoints. Only the
+// providers listed are enabled.
+type Providers struct {
+	SparkPost *SparkPost `json:"sparkpost,omitempty"`
+	Sendgrid  *Provider  `json:"sendgrid,omitempty"`
+	Mailgun   *Mailgun   `json:"mailgun,omitempty"`
+	SES       *SES       `json:"ses,omitempty"`
+}
+
+// Provider configures the endpoint of an email service provider.
+type Provider struct {
+	// Enabled can be set to false to turn the provider off while
+	// keeping its settings.
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// Path is the prefix of the provider's routes, replacing the
+	// default ("/mg" for Mailgun). It can include a secret segment
+	// ("/hooks/8d5e2b/mg").
+	Path string `json:"path,omitempty"`
+
+	// Allow restricts the provider's routes to requests from these
+	// networks (CIDRs or IP addresses), and AllowFile to those listed
+	// in a file, one per line. Without either any address is allowed.
+	Allow     []string `json:"allow,omitempty"`
+	AllowFile string   `json:"allow-file,omitempty"`
+}
+
+// IsEnabled reports whether the provider is configured and enabled.
+func (p *Provider) IsEnabled() bool {
+	return p != nil && (p.Enabled == nil || *p.Enabled)
+}
+
+// SparkPost configures the SparkPost relay webhook.
+type SparkPost struct {
+	Provider
+
+	// Token is the authentication token set on the relay webhook. When
+	// set, requests without it are refused.
+	Token Secret `json:"token,omitempty"`
+}
+
+// Mailgun configures the Mailgun forward route.
+type Mailgun struct {
+	Provider
+
+	// SigningKey is the HTTP webhook signing key. When set, requests
+	// without a valid signature are refused.
+	SigningKey Secret `json:"signing-key,omitempty"`
+}
+
+// SES configures the SES notifications received through SNS.
+type SES struct {
+	Provider
+
+	// TopicARN is the SNS topic the notifications are published to.
+	// Defaults to RT_SES_SNS_TOPIC_ARN.
+	TopicARN string `json:"topic-arn,omitempty"`
+}
+
+// Storage configures where files are stored: a local directory or an
+// S3 bucket.
+type Storage struct {
+	Dir string `json:"dir,omitempty"`
+	S3  *S3    `json:"s3,omitempty"`
+
+	// URL is the base URL the stored files are served from. It's
+	// required for offloading attachments to S3.
+	URL string `json:"url,omitempty"`
+}
+
+// S3 configures an S3 or S3 compatible bucket. Credentials are taken
+// from the environment, as for SES.
+type S3 struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+	Region string `json:"region,omitempty"`
+
+	// Endpoint and PathStyle are for S3 compatible services like MinIO.
+	Endpoint  string `json:"endpoint,omitempty"`
+	PathStyle bool   `json:"path-style,omitempty"`
+}
+
+// Policy is the access policy for an RT queue.
+type Policy struct {
+	// Senders, domains (including subdomains) and regular expressions
+	// matched against the sender address. When any allow list is set,
+	// the sender must match one of them. The sender is taken from the
+	// From header, which can be forged, so use them with RequireAuth.
+	AllowSenders  []string `json:"allow-senders,omitempty"`
+	AllowDomains  []string `json:"allow-domains,omitempty"`
+	AllowPatterns []string `json:"allow-patterns,omitempty"`
+	BlockSenders  []string `json:"block-senders,omitempty"`
+	BlockDomains  []string `json:"block-domains,omitempty"`
+	BlockPatterns []string `json:"block-patterns,omitempty"`
+
+	// MaxSize is the largest message accepted for the queue. Oversize
+	// and StripAbove override the global limits settings for the queue.
+	MaxSize    Size   `json:"max-size,omitempty"`
+	Oversize   string `json:"oversize,omitempty" enum:"reject,strip"`
+	StripAbove Size   `json:"strip-above,omitempty"`
+
+	// RequireAuth only accepts messages passing DMARC. It needs Auth,
+	// unless SES is the only provider.
+	RequireAuth bool `json:"require-auth,omitempty"`
+}
+
+// Scanner configures a network content scanner.
+type Scanner struct {
+	Address string   `json:"address"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// Duration is a time.Duration that is written as a string ("10s") in the
+// configuration file.
+type Duration time.Duration
+
+// UnmarshalJSON accepts a duration string or a number of seconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dur)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Or returns the duration, or def if it isn't set.
+func (d Duration) Or(def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// Size is a size in bytes. In the configuration file it's a number of
+// bytes or a string with a KB, MB or GB suffix ("50MB").
+type Size int64
+
+// UnmarshalJSON accepts a number of bytes or a size string.
+func (s *Size) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*s = Size(v)
+	case string:
+		size, err := ParseSize(v)
+		if err != nil {
+			return err
+		}
+		*s = size
+	default:
+		return fmt.Errorf("invalid size %s", b)
+	}
+	return nil
+}
+
+// ParseSize parses a size like "512KB", "50MB" or "1GB". Units are
+// powers of 1024.
+func ParseSize(str string) (Size, error) {
+	s := strings.ToUpper(strings.TrimSpace(str))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+	return Size(n * float64(mult)), nil
+}
+
+// Load reads the configuration file, in JSON, YAML or TOML (see ToJSON),
+// and applies the overrides from the environment (see ApplyEnv).
+func Load(file string) (*Config, error) {
+	b, err := os.ReadFile(file) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	b, err = ToJSON(file, b)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ApplyEnv(cfg, os.Environ()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Parse parses a JSON configuration file's contents.
+func Parse(b []byte) (*Config, error) {
+	cfg := Config{}
+
+	err := json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
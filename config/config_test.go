@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `{
+  "rt-url": "https://rt.example.com/",
+  "queues": {"help": "help", "help": "other"},
+  "filters": {"spamd": {"adress": "localhost:783", "timeout": "5s"}},
+  "limits": {"max-size": "20MB"},
+  "offload": {"above": 1024, "dir": "/tmp", "s3": {"bucket": "b", "regoin": "x"}},
+  "policies": {"ops": {"allow-domains": ["example.com"], "max-size": "1.5MB", "alow-senders": []}},
+  "RT-URL": "https://rt.example.com/",
+  "limts": {}
+}`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Queues["help"] != "other" {
+		t.Errorf("queues = %v", cfg.Queues)
+	}
+	if cfg.Limits.MaxSize != 20<<20 || cfg.Policies["ops"].MaxSize != 3<<19 || cfg.Offload.Above != 1024 {
+		t.Errorf("sizes: %d %d %d", cfg.Limits.MaxSize, cfg.Policies["ops"].MaxSize, cfg.Offload.Above)
+	}
+	if cfg.Filters.Spamd.Timeout.Or(time.Second) != 5*time.Second {
+		t.Errorf("timeout = %s", time.Duration(cfg.Filters.Spamd.Timeout))
+	}
+	if cfg.Offload.Dir != "/tmp" || cfg.Offload.S3.Bucket != "b" {
+		t.Errorf("offload storage = %+v", cfg.Offload.Storage)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	problems, err := Validate([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`unknown key "RT-URL" (did you mean "rt-url"?)`,
+		`unknown key "filters.spamd.adress"`,
+		`unknown key "limts"`,
+		`unknown key "offload.s3.regoin"`,
+		`unknown key "policies.ops.alow-senders"`,
+	}
+	if got := strings.Join(problems, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("problems:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	problems, err = Validate([]byte(`{
+	  "$schema": "./rt-mail.schema.json",
+	  "queues": {"help": 1},
+	  "limits": {"max-size": "lots", "oversize": "truncate"},
+	  "archive": {"retention": "90d", "compress": "yes"},
+	  "admin": {"dashboard": {"entries": 1.5, "max-age": 3600}},
+	  "policies": {"*": {"allow-domains": ["example.com", 2]}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		`admin.dashboard.entries: number is not integer`,
+		`archive.compress: string is not boolean`,
+		`archive.retention: invalid value "90d"`,
+		`limits.max-size: invalid value "lots"`,
+		`limits.oversize: "truncate" is not one of [reject strip]`,
+		`policies.*.allow-domains[1]: integer is not string`,
+		`queues.help: integer is not string`,
+	}
+	if got := strings.Join(problems, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("problems:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestSchemaUpToDate(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("..", SchemaFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, Schema()) {
+		t.Errorf("%s is out of date; run rt-mail schema > %s", SchemaFile, SchemaFile)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	want, err := Parse([]byte(`{
+	  "rt-url": "https://rt.example.com/",
+	  "queues": {"help": "help", "sales@example.com": "sales"},
+	  "limits": {"max-size": "20MB"},
+	  "filters": {"spamd": {"address": "localhost:783", "timeout": 5}},
+	  "policies": {"sales": {"allow-domains": ["example.com"]}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, data := range map[string]string{
+		"rt-mail.yaml": `
+rt-url: https://rt.example.com/
+queues:
+  help: help               # general support
+  sales@example.com: sales
+limits:
+  max-size: 20MB
+filters:
+  spamd: {address: "localhost:783", timeout: 5}
+policies:
+  sales:
+    allow-domains: [example.com]
+`,
+		"rt-mail.toml": `
+rt-url = "https://rt.example.com/"
+
+[queues]
+help = "help"  # general support
+"sales@example.com" = "sales"
+
+[limits]
+max-size = "20MB"
+
+[filters.spamd]
+address = "localhost:783"
+timeout = 5
+
+[policies.sales]
+allow-domains = ["example.com"]
+`,
+	} {
+		b, err := ToJSON(file, []byte(data))
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+		if problems, _ := Validate(b); len(problems) > 0 {
+			t.Errorf("%s: %v", file, problems)
+		}
+		cfg, err := Parse(b)
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%s: got %+v, want %+v", file, cfg, want)
+		}
+	}
+
+	if _, err := ToJSON("rt-mail.yml", []byte("queues: {help: help, help: other}")); err == nil {
+		t.Error("duplicate YAML key accepted")
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	dups, err := DuplicateKeys([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(dups, " ") != "queues.help" {
+		t.Errorf("duplicate keys %q", dups)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]Size{
+		"512":    512,
+		"512B":   512,
+		"10kb":   10 << 10,
+		"50MB":   50 << 20,
+		" 1 GB ": 1 << 30,
+	}
+	for s, want := range tests {
+		got, err := ParseSize(s)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "MB", "-1MB", "ten"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) didn't fail", s)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Parse([]byte(`{"rt-url": "https://rt.example.com/", "limits": {"max-size": "20MB"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := ApplyEnv(cfg, []string{
+		"RT_MAIL_RT_URL=https://rt.example.org/",
+		`RT_MAIL_QUEUES={"help": "help"}`,
+		"RT_MAIL_LIMITS_MAX_SIZE=5MB",
+		"RT_MAIL_ADMIN_LISTEN=:8003",
+		"RT_MAIL_ADMIN_TOKEN=from-env",
+		"RT_MAIL_ADMIN_TOKEN_FILE=" + secret,
+		"RT_MAIL_ADMIN_DASHBOARD_MAX_AGE=24h",
+		"RT_MAIL_PROVIDERS_MAILGUN_ENABLED=false",
+		"RT_MAIL_ADMIN_TOKN=typo",
+		"HOME=/root",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RTUrl != "https://rt.example.org/" || cfg.Queues["help"] != "help" || cfg.Limits.MaxSize != 5<<20 {
+		t.Errorf("cfg = %+v", cfg)
+	}
+	if cfg.Admin == nil || cfg.Admin.Listen != ":8003" || cfg.Admin.Token != "from-file" {
+		t.Fatalf("admin = %+v", cfg.Admin)
+	}
+	if cfg.Admin.Dashboard == nil || cfg.Admin.Dashboard.MaxAge.Or(0) != 24*time.Hour {
+		t.Errorf("dashboard = %+v", cfg.Admin.Dashboard)
+	}
+	if cfg.Providers == nil || cfg.Providers.Mailgun.IsEnabled() {
+		t.Errorf("providers = %+v", cfg.Providers)
+	}
+	if len(unknown) != 1 || unknown[0] != "RT_MAIL_ADMIN_TOKN" {
+		t.Errorf("unknown = %v", unknown)
+	}
+
+	if _, err := ApplyEnv(cfg, []string{"RT_MAIL_LIMITS_MAX_SIZE=lots"}); err == nil {
+		t.Error("invalid size accepted")
+	}
+}
+
+func TestSecret(t *testing.T) {
+	s := Secret("hunter2")
+	var buf strings.Builder
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+	log.Info("config", "token", s)
+	b, _ := json.Marshal(struct{ Token Secret }{s})
+	for _, out := range []string{fmt.Sprint(s), fmt.Sprintf("%#v", s), buf.String(), string(b)} {
+		if strings.Contains(out, "hunter2") {
+			t.Errorf("secret not redacted: %s", out)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the
+// configuration file.
+const EnvPrefix = "RT_MAIL_"
+
+// Secret is a setting like a token or key. It's redacted when printed,
+// logged or written as JSON.
+type Secret string
+
+const redacted = "[redacted]"
+
+// String returns "[redacted]", or "" if the secret isn't set.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// GoString redacts the secret for %#v.
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+// LogValue redacts the secret in structured logs.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// MarshalJSON writes the secret redacted.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// EnvName returns the environment variable for the setting at the
+// dotted path ("admin.token" is RT_MAIL_ADMIN_TOKEN).
+func EnvName(path string) string {
+	r := strings.NewReplacer(".", "_", "-", "_")
+	return EnvPrefix + strings.ToUpper(r.Replace(path))
+}
+
+// ApplyEnv overrides the settings in cfg with the RT_MAIL_* variables
+// in environ (as returned by os.Environ). A variable named after a
+// setting with a _FILE suffix is the name of a file holding the value,
+// for secrets mounted by Docker or Kubernetes; it takes precedence.
+//
+// Values are strings, numbers, durations and sizes as in the
+// configuration file, without quotes; sections, lists and maps (like
+// RT_MAIL_QUEUES) are JSON. ApplyEnv returns the RT_MAIL_* variables
+// that don't correspond to a setting.
+func ApplyEnv(cfg *Config, environ []string) (unknown []string, err error) {
+	env := map[string]string{}
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(k, EnvPrefix) {
+			env[k] = v
+		}
+	}
+	used := map[string]bool{}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), "", env, used); err != nil {
+		return nil, err
+	}
+	for k := range env {
+		if !used[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+func applyEnv(v reflect.Value, path string, env map[string]string, used map[string]bool) error {
+	fields := Fields(v.Type())
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := fields[name]
+		fpath := joinPath(path, name)
+		fv := v.FieldByIndex(f.Index)
+
+		if value, ok, err := envValue(EnvName(fpath), env, used); err != nil {
+			return err
+		} else if ok {
+			if err := setEnv(fv, value); err != nil {
+				return fmt.Errorf("%s: %w", EnvName(fpath), err)
+			}
+		}
+
+		t := f.Type
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || !hasPrefix(env, EnvName(fpath)+"_") {
+			continue
+		}
+		if fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				fv.Set(reflect.New(t))
+			}
+			fv = fv.Elem()
+		}
+		if err := applyEnv(fv, fpath, env, used); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envValue returns the value of the named variable, or of the file
+// named by name_FILE.
+func envValue(name string, env map[string]string, used map[string]bool) (string, bool, error) {
+	value, ok := env[name]
+	if ok {
+		used[name] = true
+	}
+	if file, ok := env[name+"_FILE"]; ok {
+		used[name+"_FILE"] = true
+		b, err := os.ReadFile(file) //nolint:gosec
+		if err != nil {
+			return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	}
+	return value, ok, nil
+}
+
+// setEnv sets v from an environment variable's value.
+func setEnv(v reflect.Value, value string) error {
+	ptr := reflect.New(v.Type())
+	b := []byte(value)
+	switch v.Type().Kind() {
+	case reflect.String:
+		b, _ = json.Marshal(value)
+	case reflect.Map, reflect.Slice, reflect.Struct, reflect.Pointer:
+	default:
+		// numbers and booleans, and durations and sizes which are
+		// strings unless given in seconds or bytes
+		if !json.Valid(b) {
+			b, _ = json.Marshal(value)
+		}
+	}
+	if err := json.Unmarshal(b, ptr.Interface()); err != nil {
+		return err
+	}
+	v.Set(ptr.Elem())
+	return nil
+}
+
+func hasPrefix(env map[string]string, prefix string) bool {
+	for k := range env {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
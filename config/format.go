@@ -0,0 +1,55 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ToJSON returns the contents of a configuration file as JSON. Files
+// ending in .yaml or .yml are YAML and files ending in .toml are TOML;
+// anything else is returned as is.
+func ToJSON(file string, b []byte) ([]byte, error) {
+	var v any
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if _, err := toml.Decode(string(b), &v); err != nil {
+			return nil, err
+		}
+	default:
+		return b, nil
+	}
+	if v == nil {
+		v = map[string]any{}
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue converts the maps with non-string keys YAML can produce.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = jsonValue(e)
+		}
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
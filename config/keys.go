@@ -0,0 +1,91 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Fields returns the fields of a configuration struct by their JSON
+// name, including the fields of embedded structs.
+func Fields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for n, ef := range Fields(f.Type) {
+				ef.Index = append([]int{i}, ef.Index...)
+				fields[n] = ef
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// DuplicateKeys returns the keys that appear more than once in the same
+// object of the configuration file. Only the last value of a duplicate
+// key is used.
+func DuplicateKeys(b []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var dups []string
+	if err := duplicateKeys(dec, "", &dups); err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
+
+func duplicateKeys(dec *json.Decoder, path string, dups *[]string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		seen := map[string]bool{}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := tok.(string)
+			if seen[key] {
+				*dups = append(*dups, joinPath(path, key))
+			}
+			seen[key] = true
+			if err := duplicateKeys(dec, joinPath(path, key), dups); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := duplicateKeys(dec, path+"["+strconv.Itoa(i)+"]", dups); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SchemaFile is where the JSON Schema for the configuration is
+// published, relative to the repository root. Regenerate it with
+// "rt-mail schema > rt-mail.schema.json".
+const SchemaFile = "rt-mail.schema.json"
+
+const (
+	durationPattern = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+	sizePattern     = `^ *[0-9]+(\.[0-9]+)? *([kKmMgG]?[bB])? *$`
+)
+
+var (
+	durationType = reflect.TypeOf(Duration(0))
+	sizeType     = reflect.TypeOf(Size(0))
+)
+
+// Schema returns the JSON Schema for the configuration file, generated
+// from the Config type. String settings with a fixed set of values have
+// them in an enum struct tag ("reject,strip").
+func Schema() []byte {
+	s := schemaFor(reflect.TypeOf(Config{}))
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "rt-mail configuration"
+	// lets JSON files name their schema for editors
+	s["properties"].(map[string]any)["$schema"] = map[string]any{"type": "string"}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+func schemaFor(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case durationType:
+		return map[string]any{"type": []string{"string", "number"}, "pattern": durationPattern}
+	case sizeType:
+		return map[string]any{"type": []string{"string", "number"}, "pattern": sizePattern}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		props := map[string]any{}
+		for name, f := range Fields(t) {
+			s := schemaFor(f.Type)
+			if enum := f.Tag.Get("enum"); enum != "" {
+				s["enum"] = strings.Split(enum, ",")
+			}
+			props[name] = s
+		}
+		return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	panic("config: no schema for " + t.String())
+}
+
+// Validate checks the configuration file's contents (as JSON) against
+// the schema and returns the problems found, like unknown keys and
+// values of the wrong type.
+func Validate(b []byte) ([]string, error) {
+	var doc, schema any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(Schema(), &schema); err != nil {
+		return nil, err
+	}
+	var problems []string
+	validate(doc, schema.(map[string]any), "", &problems)
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// validate implements the subset of JSON Schema used by Schema.
+func validate(v any, schema map[string]any, path string, problems *[]string) {
+	where := path
+	if where == "" {
+		where = "configuration"
+	}
+	if !hasType(v, schema["type"]) {
+		*problems = append(*problems, fmt.Sprintf("%s: %s is not %s", where, jsonType(v), typeNames(schema["type"])))
+		return
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			*problems = append(*problems, fmt.Sprintf("%s: %q is not one of %v", where, v, enum))
+		}
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if s, ok := v.(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			*problems = append(*problems, fmt.Sprintf("%s: invalid value %q", where, s))
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		for key, e := range v {
+			if s, ok := props[key].(map[string]any); ok {
+				validate(e, s, joinPath(path, key), problems)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case map[string]any:
+				validate(e, extra, joinPath(path, key), problems)
+			case bool:
+				if !extra {
+					*problems = append(*problems, unknownKey(joinPath(path, key), key, props))
+				}
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, e := range v {
+				validate(e, items, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	}
+}
+
+// unknownKey describes an unknown key, suggesting the setting it
+// differs from only in case. encoding/json accepts those, but editors
+// using the schema don't.
+func unknownKey(path, key string, props map[string]any) string {
+	for name := range props {
+		if strings.EqualFold(name, key) {
+			return fmt.Sprintf("unknown key %q (did you mean %q?)", path, name)
+		}
+	}
+	return fmt.Sprintf("unknown key %q", path)
+}
+
+func hasType(v any, types any) bool {
+	switch types := types.(type) {
+	case nil:
+		return true
+	case string:
+		t := jsonType(v)
+		return t == types || t == "integer" && types == "number" || v == nil
+	case []any:
+		for _, t := range types {
+			if hasType(v, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "null"
+}
+
+func typeNames(types any) string {
+	if list, ok := types.([]any); ok {
+		var names []string
+		for _, t := range list {
+			names = append(names, fmt.Sprint(t))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
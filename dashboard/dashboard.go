@@ -0,0 +1,246 @@
+// Package dashboard is a web UI listing the recent deliveries, so it's
+// easy to check whether a customer's email reached RT and to post failed
+// messages again.
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+}).ParseFS(templateFS, "templates/*.html"))
+
+// maxHeader is the most of a message's header section kept.
+const maxHeader = 64 << 10
+
+// Dashboard records deliveries and serves the UI.
+type Dashboard struct {
+	Store *Store
+
+	// Client is what messages are posted to again.
+	Client rt.Client
+
+	prefix  string
+	csrfKey []byte
+}
+
+// New returns a dashboard configured from cfg. Failed messages are
+// posted again to client.
+func New(cfg *config.Dashboard, client rt.Client) *Dashboard {
+	entries := cfg.Entries
+	if entries <= 0 {
+		entries = 1000
+	}
+	keep := int(cfg.KeepFailed)
+	if keep <= 0 {
+		keep = 64 << 20
+	}
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return &Dashboard{
+		Store:   NewStore(entries, cfg.MaxAge.Or(7*24*time.Hour), keep),
+		Client:  client,
+		csrfKey: key,
+	}
+}
+
+type recorder struct {
+	d    *Dashboard
+	next rt.Client
+}
+
+// Record returns a client recording the messages posted through it in
+// the dashboard.
+func (d *Dashboard) Record(next rt.Client) rt.Client {
+	return &recorder{d: d, next: next}
+}
+
+func (r *recorder) Postmail(ctx context.Context, recipient string, message string) error {
+	receipt := rt.ReceiptFromContext(ctx)
+	if receipt == nil {
+		receipt = &rt.Receipt{}
+		ctx = rt.WithReceipt(ctx, receipt)
+	}
+	err := r.next.Postmail(ctx, recipient, message)
+
+	env := rt.EnvelopeFromContext(ctx)
+	e := newEntry([]byte(message))
+	e.Time = time.Now()
+	e.Provider = env.Provider
+	e.From = env.From
+	e.Recipient = recipient
+	e.RequestID = rt.RequestIDFromContext(ctx)
+	e.Backend, e.Queue, e.Action, e.Ticket = receipt.Backend, receipt.Queue, receipt.Action, receipt.Ticket
+	e.Outcome = archive.Outcome(err)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.d.Store.Add(e, []byte(message))
+
+	return err
+}
+
+// newEntry returns an entry with the details parsed from the message.
+func newEntry(raw []byte) *Entry {
+	e := &Entry{Size: len(raw)}
+
+	header := raw
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		header = raw[:i]
+	} else if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		header = raw[:i]
+	}
+	if len(header) > maxHeader {
+		header = header[:maxHeader]
+	}
+	e.Header = string(header)
+
+	if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		dec := &mime.WordDecoder{}
+		e.Subject = m.Header.Get("Subject")
+		if s, err := dec.DecodeHeader(e.Subject); err == nil {
+			e.Subject = s
+		}
+		e.MessageID = m.Header.Get("Message-Id")
+	}
+	return e
+}
+
+// Handler returns the UI handler, to be mounted at prefix on the admin
+// listener.
+func (d *Dashboard) Handler(prefix string) http.Handler {
+	d.prefix = prefix
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+prefix+"/{$}", d.list)
+	mux.HandleFunc("GET "+prefix+"/messages/{id}", d.detail)
+	mux.HandleFunc("POST "+prefix+"/messages/{id}/repost", d.repost)
+	return mux
+}
+
+// page has the fields used by the layout template.
+type page struct {
+	Base  string
+	Title string
+}
+
+type listPage struct {
+	page
+	Query    string
+	Outcome  string
+	Outcomes []string
+	Entries  []Entry
+}
+
+func (d *Dashboard) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := listPage{
+		page:     page{Base: d.prefix},
+		Query:    q.Get("q"),
+		Outcome:  q.Get("outcome"),
+		Outcomes: []string{archive.Delivered, archive.Rejected, archive.NotFound, archive.Failed},
+	}
+	p.Entries = d.Store.Search(p.Query, p.Outcome, 500)
+	d.render(w, "list.html", p)
+}
+
+type detailPage struct {
+	page
+	Entry Entry
+	CSRF  string
+	Flash string
+}
+
+func (d *Dashboard) detail(w http.ResponseWriter, r *http.Request) {
+	e, ok := d.Store.Get(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	d.render(w, "detail.html", detailPage{
+		page:  page{Base: d.prefix, Title: e.Subject},
+		Entry: e,
+		CSRF:  d.csrfToken(e.ID),
+		Flash: r.URL.Query().Get("flash"),
+	})
+}
+
+func (d *Dashboard) repost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(d.csrfToken(id))) {
+		http.Error(w, "invalid form token", http.StatusForbidden)
+		return
+	}
+	e, ok := d.Store.Get(id)
+	raw := d.Store.Raw(id)
+	if !ok || raw == nil {
+		http.Error(w, "message not available", http.StatusNotFound)
+		return
+	}
+
+	mctx := rt.NewContext(ctx, &rt.Envelope{Provider: e.Provider, From: e.From})
+	receipt := &rt.Receipt{}
+	err := d.Client.Postmail(rt.WithReceipt(mctx, receipt), e.Recipient, string(raw))
+
+	d.Store.Update(id, func(e *Entry) {
+		e.Reposted = time.Now()
+		e.Outcome = archive.Outcome(err)
+		e.Error = ""
+		if err != nil {
+			e.Error = err.Error()
+		}
+		if receipt.Queue != "" {
+			e.Backend, e.Queue, e.Action, e.Ticket = receipt.Backend, receipt.Queue, receipt.Action, receipt.Ticket
+		}
+	})
+
+	log := logger.FromContext(ctx)
+	log.InfoContext(ctx, "dashboard reposted message", "recipient", e.Recipient, "outcome", archive.Outcome(err))
+
+	flash := "Posted to RT"
+	if err != nil {
+		flash = "Posting failed: " + err.Error()
+	}
+	http.Redirect(w, r, "../"+url.PathEscape(id)+"?flash="+url.QueryEscape(flash), http.StatusSeeOther)
+}
+
+// csrfToken returns the form token for reposting the entry.
+func (d *Dashboard) csrfToken(id string) string {
+	mac := hmac.New(sha256.New, d.csrfKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dashboard) render(w http.ResponseWriter, name string, data any) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = buf.WriteTo(w)
+}
@@ -0,0 +1,142 @@
+package dashboard
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+const testMessage = "From: Customer <customer@example.net>\r\n" +
+	"To: help@example.com\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9_order?=\r\n" +
+	"Message-Id: <1@example.net>\r\n" +
+	"\r\n" +
+	"Where is my order?\r\n"
+
+func TestStoreRetention(t *testing.T) {
+	s := NewStore(3, time.Hour, 10)
+
+	old := s.Add(&Entry{Time: time.Now().Add(-2 * time.Hour), Outcome: archive.Failed}, []byte("old"))
+	for i := 0; i < 4; i++ {
+		s.Add(&Entry{Time: time.Now(), Outcome: archive.Failed}, []byte("12345"))
+	}
+	if _, ok := s.Get(old.ID); ok {
+		t.Error("expired entry still kept")
+	}
+	if got := s.Search("", "", 0); len(got) != 3 {
+		t.Fatalf("got %d entries, want 3", len(got))
+	}
+
+	// only the two newest failures fit in 10 bytes
+	kept := 0
+	for _, e := range s.Search("", "", 0) {
+		if e.CanRepost() {
+			kept++
+		}
+	}
+	if kept != 2 || s.rawBytes != 10 {
+		t.Errorf("kept %d messages in %d bytes, want 2 in 10", kept, s.rawBytes)
+	}
+
+	e := s.Add(&Entry{Time: time.Now(), Outcome: archive.Delivered}, []byte("ok"))
+	if e.CanRepost() {
+		t.Error("delivered message kept")
+	}
+}
+
+func TestStoreSearch(t *testing.T) {
+	s := NewStore(10, 0, 1<<20)
+	s.Add(&Entry{Time: time.Now(), From: "a@example.net", Subject: "Invoice", Outcome: archive.Delivered}, nil)
+	s.Add(&Entry{Time: time.Now(), From: "b@example.net", Subject: "Refund", Outcome: archive.Failed}, nil)
+	s.Add(&Entry{Time: time.Now(), From: "a@example.net", Subject: "Refund", Outcome: archive.Delivered}, nil)
+
+	got := s.Search("A@EXAMPLE", "", 0)
+	if len(got) != 2 || got[0].Subject != "Refund" {
+		t.Errorf("search = %+v", got)
+	}
+	if got := s.Search("refund", archive.Failed, 0); len(got) != 1 || got[0].From != "b@example.net" {
+		t.Errorf("search failed = %+v", got)
+	}
+	if got := s.Search("", "", 1); len(got) != 1 {
+		t.Errorf("limit: got %d entries", len(got))
+	}
+}
+
+func TestRecordAndRepost(t *testing.T) {
+	fail := true
+	var posted int
+	next := &testutil.MockRTClient{PostmailFunc: func(recipient, message string) error {
+		posted++
+		if fail {
+			return errors.New("RT unavailable")
+		}
+		return nil
+	}}
+	d := New(&config.Dashboard{}, next)
+	client := d.Record(next)
+	h := d.Handler("/ui")
+
+	ctx := rt.NewContext(context.Background(), &rt.Envelope{Provider: "mailgun", From: "customer@example.net"})
+	if err := client.Postmail(ctx, "help@example.com", testMessage); err == nil {
+		t.Fatal("expected error")
+	}
+
+	entries := d.Store.Search("", "", 0)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries", len(entries))
+	}
+	e := entries[0]
+	if e.Provider != "mailgun" || e.Subject != "Café order" || e.MessageID != "<1@example.net>" ||
+		e.Outcome != archive.Failed || !e.CanRepost() {
+		t.Errorf("entry = %+v", e)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ui/?q=customer", nil))
+	testutil.AssertStatusCode(t, w.Code, http.StatusOK)
+	if !strings.Contains(w.Body.String(), "Café order") {
+		t.Errorf("list doesn't show the message: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ui/messages/"+e.ID, nil))
+	testutil.AssertStatusCode(t, w.Code, http.StatusOK)
+	if !strings.Contains(w.Body.String(), "Message-Id: &lt;1@example.net&gt;") || !strings.Contains(w.Body.String(), "repost") {
+		t.Errorf("detail doesn't show headers and repost: %s", w.Body.String())
+	}
+
+	repost := func(token string) *httptest.ResponseRecorder {
+		form := url.Values{"csrf": {token}}
+		req := httptest.NewRequest(http.MethodPost, "/ui/messages/"+e.ID+"/repost", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	testutil.AssertStatusCode(t, repost("forged").Code, http.StatusForbidden)
+	if posted != 1 {
+		t.Errorf("posted %d times with a forged token", posted)
+	}
+
+	fail = false
+	w = repost(d.csrfToken(e.ID))
+	testutil.AssertStatusCode(t, w.Code, http.StatusSeeOther)
+	if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, "/ui/messages/"+e.ID+"?") {
+		t.Errorf("redirected to %q", loc)
+	}
+	e, _ = d.Store.Get(e.ID)
+	if posted != 2 || e.Outcome != archive.Delivered || e.Error != "" || e.Reposted.IsZero() || e.CanRepost() {
+		t.Errorf("after repost: posted %d, entry = %+v", posted, e)
+	}
+}
@@ -0,0 +1,189 @@
+package dashboard
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.askask.com/rt-mail/archive"
+)
+
+// Entry is a delivery shown in the dashboard.
+type Entry struct {
+	ID        string
+	Time      time.Time
+	Provider  string
+	From      string
+	Recipient string
+	Subject   string
+	MessageID string
+	Backend   string
+	Queue     string
+	Action    string
+	Ticket    string
+	Outcome   string
+	Error     string
+	Size      int
+	RequestID string
+
+	// Header is the header section of the message.
+	Header string
+
+	// Reposted is when the message was last posted again from the
+	// dashboard.
+	Reposted time.Time
+
+	// raw is the message, kept for failures while memory allows.
+	raw []byte
+}
+
+// CanRepost reports whether the message is kept and can be posted again.
+func (e Entry) CanRepost() bool {
+	return e.raw != nil
+}
+
+// Store keeps the most recent deliveries in memory.
+type Store struct {
+	// MaxEntries and MaxAge bound how many and how long entries are kept.
+	MaxEntries int
+	MaxAge     time.Duration
+
+	// MaxRawBytes bounds the memory used for failed messages.
+	MaxRawBytes int
+
+	mu       sync.Mutex
+	entries  []*Entry // oldest first
+	rawBytes int
+	nextID   int64
+}
+
+// NewStore returns a store with the given bounds.
+func NewStore(maxEntries int, maxAge time.Duration, maxRawBytes int) *Store {
+	return &Store{MaxEntries: maxEntries, MaxAge: maxAge, MaxRawBytes: maxRawBytes}
+}
+
+// Add stores e, keeping raw if the delivery failed and there's room for
+// it, and returns e with its ID set.
+func (s *Store) Add(e *Entry, raw []byte) *Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	e.ID = strconv.FormatInt(s.nextID, 10)
+	s.entries = append(s.entries, e)
+	s.keep(e, raw)
+	s.expire(time.Now())
+	return e
+}
+
+// keep stores raw with e, dropping the raw messages of older entries
+// if needed. s.mu must be held.
+func (s *Store) keep(e *Entry, raw []byte) {
+	if raw == nil || e.Outcome == archive.Delivered || len(raw) > s.MaxRawBytes {
+		return
+	}
+	for _, old := range s.entries {
+		if s.rawBytes+len(raw) <= s.MaxRawBytes {
+			break
+		}
+		s.dropRaw(old)
+	}
+	e.raw = raw
+	s.rawBytes += len(raw)
+}
+
+func (s *Store) dropRaw(e *Entry) {
+	s.rawBytes -= len(e.raw)
+	e.raw = nil
+}
+
+// expire removes the entries over the bounds. s.mu must be held.
+func (s *Store) expire(now time.Time) {
+	n := 0
+	for n < len(s.entries) &&
+		((s.MaxEntries > 0 && len(s.entries)-n > s.MaxEntries) ||
+			(s.MaxAge > 0 && now.Sub(s.entries[n].Time) > s.MaxAge)) {
+		s.dropRaw(s.entries[n])
+		s.entries[n] = nil
+		n++
+	}
+	s.entries = s.entries[n:]
+}
+
+// Get returns a copy of the entry with the given ID.
+func (s *Store) Get(id string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.find(id); e != nil {
+		return *e, true
+	}
+	return Entry{}, false
+}
+
+func (s *Store) find(id string) *Entry {
+	for _, e := range s.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// Update calls fn with the entry with the given ID under the store's
+// lock. It returns false if there's no such entry.
+func (s *Store) Update(id string, fn func(e *Entry)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.find(id)
+	if e == nil {
+		return false
+	}
+	fn(e)
+	if e.Outcome == archive.Delivered && e.raw != nil {
+		s.dropRaw(e)
+	}
+	return true
+}
+
+// Raw returns the kept message of the entry with the given ID.
+func (s *Store) Raw(id string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.find(id); e != nil {
+		return e.raw
+	}
+	return nil
+}
+
+// Search returns up to limit entries, newest first, containing query in
+// any of their addresses, subject, queue, ticket or message ID and
+// having the given outcome (if not empty).
+func (s *Store) Search(query, outcome string, limit int) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	var res []Entry
+	for i := len(s.entries) - 1; i >= 0 && (limit <= 0 || len(res) < limit); i-- {
+		e := s.entries[i]
+		if outcome != "" && e.Outcome != outcome {
+			continue
+		}
+		if query != "" && !e.matches(query) {
+			continue
+		}
+		res = append(res, *e)
+	}
+	return res
+}
+
+func (e *Entry) matches(query string) bool {
+	for _, field := range []string{e.From, e.Recipient, e.Subject, e.Backend, e.Queue, e.Ticket, e.MessageID, e.Provider, e.RequestID} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package filter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks streamed to clamd. It must stay
+// below clamd's StreamMaxLength.
+const clamdChunkSize = 64 * 1024
+
+// Clamd scans messages with ClamAV's clamd using the INSTREAM command.
+type Clamd struct {
+	Address string // host:port of clamd, or a path to its unix socket
+	Timeout time.Duration
+}
+
+// Scan streams the message to clamd.
+func (c *Clamd) Scan(ctx context.Context, msg *Message) (*Verdict, error) {
+	conn, err := dialScanner(ctx, c.Address, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	w := bufio.NewWriter(conn)
+	_, _ = w.WriteString("zINSTREAM\x00")
+
+	raw := msg.bytes()
+	var size [4]byte
+	for len(raw) > 0 {
+		n := min(len(raw), clamdChunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n)) //nolint:gosec
+		_, _ = w.Write(size[:])
+		_, _ = w.Write(raw[:n])
+		raw = raw[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	_, _ = w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("clamd: sending message: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return nil, fmt.Errorf("clamd: reading response: %w", err)
+	}
+
+	return parseClamdResponse(reply)
+}
+
+// parseClamdResponse parses a reply like "stream: OK" or
+// "stream: Eicar-Signature FOUND".
+func parseClamdResponse(reply string) (*Verdict, error) {
+	reply = strings.TrimRight(reply, "\x00\n")
+	result, ok := strings.CutPrefix(reply, "stream: ")
+	if !ok {
+		return nil, fmt.Errorf("clamd: unexpected response %q", reply)
+	}
+
+	switch {
+	case result == "OK":
+		return &Verdict{Scanner: "clamd"}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &Verdict{Scanner: "clamd", Virus: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("clamd: %s", result)
+	}
+}
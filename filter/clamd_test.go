@@ -0,0 +1,83 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/testutil"
+)
+
+// startClamd runs a stand-in clamd that flags messages containing the
+// EICAR test string.
+func startClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.AssertNoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				cmd, _ := r.ReadString(0)
+				if cmd != "zINSTREAM\x00" {
+					_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var data bytes.Buffer
+				var size [4]byte
+				for {
+					if _, err := io.ReadFull(r, size[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+					_, _ = io.CopyN(&data, r, int64(n))
+				}
+				if strings.Contains(data.String(), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+					_, _ = conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+					return
+				}
+				_, _ = conn.Write([]byte("stream: OK\x00"))
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestClamdScan(t *testing.T) {
+	c := &Clamd{Address: startClamd(t), Timeout: time.Second}
+
+	v, err := c.Scan(context.Background(), &Message{Raw: []byte("Subject: hello\r\n\r\n" + strings.Repeat("x", 3*clamdChunkSize))})
+	testutil.AssertNoError(t, err)
+	if v.Virus != "" {
+		t.Errorf("clean message: virus = %q", v.Virus)
+	}
+
+	v, err = c.Scan(context.Background(), &Message{Raw: []byte("Subject: hello\r\n\r\nX5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")})
+	testutil.AssertNoError(t, err)
+	if v.Virus != "Eicar-Signature" {
+		t.Errorf("virus = %q, want Eicar-Signature", v.Virus)
+	}
+}
+
+func TestParseClamdResponse(t *testing.T) {
+	if _, err := parseClamdResponse("INSTREAM size limit exceeded. ERROR\x00"); err == nil {
+		t.Error("expected error for size limit response")
+	}
+}
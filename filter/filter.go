@@ -0,0 +1,189 @@
+// Package filter runs inbound messages through checks (spam and virus
+// scanning and so on) before they are posted to RT.
+package filter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+)
+
+// Message is a message on its way to RT.
+type Message struct {
+	Recipient string
+	Raw       []byte
+	Envelope  *rt.Envelope
+
+	// Queue and Action override the queue mapped to the recipient when
+	// Queue is set.
+	Queue  string
+	Action string
+
+	headers    []string
+	replyQueue string // queue of a reply to an address without one
+}
+
+// AddHeader prepends a header to the message. Headers are added above
+// the existing ones so DKIM signatures on the original headers still verify.
+// Values folded over several lines should use the message's EOL.
+func (m *Message) AddHeader(name, value string) {
+	m.headers = append(m.headers, name+": "+value)
+}
+
+// Route sends the message to queue instead of the one mapped to the recipient.
+func (m *Message) Route(queue, action string) {
+	m.Queue = queue
+	m.Action = action
+}
+
+// EOL returns the line ending of the message, "\r\n" or "\n".
+func (m *Message) EOL() string {
+	return rt.LineEnding(m.Raw)
+}
+
+// bytes returns the message with the added headers.
+func (m *Message) bytes() []byte {
+	if len(m.headers) == 0 {
+		return m.Raw
+	}
+	return append([]byte(m.added()), m.Raw...)
+}
+
+// Size returns the size of the message with the added headers, as it
+// will be posted.
+func (m *Message) Size() int64 {
+	return int64(len(m.added()) + len(m.Raw))
+}
+
+// added returns the added headers.
+func (m *Message) added() string {
+	var sb strings.Builder
+	eol := m.EOL()
+	for _, h := range m.headers {
+		sb.WriteString(h)
+		sb.WriteString(eol)
+	}
+	return sb.String()
+}
+
+// Router maps a recipient address to its RT queue, as *rt.RT does.
+type Router interface {
+	Route(recipient string) (queue, action string)
+}
+
+// ReplyRouter is implemented by clients that post replies to addresses
+// without a queue to their ticket, as *rt.RT does.
+type ReplyRouter interface {
+	ReplyRoute(recipient, message string) (queue, action string)
+}
+
+// QueueFor returns the queue the message will be posted to: the queue it
+// was routed to by an earlier filter, the queue mapped to its recipient,
+// or the replies queue if it replies to a ticket.
+func (m *Message) QueueFor(router Router) string {
+	if m.Queue != "" {
+		return m.Queue
+	}
+	if queue, _ := router.Route(m.Recipient); queue != "" {
+		return queue
+	}
+	return m.replyQueue
+}
+
+// Filter inspects a message before it is posted to RT. It can modify the
+// message, reroute it, or return an error (usually from rt.Rejectf) to
+// stop the delivery.
+type Filter interface {
+	Filter(ctx context.Context, msg *Message) error
+}
+
+// FilterFunc adapts a function to the Filter interface.
+type FilterFunc func(ctx context.Context, msg *Message) error
+
+// Filter calls f(ctx, msg).
+func (f FilterFunc) Filter(ctx context.Context, msg *Message) error {
+	return f(ctx, msg)
+}
+
+// Client is an rt.Client that runs the configured filters before passing
+// the message on to the next client.
+type Client struct {
+	next    rt.Client
+	filters []Filter
+}
+
+// New returns a Client posting to next after running the filters
+// configured in cfg.
+func New(next rt.Client, cfg *config.Filters) (*Client, error) {
+	c := &Client{next: next}
+
+	var scanners []Scanner
+	if cfg.Spamd != nil {
+		scanners = append(scanners, &Spamd{
+			Address:   cfg.Spamd.Address,
+			Timeout:   cfg.Spamd.Timeout.Or(defaultTimeout),
+			Threshold: cfg.SpamThreshold,
+		})
+	}
+	if cfg.Clamd != nil {
+		scanners = append(scanners, &Clamd{
+			Address: cfg.Clamd.Address,
+			Timeout: cfg.Clamd.Timeout.Or(defaultTimeout),
+		})
+	}
+	if cfg.ProviderScores {
+		scanners = append(scanners, &ProviderScores{Threshold: cfg.SpamThreshold})
+	}
+	if len(scanners) > 0 {
+		sf, err := NewScanFilter(scanners, cfg.Actions, cfg.SpamQueue)
+		if err != nil {
+			return nil, err
+		}
+		c.filters = append(c.filters, sf)
+	}
+
+	return c, nil
+}
+
+// Use appends filters to the chain.
+func (c *Client) Use(filters ...Filter) {
+	c.filters = append(c.filters, filters...)
+}
+
+// Postmail runs the filters and posts the message to the next client.
+func (c *Client) Postmail(ctx context.Context, recipient string, message string) error {
+	msg := &Message{
+		Recipient: recipient,
+		Raw:       []byte(message),
+		Envelope:  rt.EnvelopeFromContext(ctx),
+	}
+	if rr, ok := c.next.(ReplyRouter); ok {
+		msg.replyQueue, _ = rr.ReplyRoute(recipient, message)
+	}
+
+	for _, f := range c.filters {
+		if err := f.Filter(ctx, msg); err != nil {
+			if _, ok := err.(*rt.Error); !ok {
+				err = fmt.Errorf("filter: %w", err)
+			}
+			return err
+		}
+	}
+
+	if msg.Queue != "" {
+		log := logger.FromContext(ctx)
+		log.InfoContext(ctx, "filter rerouted message",
+			"recipient", recipient,
+			"queue", msg.Queue,
+			"action", msg.Action,
+		)
+		ctx = rt.WithRoute(ctx, msg.Queue, msg.Action)
+	}
+
+	return c.next.Postmail(ctx, recipient, string(msg.bytes()))
+}
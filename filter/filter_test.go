@@ -0,0 +1,121 @@
+package filter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+func TestScanFilterActions(t *testing.T) {
+	score := 9.5
+
+	tests := []struct {
+		name       string
+		actions    map[string]string
+		env        *rt.Envelope
+		wantReject bool
+		wantQueue  string
+		wantHeader string
+	}{
+		{
+			name:       "spam tagged by default",
+			env:        &rt.Envelope{Provider: "sendgrid", SpamScore: &score},
+			wantHeader: "X-Spam-Flag: YES",
+		},
+		{
+			name:      "spam routed to queue",
+			actions:   map[string]string{"spam": "queue"},
+			env:       &rt.Envelope{Provider: "ses", SpamVerdict: "spam"},
+			wantQueue: "spam",
+		},
+		{
+			name:       "virus rejected by default",
+			env:        &rt.Envelope{Provider: "ses", VirusVerdict: "infected"},
+			wantReject: true,
+		},
+		{
+			name:    "spam passed",
+			actions: map[string]string{"spam": "pass"},
+			env:     &rt.Envelope{Provider: "mailgun", SpamVerdict: "spam"},
+		},
+		{
+			name: "ham",
+			env:  &rt.Envelope{Provider: "ses", SpamVerdict: "ham", VirusVerdict: "clean"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			var gotCtx context.Context
+			mock := &testutil.MockRTClient{
+				PostmailFunc: func(recipient string, message string) error {
+					got = message
+					return nil
+				},
+			}
+			c, err := New(&ctxRecorder{next: mock, ctx: &gotCtx}, &config.Filters{
+				ProviderScores: true,
+				Actions:        tt.actions,
+				SpamQueue:      "spam",
+			})
+			testutil.AssertNoError(t, err)
+
+			ctx := rt.NewContext(context.Background(), tt.env)
+			err = c.Postmail(ctx, "help@example.com", "Subject: test\r\n\r\nbody")
+
+			if tt.wantReject {
+				rtErr, ok := err.(*rt.Error)
+				if !ok || !rtErr.Rejected {
+					t.Fatalf("expected rejection, got %v", err)
+				}
+				return
+			}
+			testutil.AssertNoError(t, err)
+
+			if tt.wantHeader != "" && !strings.HasPrefix(got, tt.wantHeader) {
+				t.Errorf("message doesn't start with %q:\n%s", tt.wantHeader, got)
+			}
+			if tt.wantHeader == "" && tt.wantQueue == "" && got != "Subject: test\r\n\r\nbody" {
+				t.Errorf("message was modified:\n%s", got)
+			}
+			if tt.wantQueue != "" && !rtRouted(gotCtx, tt.wantQueue) {
+				t.Errorf("message wasn't routed to %q", tt.wantQueue)
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnknownAction(t *testing.T) {
+	_, err := New(&testutil.MockRTClient{}, &config.Filters{
+		ProviderScores: true,
+		Actions:        map[string]string{"spam": "quarantine"},
+	})
+	if err == nil {
+		t.Error("expected error for unknown action")
+	}
+}
+
+// ctxRecorder keeps the context Postmail was called with.
+type ctxRecorder struct {
+	next rt.Client
+	ctx  *context.Context
+}
+
+func (c *ctxRecorder) Postmail(ctx context.Context, recipient string, message string) error {
+	*c.ctx = ctx
+	return c.next.Postmail(ctx, recipient, message)
+}
+
+// rtRouted checks that ctx overrides the RT queue with queue.
+func rtRouted(ctx context.Context, queue string) bool {
+	if ctx == nil {
+		return false
+	}
+	q, _, ok := rt.RouteFromContext(ctx)
+	return ok && q == queue
+}
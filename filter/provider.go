@@ -0,0 +1,46 @@
+package filter
+
+import "context"
+
+// defaultProviderThreshold is the spam score threshold used for provider
+// scores when none is configured. SendGrid and Mailgun both report
+// SpamAssassin-style scores.
+const defaultProviderThreshold = 5.0
+
+// ProviderScores turns the spam and virus verdicts supplied by the email
+// provider into a Verdict.
+type ProviderScores struct {
+	Threshold float64
+}
+
+// Scan reads the provider verdicts from the message envelope.
+func (p *ProviderScores) Scan(_ context.Context, msg *Message) (*Verdict, error) {
+	env := msg.Envelope
+	if env == nil {
+		return nil, nil
+	}
+
+	v := &Verdict{
+		Scanner:   env.Provider,
+		Threshold: p.Threshold,
+	}
+	if v.Scanner == "" {
+		v.Scanner = "provider"
+	}
+	if v.Threshold <= 0 {
+		v.Threshold = defaultProviderThreshold
+	}
+
+	switch {
+	case env.SpamScore != nil:
+		v.Score = *env.SpamScore
+		v.Spam = v.Score >= v.Threshold
+	case env.SpamVerdict == "spam":
+		v.Spam = true
+	}
+	if env.VirusVerdict == "infected" {
+		v.Virus = "provider verdict"
+	}
+
+	return v, nil
+}
@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/rt"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Verdict is the outcome of scanning a message.
+type Verdict struct {
+	Scanner   string
+	Spam      bool
+	Score     float64
+	Threshold float64
+	Rules     []string // spam rules that matched, if the scanner reports them
+	Virus     string   // name of the virus found, empty if clean
+}
+
+// Scanner checks a message for spam or viruses.
+type Scanner interface {
+	Scan(ctx context.Context, msg *Message) (*Verdict, error)
+}
+
+// Action is what is done with a message a scanner flagged.
+type Action string
+
+// Actions that can be configured per verdict.
+const (
+	ActionPass   Action = "pass"   // deliver as is
+	ActionTag    Action = "tag"    // deliver with X-Spam headers added
+	ActionQueue  Action = "queue"  // deliver to the spam queue
+	ActionReject Action = "reject" // don't deliver
+)
+
+// ScanFilter is a Filter running a set of scanners and acting on their verdicts.
+type ScanFilter struct {
+	scanners  []Scanner
+	spam      Action
+	virus     Action
+	spamQueue string
+}
+
+// NewScanFilter returns a filter running scanners. actions maps "spam"
+// and "virus" to an Action; by default spam is tagged and viruses rejected.
+func NewScanFilter(scanners []Scanner, actions map[string]string, spamQueue string) (*ScanFilter, error) {
+	sf := &ScanFilter{
+		scanners:  scanners,
+		spam:      ActionTag,
+		virus:     ActionReject,
+		spamQueue: spamQueue,
+	}
+	for verdict, a := range actions {
+		action := Action(a)
+		switch action {
+		case ActionPass, ActionTag, ActionQueue, ActionReject:
+		default:
+			return nil, fmt.Errorf("unknown action %q for %q verdict", a, verdict)
+		}
+		if action == ActionQueue && spamQueue == "" {
+			return nil, fmt.Errorf("action %q for %q verdict requires spam-queue", a, verdict)
+		}
+		switch verdict {
+		case "spam":
+			sf.spam = action
+		case "virus":
+			sf.virus = action
+		default:
+			return nil, fmt.Errorf("unknown verdict %q in actions", verdict)
+		}
+	}
+	return sf, nil
+}
+
+// Filter scans the message and applies the configured action.
+func (sf *ScanFilter) Filter(ctx context.Context, msg *Message) error {
+	log := logger.FromContext(ctx)
+
+	var spam, virus *Verdict
+	for _, s := range sf.scanners {
+		v, err := s.Scan(ctx, msg)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+		log.DebugContext(ctx, "scan verdict",
+			"scanner", v.Scanner,
+			"spam", v.Spam,
+			"score", v.Score,
+			"virus", v.Virus,
+		)
+		if v.Virus != "" && virus == nil {
+			virus = v
+		}
+		if v.Spam && spam == nil {
+			spam = v
+		}
+	}
+
+	if virus != nil {
+		log.WarnContext(ctx, "virus found",
+			"recipient", msg.Recipient,
+			"scanner", virus.Scanner,
+			"virus", virus.Virus,
+			"action", sf.virus,
+		)
+		if err := sf.apply(msg, sf.virus, virus); err != nil {
+			return err
+		}
+	}
+
+	if spam != nil {
+		log.InfoContext(ctx, "spam detected",
+			"recipient", msg.Recipient,
+			"scanner", spam.Scanner,
+			"score", spam.Score,
+			"action", sf.spam,
+		)
+		if err := sf.apply(msg, sf.spam, spam); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sf *ScanFilter) apply(msg *Message, action Action, v *Verdict) error {
+	switch action {
+	case ActionReject:
+		if v.Virus != "" {
+			return rt.Rejectf("virus %s found by %s", v.Virus, v.Scanner)
+		}
+		return rt.Rejectf("spam (score %.1f) found by %s", v.Score, v.Scanner)
+	case ActionQueue:
+		msg.Route(sf.spamQueue, "correspond")
+		fallthrough
+	case ActionTag:
+		if v.Virus != "" {
+			msg.AddHeader("X-Virus-Status", "Infected ("+v.Virus+")")
+			return nil
+		}
+		msg.AddHeader("X-Spam-Flag", "YES")
+		msg.AddHeader("X-Spam-Score", strconv.FormatFloat(v.Score, 'f', 1, 64))
+		status := fmt.Sprintf("Yes, score=%.1f required=%.1f", v.Score, v.Threshold)
+		if len(v.Rules) > 0 {
+			status += " tests=" + strings.Join(v.Rules, ",")
+		}
+		msg.AddHeader("X-Spam-Status", status)
+	}
+	return nil
+}
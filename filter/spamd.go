@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spamd scans messages with SpamAssassin's spamd.
+type Spamd struct {
+	Address string // host:port of spamd, or a path to its unix socket
+	Timeout time.Duration
+
+	// Threshold overrides spamd's required score when set.
+	Threshold float64
+}
+
+// Scan sends the message to spamd with the SYMBOLS command.
+func (s *Spamd) Scan(ctx context.Context, msg *Message) (*Verdict, error) {
+	conn, err := dialScanner(ctx, s.Address, s.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("spamd: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	raw := msg.bytes()
+	_, err = fmt.Fprintf(conn, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n\r\n", len(raw))
+	if err == nil {
+		_, err = conn.Write(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("spamd: sending message: %w", err)
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+
+	return parseSpamdResponse(bufio.NewReader(conn), s.Threshold)
+}
+
+// parseSpamdResponse reads a SPAMD/1.x response to the SYMBOLS command.
+func parseSpamdResponse(r *bufio.Reader, threshold float64) (*Verdict, error) {
+	tp := textproto.NewReader(r)
+
+	status, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("spamd: reading response: %w", err)
+	}
+	// SPAMD/1.1 0 EX_OK
+	fields := strings.Fields(status)
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return nil, fmt.Errorf("spamd: unexpected response %q", status)
+	}
+	if fields[1] != "0" {
+		return nil, fmt.Errorf("spamd: error response %q", status)
+	}
+
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("spamd: reading headers: %w", err)
+	}
+
+	// Spam: True ; 15.3 / 5.0
+	spamHdr := hdr.Get("Spam")
+	parts := strings.SplitN(spamHdr, ";", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("spamd: invalid Spam header %q", spamHdr)
+	}
+	scores := strings.SplitN(parts[1], "/", 2)
+	if len(scores) != 2 {
+		return nil, fmt.Errorf("spamd: invalid Spam header %q", spamHdr)
+	}
+	score, err := strconv.ParseFloat(strings.TrimSpace(scores[0]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("spamd: invalid score in %q", spamHdr)
+	}
+	required, err := strconv.ParseFloat(strings.TrimSpace(scores[1]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("spamd: invalid required score in %q", spamHdr)
+	}
+
+	v := &Verdict{
+		Scanner:   "spamd",
+		Score:     score,
+		Threshold: required,
+		Spam:      strings.EqualFold(strings.TrimSpace(parts[0]), "true"),
+	}
+	if threshold > 0 {
+		v.Threshold = threshold
+		v.Spam = score >= threshold
+	}
+
+	body, _ := io.ReadAll(r)
+	for _, rule := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			v.Rules = append(v.Rules, rule)
+		}
+	}
+
+	return v, nil
+}
+
+// dialScanner connects to a scanner listening on a TCP address or unix socket.
+func dialScanner(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	return conn, nil
+}
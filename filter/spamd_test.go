@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/testutil"
+)
+
+// startSpamd runs a stand-in spamd that reports score for every message.
+func startSpamd(t *testing.T, score float64) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.AssertNoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				tp := textproto.NewReader(bufio.NewReader(conn))
+				cmd, _ := tp.ReadLine()
+				hdr, _ := tp.ReadMIMEHeader()
+				n, _ := strconv.Atoi(hdr.Get("Content-Length"))
+				body := make([]byte, n)
+				_, _ = io.ReadFull(tp.R, body)
+				if !strings.HasPrefix(cmd, "SYMBOLS ") || !strings.Contains(string(body), "Subject:") {
+					_, _ = fmt.Fprintf(conn, "SPAMD/1.1 76 EX_PROTOCOL\r\n\r\n")
+					return
+				}
+				spam := "False"
+				if score >= 5 {
+					spam = "True"
+				}
+				_, _ = fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: 21\r\nSpam: %s ; %.1f / 5.0\r\n\r\nBAYES_99,URIBL_BLACK\r\n", spam, score)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestSpamdScan(t *testing.T) {
+	tests := []struct {
+		score     float64
+		threshold float64
+		spam      bool
+	}{
+		{score: 15.3, spam: true},
+		{score: 1.2, spam: false},
+		{score: 4.0, threshold: 3.5, spam: true},
+	}
+
+	for _, tt := range tests {
+		s := &Spamd{
+			Address:   startSpamd(t, tt.score),
+			Timeout:   time.Second,
+			Threshold: tt.threshold,
+		}
+		v, err := s.Scan(context.Background(), &Message{Raw: []byte("Subject: test\r\n\r\nbody")})
+		testutil.AssertNoError(t, err)
+		if v.Spam != tt.spam {
+			t.Errorf("score %.1f threshold %.1f: spam = %v, want %v", tt.score, tt.threshold, v.Spam, tt.spam)
+		}
+		if v.Score != tt.score {
+			t.Errorf("score = %.1f, want %.1f", v.Score, tt.score)
+		}
+		if len(v.Rules) != 2 || v.Rules[0] != "BAYES_99" {
+			t.Errorf("rules = %v", v.Rules)
+		}
+	}
+}
+
+func TestSpamdProtocolError(t *testing.T) {
+	s := &Spamd{Address: startSpamd(t, 0), Timeout: time.Second}
+	_, err := s.Scan(context.Background(), &Message{Raw: []byte("no headers")})
+	if err == nil {
+		t.Fatal("expected error for EX_PROTOCOL response")
+	}
+}
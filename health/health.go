@@ -0,0 +1,139 @@
+// Package health implements the readiness check: whether rt-mail's
+// dependencies, like RT and S3, can be reached. /healthz stays a pure
+// liveness check.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults for Checker.
+const (
+	DefaultTTL     = 10 * time.Second
+	DefaultTimeout = 5 * time.Second
+)
+
+// Result statuses.
+const (
+	OK   = "ok"
+	Fail = "fail"
+)
+
+type check struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// Checker runs the readiness checks, caching the results so frequent
+// probes don't load the dependencies.
+type Checker struct {
+	// TTL is how long results are reused, DefaultTTL if zero.
+	TTL time.Duration
+	// Timeout is the time allowed for the checks, DefaultTimeout if zero.
+	Timeout time.Duration
+
+	checks []check
+
+	mu     sync.Mutex
+	report *Report
+}
+
+// Report is the result of the checks.
+type Report struct {
+	Status  string    `json:"status"` // OK if all checks passed
+	Checked time.Time `json:"checked"`
+	Checks  []Result  `json:"checks"`
+}
+
+// Result is the result of one check.
+type Result struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Add adds a check. fn returns an error if the dependency isn't usable.
+func (c *Checker) Add(name string, fn func(context.Context) error) {
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// Check returns the results of the checks, running them if the cached
+// results are older than the TTL. The checks run concurrently.
+func (c *Checker) Check(ctx context.Context) *Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if c.report != nil && time.Since(c.report.Checked) < ttl {
+		return c.report
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	report := &Report{Status: OK, Checked: time.Now(), Checks: make([]Result, len(c.checks))}
+	var wg sync.WaitGroup
+	for i, chk := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := chk.fn(ctx)
+			r := Result{Name: chk.name, Status: OK, Duration: time.Since(start).Round(time.Millisecond).String()}
+			if err != nil {
+				r.Status, r.Error = Fail, err.Error()
+			}
+			report.Checks[i] = r
+		}()
+	}
+	wg.Wait()
+	for _, r := range report.Checks {
+		if r.Status != OK {
+			report.Status = Fail
+		}
+	}
+
+	c.report = report
+	return report
+}
+
+// ServeHTTP serves the report as JSON, with status 200 if all checks
+// passed and 503 otherwise.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := c.Check(r.Context())
+	serve(w, report.Status, report)
+}
+
+// StatusHandler serves only the overall status, like {"status": "ok"},
+// with the HTTP status of ServeHTTP. The details (which include internal
+// URLs and errors) are left out, for listeners anyone can reach.
+func (c *Checker) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Check(r.Context())
+		serve(w, report.Status, map[string]string{"status": report.Status})
+	})
+}
+
+func serve(w http.ResponseWriter, result string, v any) {
+	status := http.StatusOK
+	if result != OK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
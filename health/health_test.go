@@ -0,0 +1,80 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/testutil"
+)
+
+func TestChecker(t *testing.T) {
+	calls := 0
+	var rtErr error
+	c := &Checker{TTL: time.Hour}
+	c.Add("rt", func(context.Context) error {
+		calls++
+		return rtErr
+	})
+	c.Add("s3", func(context.Context) error { return nil })
+
+	get := func() (int, Report) {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report Report
+		testutil.AssertNoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		return w.Code, report
+	}
+
+	code, report := get()
+	testutil.AssertStatusCode(t, code, http.StatusOK)
+	if report.Status != OK || len(report.Checks) != 2 || report.Checks[0].Name != "rt" || report.Checks[1].Status != OK {
+		t.Errorf("report = %+v", report)
+	}
+
+	// cached
+	rtErr = errors.New("connection refused")
+	code, _ = get()
+	testutil.AssertStatusCode(t, code, http.StatusOK)
+	if calls != 1 {
+		t.Errorf("check ran %d times", calls)
+	}
+
+	c.report.Checked = time.Now().Add(-2 * time.Hour)
+	code, report = get()
+	testutil.AssertStatusCode(t, code, http.StatusServiceUnavailable)
+	if report.Status != Fail || report.Checks[0].Status != Fail || report.Checks[0].Error != "connection refused" {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestCheckerTimeout(t *testing.T) {
+	c := &Checker{Timeout: 10 * time.Millisecond}
+	c.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if report := c.Check(context.Background()); report.Status != Fail {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	c := &Checker{}
+	c.Add("rt:default", func(context.Context) error {
+		return errors.New("dial tcp 10.0.0.5:443: connection refused")
+	})
+
+	w := httptest.NewRecorder()
+	c.StatusHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	testutil.AssertStatusCode(t, w.Code, http.StatusServiceUnavailable)
+	var body map[string]any
+	testutil.AssertNoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	if len(body) != 1 || body["status"] != Fail {
+		t.Errorf("body = %s", w.Body)
+	}
+}
@@ -0,0 +1,206 @@
+// Package limits enforces the message size limits, optionally stripping
+// large attachments from oversized messages instead of rejecting them.
+package limits
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sort"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/attachment"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+)
+
+// oversized counts oversized messages by queue and outcome.
+var oversized = expvar.NewMap("oversized_messages")
+
+// Strategies for oversized messages.
+const (
+	Reject = "reject"
+	Strip  = "strip"
+)
+
+// Limit is the size limit for a queue.
+type Limit struct {
+	MaxSize    int64
+	Oversize   string
+	StripAbove int64
+}
+
+// Filter enforces size limits.
+type Filter struct {
+	router filter.Router
+	global Limit
+	queues map[string]Limit
+}
+
+// New returns a filter enforcing the global limits and the max-size of
+// the queue policies. router is used to find the queue for messages that
+// haven't been rerouted.
+func New(cfg *config.Limits, policies map[string]*config.Policy, router filter.Router) (*Filter, error) {
+	f := &Filter{
+		router: router,
+		global: Limit{
+			MaxSize:    rt.MaxMessageSize(int64(cfg.MaxSize)),
+			Oversize:   cfg.Oversize,
+			StripAbove: int64(cfg.StripAbove),
+		},
+		queues: map[string]Limit{},
+	}
+	if f.global.Oversize == "" {
+		f.global.Oversize = Reject
+	}
+	if err := checkStrategy(f.global.Oversize); err != nil {
+		return nil, err
+	}
+
+	for queue, p := range policies {
+		if p.MaxSize == 0 && p.Oversize == "" && p.StripAbove == 0 {
+			continue
+		}
+		l := f.global
+		if p.MaxSize > 0 && int64(p.MaxSize) < l.MaxSize {
+			l.MaxSize = int64(p.MaxSize)
+		}
+		if p.Oversize != "" {
+			if err := checkStrategy(p.Oversize); err != nil {
+				return nil, fmt.Errorf("policy for queue %q: %w", queue, err)
+			}
+			l.Oversize = p.Oversize
+		}
+		if p.StripAbove > 0 {
+			l.StripAbove = int64(p.StripAbove)
+		}
+		f.queues[queue] = l
+	}
+	return f, nil
+}
+
+func checkStrategy(s string) error {
+	switch s {
+	case Reject, Strip:
+		return nil
+	}
+	return fmt.Errorf("invalid oversize strategy %q", s)
+}
+
+// Limit returns the limit for queue.
+func (f *Filter) Limit(queue string) Limit {
+	if l, ok := f.queues[queue]; ok {
+		return l
+	}
+	if l, ok := f.queues["*"]; ok {
+		return l
+	}
+	return f.global
+}
+
+// Filter strips attachments from or rejects messages over the size
+// limit of their queue.
+func (f *Filter) Filter(ctx context.Context, msg *filter.Message) error {
+	queue := msg.QueueFor(f.router)
+	l := f.Limit(queue)
+	size := msg.Size()
+	if size <= l.MaxSize {
+		return nil
+	}
+
+	log := logger.FromContext(ctx)
+
+	if l.Oversize == Strip {
+		// the headers added by earlier filters count too
+		added := size - int64(len(msg.Raw))
+		raw, removed, err := strip(msg.Raw, added, l)
+		if err != nil {
+			log.WarnContext(ctx, "could not strip attachments", "error", err)
+		}
+		if len(removed) > 0 && added+int64(len(raw)) <= l.MaxSize {
+			log.InfoContext(ctx, "stripped attachments from oversized message",
+				"queue", queue,
+				"recipient", msg.Recipient,
+				"size", size,
+				"new_size", added+int64(len(raw)),
+				"attachments", removed,
+			)
+			oversized.Add(queue+":stripped", 1)
+			msg.Raw = raw
+			return nil
+		}
+	}
+
+	oversized.Add(queue+":rejected", 1)
+	log.WarnContext(ctx, "message too large",
+		"queue", queue,
+		"recipient", msg.Recipient,
+		"size", size,
+		"max_size", l.MaxSize,
+	)
+	return rt.Rejectf("message size %s exceeds the limit of %s for queue %q",
+		attachment.FormatSize(int(size)), attachment.FormatSize(int(l.MaxSize)), queue)
+}
+
+// strip replaces the attachments chosen by l with a note, counting
+// added bytes of headers to be added towards the limit. It returns the
+// new message and the names of the removed attachments.
+func strip(raw []byte, added int64, l Limit) ([]byte, []string, error) {
+	var parts []*attachment.Part
+	err := attachment.Walk(raw, func(p *attachment.Part) {
+		parts = append(parts, p)
+	})
+	if err != nil || len(parts) == 0 {
+		return raw, nil, err
+	}
+
+	remove := make([]bool, len(parts))
+	if l.StripAbove > 0 {
+		for i, p := range parts {
+			remove[i] = int64(p.Size) > l.StripAbove
+		}
+	} else {
+		order := make([]int, len(parts))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return parts[order[a]].Size > parts[order[b]].Size
+		})
+		size := added + int64(len(raw))
+		for _, i := range order {
+			if size <= l.MaxSize {
+				break
+			}
+			remove[i] = true
+			size -= int64(parts[i].Size)
+		}
+	}
+
+	var removed []string
+	i := 0
+	out, _, err := attachment.Rewrite(raw, func(p *attachment.Part) (string, error) {
+		defer func() { i++ }()
+		if i >= len(remove) || !remove[i] {
+			return "", nil
+		}
+		removed = append(removed, p.Filename)
+		return Note(p, l.MaxSize), nil
+	})
+	if err != nil {
+		return raw, nil, err
+	}
+	return out, removed, nil
+}
+
+// Note is the text an attachment is replaced with.
+func Note(p *attachment.Part, maxSize int64) string {
+	name := p.Filename
+	if name == "" {
+		name = "(unnamed)"
+	}
+	return fmt.Sprintf("[rt-mail: the attachment %q (%s, %s) was removed because the message exceeded the size limit of %s.]",
+		name, p.ContentType, attachment.FormatSize(p.Size), attachment.FormatSize(int(maxSize)))
+}
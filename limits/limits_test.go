@@ -0,0 +1,119 @@
+package limits
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+type staticRouter map[string]string
+
+func (r staticRouter) Route(recipient string) (string, string) {
+	return r[recipient], "correspond"
+}
+
+func testMessage(attachments ...string) string {
+	var sb strings.Builder
+	sb.WriteString("From: alice@example.com\r\nSubject: files\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n")
+	for i, a := range attachments {
+		sb.WriteString("--b\r\nContent-Type: application/octet-stream\r\n")
+		sb.WriteString("Content-Disposition: attachment; filename=file" + string(rune('1'+i)) + ".bin\r\n\r\n")
+		sb.WriteString(a + "\r\n")
+	}
+	sb.WriteString("--b--\r\n")
+	return sb.String()
+}
+
+func TestLimits(t *testing.T) {
+	router := staticRouter{
+		"help@example.com":  "help",
+		"files@example.com": "files",
+		"big@example.com":   "big",
+	}
+	f, err := New(&config.Limits{MaxSize: 2000}, map[string]*config.Policy{
+		"files": {MaxSize: 1000, Oversize: Strip},
+		"big":   {MaxSize: 5000, Oversize: Strip, StripAbove: 100},
+	}, router)
+	testutil.AssertNoError(t, err)
+
+	small := strings.Repeat("s", 200)
+	large := strings.Repeat("L", 1500)
+
+	tests := []struct {
+		name      string
+		recipient string
+		message   string
+		rejected  bool
+		removed   []string
+	}{
+		{"under limit", "help@example.com", testMessage(small), false, nil},
+		{"global limit", "help@example.com", testMessage(large, large), true, nil},
+		{"strip largest", "files@example.com", testMessage(small, large), false, []string{"file2.bin"}},
+		{"strip several", "files@example.com", testMessage(large, large), false, []string{"file1.bin", "file2.bin"}},
+		{"no attachments", "files@example.com", "Subject: hi\r\n\r\n" + large, true, nil},
+		{"queue limit capped by global", "big@example.com", testMessage(large, large), false, []string{"file1.bin", "file2.bin"}},
+		{"unmapped", "nobody@example.com", testMessage(large, large), true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &filter.Message{Recipient: tt.recipient, Raw: []byte(tt.message), Envelope: &rt.Envelope{}}
+			err := f.Filter(context.Background(), msg)
+
+			var rtErr *rt.Error
+			if tt.rejected {
+				if !errors.As(err, &rtErr) || !rtErr.Rejected {
+					t.Fatalf("expected rejection, got %v", err)
+				}
+				return
+			}
+			testutil.AssertNoError(t, err)
+
+			for _, name := range tt.removed {
+				note := `the attachment "` + name + `"`
+				if !strings.Contains(string(msg.Raw), note) {
+					t.Errorf("no note for %s in\n%s", name, msg.Raw)
+				}
+			}
+			if tt.removed != nil && strings.Contains(string(msg.Raw), large) {
+				t.Error("large attachment not removed")
+			}
+			if tt.removed != nil && !strings.Contains(string(msg.Raw), "See attached.") {
+				t.Error("message text removed")
+			}
+		})
+	}
+}
+
+func TestLimitsAddedHeaders(t *testing.T) {
+	f, err := New(&config.Limits{MaxSize: 1000}, nil, staticRouter{})
+	testutil.AssertNoError(t, err)
+
+	// under the limit, but not with the headers added by earlier filters
+	raw := "Subject: hi\r\n\r\n" + strings.Repeat("x", 950)
+	msg := &filter.Message{Recipient: "help@example.com", Raw: []byte(raw), Envelope: &rt.Envelope{}}
+	msg.AddHeader("Authentication-Results", strings.Repeat("a", 100))
+	var rtErr *rt.Error
+	if err := f.Filter(context.Background(), msg); !errors.As(err, &rtErr) || !rtErr.Rejected {
+		t.Errorf("expected rejection, got %v", err)
+	}
+}
+
+func TestInvalidStrategy(t *testing.T) {
+	_, err := New(&config.Limits{Oversize: "drop"}, nil, staticRouter{})
+	if err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+	_, err = New(&config.Limits{}, map[string]*config.Policy{"help": {Oversize: "drop"}}, staticRouter{})
+	if err == nil {
+		t.Error("expected error for unknown queue strategy")
+	}
+}
@@ -1,19 +1,53 @@
 package mailgun
 
 import (
+	"bufio"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"go.ntppool.org/common/logger"
 
 	"go.askask.com/rt-mail/rt"
 )
 
+// DefaultPath is the prefix of the Mailgun routes.
+const DefaultPath = "/mg"
+
 type Mailgun struct {
 	RT rt.Client
+
+	// MaxSize is the largest request accepted, rt.DefaultMaxMessageSize
+	// if zero.
+	MaxSize int64
+
+	// Path is the prefix of the routes, DefaultPath if empty.
+	Path string
+
+	// SigningKey is the webhook signing key. If set, requests must be
+	// signed with it.
+	SigningKey string
+
+	mu     sync.Mutex
+	tokens map[string]time.Time // tokens seen, by when they expire
+	now    func() time.Time     // for tests
 }
 
+// maxSignatureAge is how far the timestamp of a signed request may be
+// from the current time. Tokens are remembered as long, so a signed
+// request can't be replayed.
+const maxSignatureAge = 5 * time.Minute
+
 func (mg *Mailgun) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/mg/mx/mime", mg.ReceiveHandler)
+	mux.HandleFunc(strings.TrimSuffix(cmp.Or(mg.Path, DefaultPath), "/")+"/mx/mime", mg.ReceiveHandler)
 }
 
 func (mg *Mailgun) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
@@ -30,9 +64,14 @@ func (mg *Mailgun) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 		"content_type", r.Header.Get("Content-Type"),
 	)
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024*50)
+	maxSize := rt.MaxMessageSize(mg.MaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 	defer func() { _ = r.Body.Close() }()
-	_ = r.ParseMultipartForm(64 << 20)
+	if err := r.ParseMultipartForm(rt.FormMemory); err != nil && rt.TooLarge(err) {
+		log.WarnContext(ctx, "request too large", "limit", maxSize, "error", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 
 	form := r.PostForm
 
@@ -43,12 +82,27 @@ func (mg *Mailgun) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.DebugContext(ctx, "parsed form data", "fields", formKeys)
 
+	if mg.SigningKey != "" {
+		if reason := mg.checkSignature(form); reason != "" {
+			log.WarnContext(ctx, "refused mailgun webhook", "reason", reason)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
 	recipient := form.Get("recipient")
 	body := form.Get("body-mime")
 
 	log.InfoContext(ctx, "processing mailgun webhook", "recipient", recipient)
 
-	err := mg.RT.Postmail(recipient, body)
+	env := &rt.Envelope{
+		Provider: "mailgun",
+		From:     form.Get("sender"),
+	}
+	spamHeaders(env, form, body)
+	ctx = rt.NewContext(ctx, env)
+
+	err := mg.RT.Postmail(ctx, recipient, body)
 	if err != nil {
 		log.ErrorContext(ctx, "failed to post to RT", "error", err, "recipient", recipient)
 		if err, ok := err.(*rt.Error); ok {
@@ -56,6 +110,17 @@ func (mg *Mailgun) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
+			if err.Rejected {
+				// Mailgun doesn't retry a 406
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+		}
+		// let Mailgun retry with the same token
+		mg.forget(form.Get("token"))
+		if rt.RetryAfter(w, err) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
 		}
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
@@ -64,3 +129,89 @@ func (mg *Mailgun) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 	log.InfoContext(ctx, "successfully posted to RT", "recipient", recipient)
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// spamHeaders reads the spam verdict Mailgun gives when spam filtering
+// is enabled: from the X-Mailgun-Sflag and X-Mailgun-Sscore form fields,
+// which are signed with the request, or else from the topmost of those
+// headers in the message, which Mailgun adds above the sender's headers.
+// Any the sender added further down are ignored.
+func spamHeaders(env *rt.Envelope, form url.Values, body string) {
+	flag, score := form.Get("X-Mailgun-Sflag"), form.Get("X-Mailgun-Sscore")
+	if flag == "" && score == "" {
+		hdr, _ := textproto.NewReader(bufio.NewReader(strings.NewReader(body))).ReadMIMEHeader()
+		if hdr == nil {
+			return
+		}
+		// the first value is the topmost field
+		flag, score = hdr.Get("X-Mailgun-Sflag"), hdr.Get("X-Mailgun-Sscore")
+	}
+	if s, err := strconv.ParseFloat(score, 64); err == nil {
+		env.SpamScore = &s
+	}
+	switch strings.ToLower(flag) {
+	case "yes":
+		env.SpamVerdict = "spam"
+	case "no":
+		env.SpamVerdict = "ham"
+	}
+}
+
+// checkSignature returns why the request isn't accepted as signed by
+// Mailgun: an invalid signature, a timestamp too far from now, or a
+// token that was used before. It returns "" for a valid request.
+func (mg *Mailgun) checkSignature(form url.Values) string {
+	if !verifySignature(mg.SigningKey, form) {
+		return "invalid signature"
+	}
+	now := time.Now()
+	if mg.now != nil {
+		now = mg.now()
+	}
+	ts, err := strconv.ParseInt(form.Get("timestamp"), 10, 64)
+	if err != nil {
+		return "invalid timestamp"
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return "timestamp out of range"
+	}
+
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	if mg.tokens == nil {
+		mg.tokens = map[string]time.Time{}
+	}
+	for token, expires := range mg.tokens {
+		if now.After(expires) {
+			delete(mg.tokens, token)
+		}
+	}
+	token := form.Get("token")
+	if _, ok := mg.tokens[token]; ok {
+		return "token used before"
+	}
+	mg.tokens[token] = time.Unix(ts, 0).Add(maxSignatureAge)
+	return ""
+}
+
+// forget forgets a token, for a request Mailgun should retry.
+func (mg *Mailgun) forget(token string) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	delete(mg.tokens, token)
+}
+
+// verifySignature checks the webhook signature, the HMAC-SHA256 of the
+// timestamp and token with the signing key.
+func verifySignature(key string, form url.Values) bool {
+	timestamp, token := form.Get("timestamp"), form.Get("token")
+	if timestamp == "" || token == "" {
+		return false
+	}
+	sig, err := hex.DecodeString(form.Get("signature"))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	return hmac.Equal(sig, mac.Sum(nil))
+}
@@ -2,13 +2,18 @@ package mailgun
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"go.askask.com/rt-mail/rt"
 	"go.askask.com/rt-mail/testutil"
@@ -65,6 +70,51 @@ func TestMailgunReceiveHandler_NotFound(t *testing.T) {
 	testutil.AssertStatusCode(t, rr.Code, http.StatusNotFound)
 }
 
+func TestMailgunReceiveHandler_Busy(t *testing.T) {
+	mockClient := &testutil.MockRTClient{
+		PostmailFunc: func(recipient string, message string) error {
+			return &rt.Error{Busy: true, RetryAfter: 90 * time.Second}
+		},
+	}
+
+	mg := &Mailgun{RT: mockClient}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("recipient", "test@example.com")
+	_ = writer.WriteField("body-mime", "Test")
+	_ = writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/mg/mx/mime", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	mg.ReceiveHandler(rr, req)
+
+	testutil.AssertStatusCode(t, rr.Code, http.StatusTooManyRequests)
+	if got := rr.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("Retry-After = %q", got)
+	}
+}
+
+func TestMailgunReceiveHandler_TooLarge(t *testing.T) {
+	mg := &Mailgun{RT: &testutil.MockRTClient{}, MaxSize: 1000}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("recipient", "test@example.com")
+	_ = writer.WriteField("body-mime", strings.Repeat("x", 2000))
+	_ = writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/mg/mx/mime", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	mg.ReceiveHandler(rr, req)
+
+	testutil.AssertStatusCode(t, rr.Code, http.StatusRequestEntityTooLarge)
+}
+
 func TestMailgunReceiveHandler_Integration(t *testing.T) {
 	rtServer := testutil.NewMockRTServer(t)
 	defer rtServer.Close()
@@ -92,3 +142,86 @@ func TestMailgunReceiveHandler_Integration(t *testing.T) {
 
 	testutil.AssertStatusCode(t, rr.Code, http.StatusNoContent)
 }
+
+func TestMailgunSignature(t *testing.T) {
+	posted := 0
+	mg := &Mailgun{
+		RT: &testutil.MockRTClient{PostmailFunc: func(recipient, message string) error {
+			posted++
+			return nil
+		}},
+		Path:       "/hooks/secret/mg",
+		SigningKey: "key-123",
+		now:        func() time.Time { return time.Unix(1700000060, 0) },
+	}
+	mux := http.NewServeMux()
+	mg.RegisterRoutes(mux)
+
+	post := func(signature string) int {
+		return postSigned(mux, "1700000000", "abcdef", signature)
+	}
+	sign := func(timestamp, token string) string {
+		mac := hmac.New(sha256.New, []byte("key-123"))
+		mac.Write([]byte(timestamp + token))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	valid := sign("1700000000", "abcdef")
+
+	testutil.AssertStatusCode(t, post("00"+valid[2:]), http.StatusUnauthorized)
+	testutil.AssertStatusCode(t, post(""), http.StatusUnauthorized)
+	if posted != 0 {
+		t.Errorf("posted %d messages with invalid signatures", posted)
+	}
+	testutil.AssertStatusCode(t, post(valid), http.StatusNoContent)
+	if posted != 1 {
+		t.Errorf("posted %d messages, want 1", posted)
+	}
+
+	// replayed, or signed too long ago
+	testutil.AssertStatusCode(t, post(valid), http.StatusUnauthorized)
+	testutil.AssertStatusCode(t, postSigned(mux, "1699999000", "ghijkl", sign("1699999000", "ghijkl")), http.StatusUnauthorized)
+	testutil.AssertStatusCode(t, postSigned(mux, "1700000030", "ghijkl", sign("1700000030", "ghijkl")), http.StatusNoContent)
+	if posted != 2 {
+		t.Errorf("posted %d messages, want 2", posted)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/mg/mx/mime", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	testutil.AssertStatusCode(t, rr.Code, http.StatusNotFound)
+}
+
+// postSigned posts a message to the mux with the signature fields and
+// returns the status.
+func postSigned(mux *http.ServeMux, timestamp, token, signature string) int {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("recipient", "test@example.com")
+	_ = writer.WriteField("body-mime", "Subject: Test\n\nTest message")
+	_ = writer.WriteField("timestamp", timestamp)
+	_ = writer.WriteField("token", token)
+	_ = writer.WriteField("signature", signature)
+	_ = writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/hooks/secret/mg/mx/mime", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestSpamHeaders(t *testing.T) {
+	forged := "X-Mailgun-Sflag: Yes\r\nX-Mailgun-Sscore: 9.5\r\nSubject: hi\r\nX-Mailgun-Sflag: No\r\nX-Mailgun-Sscore: -5\r\n\r\nbuy now"
+
+	env := &rt.Envelope{}
+	spamHeaders(env, nil, forged)
+	if env.SpamVerdict != "spam" || env.SpamScore == nil || *env.SpamScore != 9.5 {
+		t.Errorf("verdict from the message = %q, %v", env.SpamVerdict, env.SpamScore)
+	}
+
+	env = &rt.Envelope{}
+	spamHeaders(env, map[string][]string{"X-Mailgun-Sflag": {"Yes"}, "X-Mailgun-Sscore": {"7"}}, "X-Mailgun-Sflag: No\r\n\r\nhi")
+	if env.SpamVerdict != "spam" || env.SpamScore == nil || *env.SpamScore != 7 {
+		t.Errorf("verdict from the form = %q, %v", env.SpamVerdict, env.SpamScore)
+	}
+}
@@ -5,66 +5,147 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"go.ntppool.org/common/logger"
 
-	"go.askask.com/rt-mail/mailgun"
+	"go.askask.com/rt-mail/admin"
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/auth"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/dashboard"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/health"
+	"go.askask.com/rt-mail/limits"
 	"go.askask.com/rt-mail/middleware"
+	"go.askask.com/rt-mail/offload"
+	"go.askask.com/rt-mail/policy"
+	"go.askask.com/rt-mail/proxy"
 	requesttracker "go.askask.com/rt-mail/rt"
-	"go.askask.com/rt-mail/sendgrid"
 	"go.askask.com/rt-mail/ses"
-	"go.askask.com/rt-mail/sparkpost"
+	"go.askask.com/rt-mail/trace"
 )
 
+// configUsage describes the -config flag.
+const configUsage = "pathname of configuration file (JSON, or YAML or TOML by extension)"
+
 var (
-	configfile = flag.String("config", "rt-mail.json", "pathname of JSON configuration file")
+	configfile = flag.String("config", "rt-mail.json", configUsage)
 	listen     = flag.String("listen", ":8002", "listen address")
 )
 
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: rt-mail -config=rt-mail.json -listen=:8080")
+		fmt.Fprintln(os.Stderr, "       rt-mail check-config|route|replay|schema [flags] ...")
 		flag.PrintDefaults()
 	}
 	log.SetFlags(log.Ltime | log.Lmicroseconds | log.Lshortfile)
 }
 
-type provider interface {
-	RegisterRoutes(mux *http.ServeMux)
-}
-
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(replayCommand(os.Args[2:]))
+		case "check-config":
+			os.Exit(checkConfigCommand(os.Args[2:]))
+		case "route":
+			os.Exit(routeCommand(os.Args[2:]))
+		case "schema":
+			os.Exit(schemaCommand(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	// Initialize structured logger
 	log := logger.Setup()
 	ctx := logger.NewContext(context.Background(), log)
 
-	rt, err := requesttracker.New(*configfile)
+	cfg, err := config.Load(*configfile)
+	if err != nil {
+		log.ErrorContext(ctx, "failed to load configuration", "file", *configfile, "error", err)
+		os.Exit(1)
+	}
+
+	rtClient, filters, err := setupClient(ctx, cfg)
 	if err != nil {
 		log.ErrorContext(ctx, "failed to setup RT interface", "error", err)
 		os.Exit(1)
 	}
 
-	spark := &sparkpost.SparkPost{RT: rt}
-	sg := &sendgrid.Sendgrid{RT: rt}
-	mg := &mailgun.Mailgun{RT: rt}
+	var rt requesttracker.Client = filters
+	var messageArchive *archive.Archive
+	if cfg.Archive != nil {
+		messageArchive, err = archive.New(ctx, filters, cfg.Archive)
+		if err != nil {
+			log.ErrorContext(ctx, "failed to setup archive", "error", err)
+			os.Exit(1)
+		}
+		go messageArchive.PruneLoop(ctx, time.Hour)
+		rt = messageArchive
+	}
+	rt = admin.Count(rt)
 
-	providers := []provider{
-		spark, sg, mg,
+	var dash *dashboard.Dashboard
+	if cfg.Admin != nil && cfg.Admin.Dashboard != nil {
+		dash = dashboard.New(cfg.Admin.Dashboard, filters)
+		rt = dash.Record(rt)
 	}
 
-	// Add SES provider if configured
-	if topicARN := os.Getenv("RT_SES_SNS_TOPIC_ARN"); topicARN != "" {
-		sesHandler, err := ses.New(rt, topicARN)
-		if err != nil {
-			log.ErrorContext(ctx, "failed to setup SES handler", "error", err)
+	var byIP, byRoute *middleware.Limiter
+	if rl := cfg.RateLimits; rl != nil {
+		byIP = middleware.NewLimiter("ip", rl.IP)
+		byRoute = middleware.NewLimiter("route", rl.Route)
+		if rl.Sender != nil || rl.Recipient != nil {
+			rt = middleware.RateLimitClient(rt,
+				middleware.NewLimiter("sender", rl.Sender),
+				middleware.NewLimiter("recipient", rl.Recipient))
+		}
+	}
+
+	providers, sesEnabled, err := setupProviders(ctx, cfg, rt)
+	if err != nil {
+		log.ErrorContext(ctx, "failed to setup providers", "error", err)
+		os.Exit(1)
+	}
+
+	ready := readiness(rtClient, providers)
+
+	if cfg.Admin != nil {
+		if cfg.Admin.Token == "" {
+			log.ErrorContext(ctx, "admin token not configured")
 			os.Exit(1)
 		}
-		providers = append(providers, sesHandler)
-		log.InfoContext(ctx, "SES handler enabled", "topic_arn", topicARN)
+		adminServer := &admin.Server{
+			Token:   string(cfg.Admin.Token),
+			RT:      rtClient,
+			Client:  filters,
+			Archive: messageArchive,
+			Ready:   ready,
+		}
+		if sesEnabled {
+			adminServer.FlushCertCache = ses.FlushCertCache
+		}
+		if dash != nil {
+			adminServer.UI = dash.Handler(admin.UIPrefix)
+		}
+		adminHandler := middleware.Chain(adminServer.Handler(),
+			middleware.Recovery,
+			middleware.RequestID,
+			middleware.Logging,
+		)
+		go func() {
+			log.InfoContext(ctx, "starting admin server", "listen", cfg.Admin.Listen)
+			if err := http.ListenAndServe(cfg.Admin.Listen, adminHandler); err != nil { //nolint:gosec
+				log.ErrorContext(ctx, "admin server error", "error", err)
+				os.Exit(1)
+			}
+		}()
 	}
 
 	mux := http.NewServeMux()
@@ -78,16 +159,112 @@ func main() {
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
 	})
+	// only the status: the details name internal hosts and errors, and
+	// are on the admin listener
+	mux.Handle("/readyz", ready.StatusHandler())
+
+	allow, err := providerAllowlists(providerSettings(cfg))
+	if err != nil {
+		log.ErrorContext(ctx, "failed to load allowlists", "error", err)
+		os.Exit(1)
+	}
+	var trusted proxy.Nets
+	if cfg.Proxy != nil {
+		trusted, err = proxy.ParseNets(cfg.Proxy.Trusted)
+		if err != nil {
+			log.ErrorContext(ctx, "invalid trusted proxies", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// Apply middleware
 	handler := middleware.Chain(mux,
 		middleware.Recovery,
+		middleware.RealIP(trusted),
+		middleware.RequestID,
 		middleware.Logging,
+		middleware.Allowlist(allow),
+		middleware.RateLimit(byIP, byRoute),
 	)
 
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.ErrorContext(ctx, "server error", "error", err)
+		os.Exit(1)
+	}
+	if cfg.Proxy != nil && cfg.Proxy.Protocol {
+		ln = proxy.Listen(ln, trusted)
+	}
+
 	log.InfoContext(ctx, "starting server", "listen", *listen)
-	if err := http.ListenAndServe(*listen, handler); err != nil { //nolint:gosec
+	if err := http.Serve(ln, handler); err != nil { //nolint:gosec
 		log.ErrorContext(ctx, "server error", "error", err)
 		os.Exit(1)
 	}
 }
+
+// setupClient returns the RT client and the filter chain in front of it.
+func setupClient(ctx context.Context, cfg *config.Config) (*requesttracker.RT, *filter.Client, error) {
+	rtClient, err := requesttracker.NewFromConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filters, err := filter.New(rtClient, &cfg.Filters)
+	if err != nil {
+		return nil, nil, fmt.Errorf("filters: %w", err)
+	}
+	if cfg.Auth != nil {
+		filters.Use(auth.NewVerifier(cfg.Auth))
+	}
+	// policy runs before offload and limits, so rejected messages
+	// aren't uploaded or stripped first
+	if len(cfg.Policies) > 0 {
+		if err := checkRequireAuth(cfg); err != nil {
+			return nil, nil, fmt.Errorf("queue policies: %w", err)
+		}
+		pf, err := policy.New(cfg.Policies, rtClient)
+		if err != nil {
+			return nil, nil, fmt.Errorf("queue policies: %w", err)
+		}
+		filters.Use(pf)
+	}
+	if cfg.Offload != nil {
+		of, err := offload.New(ctx, cfg.Offload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("attachment offload: %w", err)
+		}
+		filters.Use(of)
+	}
+	lf, err := limits.New(&cfg.Limits, cfg.Policies, rtClient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("size limits: %w", err)
+	}
+	filters.Use(lf)
+	if cfg.Trace != nil {
+		tf, err := trace.New(cfg.Trace, rtClient)
+		if err != nil {
+			return nil, nil, fmt.Errorf("trace headers: %w", err)
+		}
+		filters.Use(tf)
+	}
+
+	return rtClient, filters, nil
+}
+
+// readiness returns the /readyz checks: that each RT backend can be
+// reached, and S3 if SES is enabled.
+func readiness(rtClient *requesttracker.RT, providers []provider) *health.Checker {
+	checker := &health.Checker{}
+	for _, b := range rtClient.Status() {
+		checker.Add("rt:"+b.Name, func(ctx context.Context) error {
+			return rtClient.Ping(ctx, b.Name)
+		})
+	}
+	for _, p := range providers {
+		if s, ok := p.(*ses.SES); ok {
+			checker.Add("s3", s.Ping)
+		}
+	}
+	return checker
+}
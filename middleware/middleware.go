@@ -26,8 +26,8 @@ func Recovery(next http.Handler) http.Handler {
 // Logging middleware logs requests
 func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip logging for healthz endpoint
-		if r.URL.Path == "/healthz" {
+		// Skip logging for the health endpoints
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
 			next.ServeHTTP(w, r)
 			return
 		}
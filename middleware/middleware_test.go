@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/proxy"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter("test", &config.Rate{Rate: 2, Per: config.Duration(time.Second), Burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("over the burst: %v, wait %s", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("other key refused")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("refused after refill")
+	}
+
+	// full buckets are forgotten
+	now = now.Add(time.Hour)
+	l.Allow("c")
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets after sweep", len(l.buckets))
+	}
+
+	if ok, _ := (*Limiter)(nil).Allow("a"); !ok {
+		t.Error("nil limiter refused")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	byIP := NewLimiter("ip", &config.Rate{Rate: 1})
+	h := RateLimit(byIP, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	do := func(remote, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	testutil.AssertStatusCode(t, do("192.0.2.1:1234", "/mg/mx/mime").Code, http.StatusNoContent)
+	w := do("192.0.2.1:5678", "/mg/mx/mime")
+	testutil.AssertStatusCode(t, w.Code, http.StatusTooManyRequests)
+	if w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Retry-After = %q", w.Header().Get("Retry-After"))
+	}
+	testutil.AssertStatusCode(t, do("192.0.2.2:1234", "/mg/mx/mime").Code, http.StatusNoContent)
+	testutil.AssertStatusCode(t, do("192.0.2.1:1234", "/healthz").Code, http.StatusNoContent)
+}
+
+func TestRateLimitClient(t *testing.T) {
+	client := RateLimitClient(&testutil.MockRTClient{},
+		NewLimiter("sender", &config.Rate{Rate: 1}),
+		NewLimiter("recipient", &config.Rate{Rate: 2}))
+	post := func(from, to string) error {
+		ctx := rt.NewContext(context.Background(), &rt.Envelope{From: from})
+		return client.Postmail(ctx, to, "")
+	}
+
+	testutil.AssertNoError(t, post("a@example.com", "help@example.com"))
+	err := post("A@example.com", "help@example.com")
+	if e, ok := err.(*rt.Error); !ok || !e.Busy {
+		t.Errorf("second message from sender: %v", err)
+	}
+	testutil.AssertNoError(t, post("b@example.com", "help@example.com"))
+	if err := post("c@example.com", "help@example.com"); err == nil {
+		t.Error("third message to recipient: no error")
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, err := proxy.ParseNets([]string{"10.0.0.0/8"})
+	testutil.AssertNoError(t, err)
+	var got string
+	h := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	}))
+
+	tests := []struct {
+		remote, xff, want string
+	}{
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1:1234"}, // not from a proxy
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1:0"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.0.0.2", "198.51.100.1:0"}, // forged first hop
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3:0"},
+		{"10.0.0.1:1234", "", "10.0.0.1:1234"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1:1234"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/mg/mx/mime", nil)
+		req.RemoteAddr = test.remote
+		if test.xff != "" {
+			req.Header.Set("X-Forwarded-For", test.xff)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != test.want {
+			t.Errorf("%s with X-Forwarded-For %q: %s, want %s", test.remote, test.xff, got, test.want)
+		}
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	mailgun, err := proxy.ParseNets([]string{"192.0.2.0/24", "2001:db8::/32"})
+	testutil.AssertNoError(t, err)
+	hooks, err := proxy.ParseNets([]string{"198.51.100.7"})
+	testutil.AssertNoError(t, err)
+	h := Allowlist(map[string]proxy.Nets{"/mg": mailgun, "/mg/hooks": hooks})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		remote, path string
+		want         int
+	}{
+		{"192.0.2.1:1234", "/mg/mx/mime", http.StatusNoContent},
+		{"[2001:db8::1]:1234", "/mg/mx/mime", http.StatusNoContent},
+		{"203.0.113.1:1234", "/mg/mx/mime", http.StatusForbidden},
+		{"203.0.113.1:1234", "/mgx/mx/mime", http.StatusNoContent},
+		{"203.0.113.1:1234", "/spark/mx", http.StatusNoContent},
+		{"192.0.2.1:1234", "/mg/hooks/x", http.StatusForbidden},
+		{"198.51.100.7:1234", "/mg/hooks/x", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, test.path, nil)
+		req.RemoteAddr = test.remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s %s: %d, want %d", test.remote, test.path, w.Code, test.want)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var got string
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = rt.RequestIDFromContext(r.Context())
+	}))
+	do := func(header map[string]string) string {
+		req := httptest.NewRequest(http.MethodPost, "/ses", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Header().Get(RequestIDHeader) != got {
+			t.Errorf("response header %q, context %q", w.Header().Get(RequestIDHeader), got)
+		}
+		return got
+	}
+
+	if id := do(map[string]string{"X-Request-ID": "abc-123"}); id != "abc-123" {
+		t.Errorf("propagated ID = %q", id)
+	}
+	if id := do(map[string]string{"X-Amz-Sns-Message-Id": "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324"}); id != "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324" {
+		t.Errorf("SNS ID = %q", id)
+	}
+	first := do(nil)
+	if len(first) != 32 || do(nil) == first {
+		t.Errorf("generated IDs %q, %q", first, got)
+	}
+	if id := do(map[string]string{"X-Request-ID": "bad\r\nX-Injected: 1"}); strings.Contains(id, "Injected") {
+		t.Errorf("unsafe ID accepted: %q", id)
+	}
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/proxy"
+)
+
+// allowlistRejections counts the requests refused by allowlists, keyed
+// by the path prefix.
+var allowlistRejections = expvar.NewMap("allowlist_rejections")
+
+// RealIP returns middleware setting the request's RemoteAddr to the
+// client's address from X-Forwarded-For, when the request comes from a
+// trusted proxy. The header is read from the right, skipping the
+// trusted proxies, so clients can't forge their address by sending the
+// header themselves.
+func RealIP(trusted proxy.Nets) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(trusted) > 0 && trusted.ContainsString(r.RemoteAddr) {
+				if client := forwardedFor(r, trusted); client != "" {
+					r.RemoteAddr = client
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor returns the client address from X-Forwarded-For: the
+// last one that isn't a trusted proxy.
+func forwardedFor(r *http.Request, trusted proxy.Nets) string {
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(h, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := proxy.ParseAddr(hops[i])
+		if err != nil {
+			break
+		}
+		client = net.JoinHostPort(addr.String(), "0")
+		if !trusted.Contains(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// Allowlist returns middleware refusing requests to paths under the
+// prefixes from addresses not in the prefix's networks, with 403
+// Forbidden. Paths under no prefix are allowed.
+func Allowlist(allow map[string]proxy.Nets) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			prefix, nets, ok := longestPrefix(allow, r.URL.Path)
+			if ok && !nets.ContainsString(r.RemoteAddr) {
+				ctx := r.Context()
+				log := logger.FromContext(ctx)
+				log.WarnContext(ctx, "request from address not in allowlist", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				allowlistRejections.Add(prefix, 1)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// longestPrefix returns the longest prefix in allow that path is under.
+func longestPrefix(allow map[string]proxy.Nets, path string) (string, proxy.Nets, bool) {
+	best, found := "", false
+	for prefix := range allow {
+		if (path == prefix || strings.HasPrefix(path, prefix+"/")) && len(prefix) >= len(best) {
+			best, found = prefix, true
+		}
+	}
+	return best, allow[best], found
+}
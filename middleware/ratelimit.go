@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+)
+
+// rateLimited counts the requests and messages refused by rate limits,
+// keyed by limit ("ip", "route", "sender" or "recipient").
+var rateLimited = expvar.NewMap("rate_limited")
+
+// Limiter is a set of token buckets, one per key.
+type Limiter struct {
+	name  string
+	rate  float64 // tokens per second
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns the limiter for cfg, or nil if cfg is nil. name is
+// what the limit is counted as in the rate_limited expvar.
+func NewLimiter(name string, cfg *config.Rate) *Limiter {
+	if cfg == nil || cfg.Rate <= 0 {
+		return nil
+	}
+	per := cfg.Per.Or(time.Minute)
+	burst := float64(cfg.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(cfg.Rate))
+	}
+	return &Limiter{
+		name:    name,
+		rate:    cfg.Rate / per.Seconds(),
+		burst:   burst,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the key's bucket. If there is none, it
+// returns false and how long until there is.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	rateLimited.Add(l.name, 1)
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets the buckets that have filled up again, which are the
+// same as new ones, so the map doesn't grow with every key ever seen.
+func (l *Limiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < max(full, time.Minute) {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimit returns middleware refusing requests over the limits per
+// client IP address and per route (path) with 429 Too Many Requests.
+// Either limiter may be nil.
+func RateLimit(byIP, byRoute *Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ok, wait := byIP.Allow(clientIP(r))
+			if ok {
+				ok, wait = byRoute.Allow(r.URL.Path)
+			}
+			if !ok {
+				ctx := r.Context()
+				log := logger.FromContext(ctx)
+				log.WarnContext(ctx, "rate limited request", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				w.Header().Set("Retry-After", retryAfter(wait))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the IP address of the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
+
+type rateLimitClient struct {
+	next        rt.Client
+	bySender    *Limiter
+	byRecipient *Limiter
+}
+
+// RateLimitClient returns a client refusing messages over the limits
+// per envelope sender and per recipient, with a busy error so the
+// provider is told to retry later. Either limiter may be nil.
+func RateLimitClient(next rt.Client, bySender, byRecipient *Limiter) rt.Client {
+	return &rateLimitClient{next: next, bySender: bySender, byRecipient: byRecipient}
+}
+
+func (c *rateLimitClient) Postmail(ctx context.Context, recipient string, message string) error {
+	sender := strings.ToLower(rt.EnvelopeFromContext(ctx).From)
+	if sender == "" {
+		sender = "<>"
+	}
+	if ok, wait := c.bySender.Allow(sender); !ok {
+		return rt.Busyf(wait, "rate limit for sender %s exceeded", sender)
+	}
+	if ok, wait := c.byRecipient.Allow(strings.ToLower(recipient)); !ok {
+		return rt.Busyf(wait, "rate limit for recipient %s exceeded", recipient)
+	}
+	return c.next.Postmail(ctx, recipient, message)
+}
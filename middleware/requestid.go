@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/rt"
+)
+
+// RequestIDHeader is the header a request ID is taken from and returned
+// in.
+const RequestIDHeader = "X-Request-ID"
+
+// snsMessageIDHeader is the ID SNS gives each notification (SES).
+const snsMessageIDHeader = "X-Amz-Sns-Message-Id"
+
+// maxRequestID is the longest request ID accepted from a client.
+const maxRequestID = 128
+
+// RequestID assigns each request an ID: the X-Request-ID header set by a
+// proxy or the client, the provider's ID for the notification, or a
+// random one. The ID is returned in the X-Request-ID header, added to the
+// logger in the request's context as request_id, and stored in the
+// context for rt.RequestIDFromContext.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := validRequestID(r.Header.Get(RequestIDHeader))
+		if id == "" {
+			id = validRequestID(r.Header.Get(snsMessageIDHeader))
+		}
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := r.Context()
+		log := logger.FromContext(ctx).With("request_id", id)
+		ctx = logger.NewContext(rt.WithRequestID(ctx, id), log)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID returns id if it's safe to log and to put in a message
+// header: not too long, and only printable ASCII without spaces.
+func validRequestID(id string) string {
+	if len(id) > maxRequestID {
+		return ""
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return ""
+		}
+	}
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,143 @@
+// Package offload moves large attachments out of messages into storage
+// and replaces them with a link, so they don't bloat RT's database.
+package offload
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/attachment"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/storage"
+)
+
+// offloaded counts offloaded attachments and failed uploads.
+var offloaded = expvar.NewMap("offloaded_attachments")
+
+// defaultAbove is the size above which attachments are offloaded when
+// it isn't configured.
+const defaultAbove = 1 << 20
+
+// Filter replaces attachments larger than Above with a link to a copy
+// in Store.
+type Filter struct {
+	Store storage.Store
+	Above int64
+}
+
+// New returns a filter configured from cfg.
+func New(ctx context.Context, cfg *config.Offload) (*Filter, error) {
+	// the links stay in tickets for good, so they can't be presigned
+	// URLs, which expire
+	if cfg.S3 != nil && cfg.URL == "" {
+		return nil, errors.New("url is required with s3, for the links to the attachments")
+	}
+	store, err := storage.New(ctx, &cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	above := int64(cfg.Above)
+	if above <= 0 {
+		above = defaultAbove
+	}
+	return &Filter{Store: store, Above: above}, nil
+}
+
+// Filter uploads the large attachments of the message and replaces them
+// with a note linking to the upload. Attachments that can't be uploaded
+// are left in the message.
+func (f *Filter) Filter(ctx context.Context, msg *filter.Message) error {
+	log := logger.FromContext(ctx)
+
+	raw, changed, err := attachment.Rewrite(msg.Raw, func(p *attachment.Part) (string, error) {
+		if int64(p.Size) <= f.Above {
+			return "", nil
+		}
+		url, err := f.upload(ctx, p)
+		if err != nil {
+			offloaded.Add("errors", 1)
+			log.WarnContext(ctx, "could not offload attachment",
+				"recipient", msg.Recipient,
+				"filename", p.Filename,
+				"error", err,
+			)
+			return "", nil
+		}
+		offloaded.Add("attachments", 1)
+		log.InfoContext(ctx, "offloaded attachment",
+			"recipient", msg.Recipient,
+			"filename", p.Filename,
+			"size", p.Size,
+			"url", url,
+		)
+		return Note(p, url), nil
+	})
+	if err != nil {
+		return fmt.Errorf("offload: %w", err)
+	}
+	if changed {
+		msg.Raw = raw
+	}
+	return nil
+}
+
+func (f *Filter) upload(ctx context.Context, p *attachment.Part) (string, error) {
+	content, err := p.Content()
+	if err != nil {
+		return "", err
+	}
+	key, err := Key(time.Now(), p.Filename)
+	if err != nil {
+		return "", err
+	}
+	if err := f.Store.Put(ctx, key, p.ContentType, content); err != nil {
+		return "", err
+	}
+	return f.Store.URL(ctx, key)
+}
+
+// Key returns a unique storage key for an attachment, partitioned by date.
+func Key(t time.Time, filename string) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return path.Join(t.UTC().Format("2006/01/02"), hex.EncodeToString(b), safeName(filename)), nil
+}
+
+// safeName makes filename usable as the last element of a key.
+func safeName(filename string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, filename)
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "attachment"
+	}
+	return name
+}
+
+// Note is the text an offloaded attachment is replaced with.
+func Note(p *attachment.Part, url string) string {
+	name := p.Filename
+	if name == "" {
+		name = "(unnamed)"
+	}
+	return fmt.Sprintf("[rt-mail: the attachment %q (%s, %s) was moved out of the message. Download it from:\n\n%s\n]",
+		name, p.ContentType, attachment.FormatSize(p.Size), url)
+}
@@ -0,0 +1,112 @@
+package offload
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/storage"
+	"go.askask.com/rt-mail/testutil"
+)
+
+func testMessage(large []byte) string {
+	return "From: alice@example.com\r\nSubject: files\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n" +
+		"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=small.txt\r\n\r\n" +
+		"small\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"big report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(large) + "\r\n" +
+		"--b--\r\n"
+}
+
+func TestOffload(t *testing.T) {
+	dir := t.TempDir()
+	f, err := New(context.Background(), &config.Offload{
+		Above:   100,
+		Storage: config.Storage{Dir: dir, URL: "https://files.example.com"},
+	})
+	testutil.AssertNoError(t, err)
+
+	large := []byte(strings.Repeat("%PDF", 100))
+	msg := &filter.Message{Recipient: "help@example.com", Raw: []byte(testMessage(large)), Envelope: &rt.Envelope{}}
+	testutil.AssertNoError(t, f.Filter(context.Background(), msg))
+
+	raw := string(msg.Raw)
+	if strings.Contains(raw, base64.StdEncoding.EncodeToString(large)) {
+		t.Error("large attachment still in message")
+	}
+	if !strings.Contains(raw, "filename=small.txt\r\n\r\nsmall\r\n") {
+		t.Error("small attachment not kept")
+	}
+	if !strings.Contains(raw, `the attachment "big report.pdf" (application/pdf`) {
+		t.Errorf("no note in message:\n%s", raw)
+	}
+
+	idx := strings.Index(raw, "https://files.example.com/")
+	if idx < 0 {
+		t.Fatalf("no link in message:\n%s", raw)
+	}
+	link := raw[idx:]
+	link = link[:strings.IndexAny(link, "\r\n")]
+	if !strings.HasSuffix(link, "/big_report.pdf") {
+		t.Errorf("link = %q", link)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(link, "https://files.example.com/"))))
+	testutil.AssertNoError(t, err)
+	if string(stored) != string(large) {
+		t.Error("stored attachment differs from the original")
+	}
+}
+
+type failingStore struct {
+	storage.Store
+}
+
+func (failingStore) Put(context.Context, string, string, []byte) error {
+	return errors.New("bucket unavailable")
+}
+
+func (failingStore) URL(context.Context, string) (string, error) {
+	return "", errors.New("bucket unavailable")
+}
+
+func TestOffloadUploadError(t *testing.T) {
+	f := &Filter{Store: failingStore{}, Above: 10}
+	orig := testMessage([]byte(strings.Repeat("x", 100)))
+	msg := &filter.Message{Raw: []byte(orig), Envelope: &rt.Envelope{}}
+	testutil.AssertNoError(t, f.Filter(context.Background(), msg))
+	if string(msg.Raw) != orig {
+		t.Error("message changed although the upload failed")
+	}
+}
+
+func TestNewS3RequiresURL(t *testing.T) {
+	cfg := &config.Offload{Storage: config.Storage{S3: &config.S3{Bucket: "attachments"}}}
+	if _, err := New(context.Background(), cfg); err == nil {
+		t.Error("offloading to S3 without url: no error")
+	}
+}
+
+func TestKey(t *testing.T) {
+	ts := time.Date(2026, 10, 19, 23, 0, 0, 0, time.FixedZone("", -7*3600))
+	key, err := Key(ts, "../../etc/pass wd")
+	testutil.AssertNoError(t, err)
+	parts := strings.Split(key, "/")
+	if len(parts) != 5 || strings.Join(parts[:3], "/") != "2026/10/20" || parts[4] != "_.._etc_pass_wd" {
+		t.Errorf("key = %q", key)
+	}
+	if key2, _ := Key(ts, "a"); strings.Split(key2, "/")[3] == parts[3] {
+		t.Error("keys aren't unique")
+	}
+}
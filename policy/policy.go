@@ -0,0 +1,179 @@
+// Package policy enforces the per-queue sender and size policies from
+// the configuration file before a message is posted to RT.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+)
+
+// rejections counts rejected messages by queue and reason.
+var rejections = expvar.NewMap("policy_rejections")
+
+// Filter enforces queue policies.
+type Filter struct {
+	router   filter.Router
+	policies map[string]*policy
+}
+
+type policy struct {
+	allowSenders  map[string]bool
+	allowDomains  []string
+	allowPatterns []*regexp.Regexp
+	blockSenders  map[string]bool
+	blockDomains  []string
+	blockPatterns []*regexp.Regexp
+	requireAuth   bool
+}
+
+// New returns a filter enforcing the configured policies. router is used
+// to find the queue for messages that haven't been rerouted.
+func New(policies map[string]*config.Policy, router filter.Router) (*Filter, error) {
+	f := &Filter{router: router, policies: map[string]*policy{}}
+	for queue, cfg := range policies {
+		p, err := compile(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("policy for queue %q: %w", queue, err)
+		}
+		f.policies[queue] = p
+	}
+	return f, nil
+}
+
+func compile(cfg *config.Policy) (*policy, error) {
+	p := &policy{
+		allowSenders: lowerSet(cfg.AllowSenders),
+		allowDomains: lowerList(cfg.AllowDomains),
+		blockSenders: lowerSet(cfg.BlockSenders),
+		blockDomains: lowerList(cfg.BlockDomains),
+		requireAuth:  cfg.RequireAuth,
+	}
+	var err error
+	if p.allowPatterns, err = compilePatterns(cfg.AllowPatterns); err != nil {
+		return nil, err
+	}
+	if p.blockPatterns, err = compilePatterns(cfg.BlockPatterns); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Filter rejects the message if it violates the policy of its queue.
+func (f *Filter) Filter(ctx context.Context, msg *filter.Message) error {
+	queue := msg.QueueFor(f.router)
+	p, ok := f.policies[queue]
+	if !ok {
+		p, ok = f.policies["*"]
+	}
+	if !ok || queue == "" {
+		return nil
+	}
+
+	sender := Sender(msg)
+	reason := p.check(sender, msg)
+	if reason == "" {
+		return nil
+	}
+
+	rejections.Add(queue+":"+reason, 1)
+
+	log := logger.FromContext(ctx)
+	log.WarnContext(ctx, "policy rejected message",
+		"queue", queue,
+		"recipient", msg.Recipient,
+		"sender", sender,
+		"reason", reason,
+	)
+
+	return rt.Rejectf("policy for queue %q: %s", queue, reason)
+}
+
+// check returns the reason the message isn't accepted, or "" if it is.
+func (p *policy) check(sender string, msg *filter.Message) string {
+	if p.matches(sender, p.blockSenders, p.blockDomains, p.blockPatterns) {
+		return "sender blocked"
+	}
+	hasAllow := len(p.allowSenders) > 0 || len(p.allowDomains) > 0 || len(p.allowPatterns) > 0
+	if hasAllow && !p.matches(sender, p.allowSenders, p.allowDomains, p.allowPatterns) {
+		return "sender not allowed"
+	}
+	if p.requireAuth && (msg.Envelope == nil || msg.Envelope.DMARC != "pass") {
+		return "sender not authenticated"
+	}
+	return ""
+}
+
+func (p *policy) matches(sender string, senders map[string]bool, domains []string, patterns []*regexp.Regexp) bool {
+	if sender == "" {
+		return false
+	}
+	if senders[sender] {
+		return true
+	}
+	_, domain, _ := strings.Cut(sender, "@")
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	for _, re := range patterns {
+		if re.MatchString(sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sender returns the address policies are checked against: the From
+// header address, or the envelope sender if the message has no usable
+// From header.
+func Sender(msg *filter.Message) string {
+	if m, err := mail.ReadMessage(bytes.NewReader(msg.Raw)); err == nil {
+		if addrs, err := m.Header.AddressList("From"); err == nil && len(addrs) == 1 {
+			return strings.ToLower(addrs[0].Address)
+		}
+	}
+	if msg.Envelope != nil {
+		return strings.ToLower(msg.Envelope.From)
+	}
+	return ""
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func lowerSet(list []string) map[string]bool {
+	set := map[string]bool{}
+	for _, s := range list {
+		set[strings.ToLower(s)] = true
+	}
+	return set
+}
+
+func lowerList(list []string) []string {
+	var res []string
+	for _, s := range list {
+		res = append(res, strings.ToLower(strings.TrimPrefix(s, "@")))
+	}
+	return res
+}
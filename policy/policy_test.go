@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+type staticRouter map[string]string
+
+func (r staticRouter) Route(recipient string) (string, string) {
+	return r[recipient], "correspond"
+}
+
+func TestPolicyFilter(t *testing.T) {
+	router := staticRouter{
+		"ops@example.com":    "ops",
+		"help@example.com":   "help",
+		"public@example.com": "public",
+	}
+	f, err := New(map[string]*config.Policy{
+		"ops": {
+			AllowDomains: []string{"example.com"},
+			BlockSenders: []string{"intern@example.com"},
+			RequireAuth:  true,
+		},
+		"help": {
+			BlockPatterns: []string{`^noreply@`},
+		},
+		"*": {
+			BlockDomains: []string{"spam.example"},
+		},
+	}, router)
+	testutil.AssertNoError(t, err)
+
+	tests := []struct {
+		name      string
+		recipient string
+		from      string
+		dmarc     string
+		reason    string
+	}{
+		{"own domain", "ops@example.com", "alice@example.com", "pass", ""},
+		{"own subdomain", "ops@example.com", "alice@eu.example.com", "pass", ""},
+		{"other domain", "ops@example.com", "alice@example.org", "pass", "sender not allowed"},
+		{"blocked sender", "ops@example.com", "intern@example.com", "pass", "sender blocked"},
+		{"not authenticated", "ops@example.com", "alice@example.com", "fail", "sender not authenticated"},
+		{"pattern", "help@example.com", "NoReply@example.org", "", "sender blocked"},
+		{"default policy", "public@example.com", "x@spam.example", "", "sender blocked"},
+		{"default policy pass", "public@example.com", "x@example.org", "", ""},
+		{"unknown queue", "nobody@example.com", "x@spam.example", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &filter.Message{
+				Recipient: tt.recipient,
+				Raw:       []byte("From: Someone <" + tt.from + ">\r\n\r\nbody"),
+				Envelope:  &rt.Envelope{From: "bounce@example.net", DMARC: tt.dmarc},
+			}
+			err := f.Filter(context.Background(), msg)
+			if tt.reason == "" {
+				testutil.AssertNoError(t, err)
+				return
+			}
+			rtErr, ok := err.(*rt.Error)
+			if !ok || !rtErr.Rejected {
+				t.Fatalf("expected rejection, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("error %q doesn't contain %q", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestSenderFallsBackToEnvelope(t *testing.T) {
+	msg := &filter.Message{
+		Raw:      []byte("Subject: no from\r\n\r\nbody"),
+		Envelope: &rt.Envelope{From: "Bounce@Example.net"},
+	}
+	if got := Sender(msg); got != "bounce@example.net" {
+		t.Errorf("Sender() = %q", got)
+	}
+}
+
+// replyClient routes the replies to addresses without a queue to
+// "General", like rt.RT with rt-replies.
+type replyClient struct {
+	testutil.MockRTClient
+}
+
+func (replyClient) ReplyRoute(_, message string) (string, string) {
+	if strings.Contains(message, "[rt #1]") {
+		return "General", "correspond"
+	}
+	return "", ""
+}
+
+func TestReplyQueuePolicy(t *testing.T) {
+	f, err := New(map[string]*config.Policy{
+		"General": {BlockDomains: []string{"spam.example"}},
+	}, staticRouter{})
+	testutil.AssertNoError(t, err)
+	client, err := filter.New(&replyClient{}, &config.Filters{})
+	testutil.AssertNoError(t, err)
+	client.Use(f)
+
+	ctx := context.Background()
+	err = client.Postmail(ctx, "sales@example.com", "From: x@spam.example\r\nSubject: Re: [rt #1] hi\r\n\r\nbody")
+	if rtErr, ok := err.(*rt.Error); !ok || !rtErr.Rejected {
+		t.Errorf("reply to the replies queue: got %v, want rejection", err)
+	}
+	err = client.Postmail(ctx, "sales@example.com", "From: x@spam.example\r\nSubject: hi\r\n\r\nbody")
+	testutil.AssertNoError(t, err)
+}
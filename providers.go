@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/mailgun"
+	"go.askask.com/rt-mail/proxy"
+	requesttracker "go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/sendgrid"
+	"go.askask.com/rt-mail/ses"
+	"go.askask.com/rt-mail/sparkpost"
+)
+
+type provider interface {
+	RegisterRoutes(mux *http.ServeMux)
+}
+
+// providerSettings returns the providers section of the configuration,
+// or the providers enabled by default if there isn't one.
+func providerSettings(cfg *config.Config) *config.Providers {
+	if cfg.Providers != nil {
+		return cfg.Providers
+	}
+	p := &config.Providers{
+		SparkPost: &config.SparkPost{},
+		Sendgrid:  &config.Provider{},
+		Mailgun:   &config.Mailgun{},
+	}
+	if os.Getenv("RT_SES_SNS_TOPIC_ARN") != "" {
+		p.SES = &config.SES{}
+	}
+	return p
+}
+
+// checkRequireAuth returns an error if a policy has require-auth but
+// nothing sets the DMARC verdict it checks: the auth filter, or SES if
+// it's the only provider.
+func checkRequireAuth(cfg *config.Config) error {
+	if cfg.Auth != nil {
+		return nil
+	}
+	var queues []string
+	for queue, p := range cfg.Policies {
+		if p.RequireAuth {
+			queues = append(queues, queue)
+		}
+	}
+	if len(queues) == 0 {
+		return nil
+	}
+	if enabled := enabledProviders(providerSettings(cfg)); len(enabled) == 1 && enabled[0].name == "ses" {
+		return nil
+	}
+	sort.Strings(queues)
+	return fmt.Errorf("policies %s: require-auth needs the auth section unless SES is the only provider",
+		strings.Join(queues, ", "))
+}
+
+// providerSetting is the endpoint settings of a provider.
+type providerSetting struct {
+	name     string
+	settings *config.Provider
+	path     string // the prefix of the routes
+}
+
+// enabledProviders returns the settings of the enabled providers.
+func enabledProviders(p *config.Providers) []providerSetting {
+	var list []providerSetting
+	add := func(name string, pc *config.Provider, def string) {
+		if pc.IsEnabled() {
+			list = append(list, providerSetting{name, pc, strings.TrimSuffix(cmp.Or(pc.Path, def), "/")})
+		}
+	}
+	if p.SparkPost != nil {
+		add("sparkpost", &p.SparkPost.Provider, sparkpost.DefaultPath)
+	}
+	add("sendgrid", p.Sendgrid, sendgrid.DefaultPath)
+	if p.Mailgun != nil {
+		add("mailgun", &p.Mailgun.Provider, mailgun.DefaultPath)
+	}
+	if p.SES != nil {
+		add("ses", &p.SES.Provider, ses.DefaultPath)
+	}
+	return list
+}
+
+// checkProviders returns the problems with the provider settings: paths
+// that aren't absolute or are used by more than one provider, and
+// invalid allowlists.
+func checkProviders(p *config.Providers) []requesttracker.Problem {
+	var problems []requesttracker.Problem
+	addError := func(format string, a ...any) {
+		problems = append(problems, requesttracker.Problem{Severity: "error", Message: fmt.Sprintf(format, a...)})
+	}
+	used := map[string]string{}
+	for _, ps := range enabledProviders(p) {
+		switch {
+		case !strings.HasPrefix(ps.path, "/"):
+			addError("providers.%s.path %q must start with / and not be /", ps.name, ps.settings.Path)
+		case used[ps.path] != "":
+			addError("providers %s and %s both use path %q", used[ps.path], ps.name, ps.path)
+		default:
+			used[ps.path] = ps.name
+		}
+		if _, err := allowNets(ps.settings); err != nil {
+			addError("providers.%s: %s", ps.name, err)
+		}
+	}
+	return problems
+}
+
+// allowNets returns the networks the provider accepts requests from, or
+// nil if it has no allowlist.
+func allowNets(pc *config.Provider) (proxy.Nets, error) {
+	if len(pc.Allow) == 0 && pc.AllowFile == "" {
+		return nil, nil
+	}
+	nets, err := proxy.ParseNets(pc.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if pc.AllowFile != "" {
+		fromFile, err := proxy.LoadNets(pc.AllowFile)
+		if err != nil {
+			return nil, fmt.Errorf("allow-file: %w", err)
+		}
+		nets = append(nets, fromFile...)
+	}
+	return nets, nil
+}
+
+// providerAllowlists returns the allowlists of the enabled providers,
+// by the prefix of their routes.
+func providerAllowlists(p *config.Providers) (map[string]proxy.Nets, error) {
+	allow := map[string]proxy.Nets{}
+	for _, ps := range enabledProviders(p) {
+		nets, err := allowNets(ps.settings)
+		if err != nil {
+			return nil, fmt.Errorf("providers.%s: %w", ps.name, err)
+		}
+		if nets != nil {
+			allow[ps.path] = nets
+		}
+	}
+	return allow, nil
+}
+
+// setupProviders returns the enabled providers, posting messages to
+// client. sesEnabled reports whether SES is among them.
+func setupProviders(ctx context.Context, cfg *config.Config, client requesttracker.Client) (providers []provider, sesEnabled bool, err error) {
+	log := logger.FromContext(ctx)
+	p := providerSettings(cfg)
+	if problems := checkProviders(p); len(problems) > 0 {
+		return nil, false, errors.New(problems[0].Message)
+	}
+	// read more than the size limit for posting to RT, so oversized
+	// messages get to the limits filter and can be stripped
+	maxSize := int64(cfg.Limits.MaxRequestSize)
+	if maxSize <= 0 {
+		maxSize = 2 * requesttracker.MaxMessageSize(int64(cfg.Limits.MaxSize))
+	}
+
+	if p.SparkPost != nil && p.SparkPost.IsEnabled() {
+		providers = append(providers, &sparkpost.SparkPost{
+			RT:      client,
+			MaxSize: maxSize,
+			Path:    p.SparkPost.Path,
+			Token:   string(p.SparkPost.Token),
+		})
+	}
+	if p.Sendgrid.IsEnabled() {
+		providers = append(providers, &sendgrid.Sendgrid{
+			RT:      client,
+			MaxSize: maxSize,
+			Path:    p.Sendgrid.Path,
+		})
+	}
+	if p.Mailgun != nil && p.Mailgun.IsEnabled() {
+		providers = append(providers, &mailgun.Mailgun{
+			RT:         client,
+			MaxSize:    maxSize,
+			Path:       p.Mailgun.Path,
+			SigningKey: string(p.Mailgun.SigningKey),
+		})
+	}
+	if p.SES != nil && p.SES.IsEnabled() {
+		topicARN := cmp.Or(p.SES.TopicARN, os.Getenv("RT_SES_SNS_TOPIC_ARN"))
+		if topicARN == "" {
+			return nil, false, fmt.Errorf("providers.ses.topic-arn is not set")
+		}
+		sesHandler, err := ses.New(client, topicARN)
+		if err != nil {
+			return nil, false, fmt.Errorf("SES: %w", err)
+		}
+		sesHandler.MaxSize = maxSize
+		sesHandler.Path = p.SES.Path
+		providers = append(providers, sesHandler)
+		sesEnabled = true
+		log.InfoContext(ctx, "SES handler enabled", "topic_arn", topicARN)
+	}
+	return providers, sesEnabled, nil
+}
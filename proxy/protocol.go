@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerTimeout is the time allowed for reading the PROXY header.
+const headerTimeout = 5 * time.Second
+
+// v2Signature starts a version 2 PROXY protocol header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listen returns a listener reading the PROXY protocol header (version 1
+// or 2) on connections from the trusted networks, and using the client
+// address from it as the connection's remote address. Connections from
+// elsewhere are used as they are.
+func Listen(l net.Listener, trusted Nets) net.Listener {
+	return &listener{Listener: l, trusted: trusted}
+}
+
+type listener struct {
+	net.Listener
+	trusted Nets
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted.ContainsString(c.RemoteAddr().String()) {
+		return c, nil
+	}
+	// the header is read on first use, not to block Accept
+	return &conn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// conn is a connection from a proxy, starting with the PROXY header.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *conn) header() {
+	c.once.Do(func() {
+		_ = c.SetReadDeadline(time.Now().Add(headerTimeout))
+		c.remote, c.err = readHeader(c.r)
+		_ = c.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY protocol from %s: %w", c.Conn.RemoteAddr(), c.err)
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.header()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client's address from the PROXY header, or
+// the proxy's if the header has none.
+func (c *conn) RemoteAddr() net.Addr {
+	c.header()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads a PROXY protocol header and returns the source
+// address, or nil for connections the proxy made itself (LOCAL or
+// UNKNOWN).
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	// the shortest version 1 header, "PROXY UNKNOWN\r\n", is longer than
+	// the version 2 signature
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readV1 reads "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid version 1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid version 1 header")
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readV2 reads the binary version 2 header.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if h[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", h[12]>>4)
+	}
+	command, family := h[12]&0xf, h[13]
+	body := make([]byte, binary.BigEndian.Uint16(h[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch command {
+	case 0: // LOCAL: a health check from the proxy itself
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	switch family >> 4 {
+	case 1: // IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short IPv4 address block")
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 2: // IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short IPv6 address block")
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	// UNSPEC or a Unix socket: no address to use
+	return nil, nil
+}
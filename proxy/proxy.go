@@ -0,0 +1,94 @@
+// Package proxy finds the address of the client behind proxies and load
+// balancers, from the PROXY protocol or X-Forwarded-For, and matches
+// addresses against lists of networks.
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Nets is a list of networks.
+type Nets []netip.Prefix
+
+// ParseNets parses networks in CIDR notation or IP addresses.
+func ParseNets(list []string) (Nets, error) {
+	nets := make(Nets, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", s)
+			}
+			nets = append(nets, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		nets = append(nets, prefix.Masked())
+	}
+	return nets, nil
+}
+
+// LoadNets reads the networks in file, one per line. Blank lines and
+// comments starting with # are ignored.
+func LoadNets(file string) (Nets, error) {
+	f, err := os.Open(file) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	nets, err := ParseNets(list)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return nets, nil
+}
+
+// Contains reports whether addr is in one of the networks.
+func (n Nets) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range n {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsString is Contains for an address as a string, with or
+// without a port. It's false for an invalid address.
+func (n Nets) ContainsString(s string) bool {
+	addr, err := ParseAddr(s)
+	return err == nil && n.Contains(addr)
+}
+
+// ParseAddr parses an IP address, with or without a port.
+func ParseAddr(s string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "allow.txt")
+	content := "# Example ranges\n192.0.2.0/24\n\n2001:db8::/32  # v6\n198.51.100.7\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	nets, err := LoadNets(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"192.0.2.200":        true,
+		"192.0.2.1:443":      true,
+		"[::ffff:192.0.2.1]": true,
+		"2001:db8::1":        true,
+		"[2001:db8::1]:443":  true,
+		"198.51.100.7":       true,
+		"198.51.100.8":       false,
+		"203.0.113.1":        false,
+		"not an address":     false,
+	} {
+		if got := nets.ContainsString(addr); got != want {
+			t.Errorf("%s: %v, want %v", addr, got, want)
+		}
+	}
+
+	if _, err := ParseNets([]string{"192.0.2.0/33"}); err == nil {
+		t.Error("invalid CIDR: no error")
+	}
+	if _, err := LoadNets(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	v2 := func(command, family byte, addr []byte) string {
+		h := append([]byte{}, v2Signature...)
+		h = append(h, 0x20|command, family)
+		h = binary.BigEndian.AppendUint16(h, uint16(len(addr)))
+		return string(append(h, addr...))
+	}
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	binary.BigEndian.PutUint16(v6[32:], 56324)
+
+	tests := []struct {
+		header string
+		want   string // "" for none, "error" for an error
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{"PROXY TCP4 192.0.2.1\r\n", "error"},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "error"},
+		{"GET / HTTP/1.1\r\n", "error"},
+		{v2(1, 0x11, v4), "192.0.2.1:56324"},
+		{v2(1, 0x21, v6), "[2001:db8::1]:56324"},
+		{v2(0, 0x00, nil), ""},
+		{v2(1, 0x11, v4[:4]), "error"},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readHeader(r)
+		got := ""
+		switch {
+		case err != nil:
+			got = "error"
+		case addr != nil:
+			got = addr.String()
+		}
+		if got != test.want {
+			t.Errorf("%q: %s (%v), want %s", test.header, got, err, test.want)
+			continue
+		}
+		if err == nil {
+			// the request follows the header
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%q: read %q after the header", test.header, rest)
+			}
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := ParseNets([]string{"127.0.0.1"})
+	ln := Listen(inner, trusted)
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr = %s", got)
+	}
+	b, _ := io.ReadAll(c)
+	if string(b) != "hello" {
+		t.Errorf("read %q", b)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/replay"
+)
+
+// replayCommand implements "rt-mail replay". It returns the exit code.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	configfile := fs.String("config", "rt-mail.json", configUsage)
+	since := fs.String("since", "", "only replay messages received at or after this time (RFC 3339 or 2006-01-02)")
+	until := fs.String("until", "", "only replay messages received at or before this time (RFC 3339 or 2006-01-02)")
+	recipient := fs.String("recipient", "", "only replay messages to this address; for files, the recipient if the headers don't have one")
+	queue := fs.String("queue", "", "only replay messages for this queue")
+	failed := fs.Bool("failed", false, "only replay archived messages that failed to post and weren't resolved")
+	dryRun := fs.Bool("dry-run", false, "report what would be replayed without posting to RT")
+	overrideQueue := fs.String("override-queue", "", "post all messages to this queue")
+	overrideAction := fs.String("override-action", "correspond", "action (correspond or comment) used with -override-queue")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: rt-mail replay [flags] [file.eml|file.mbox ...]")
+		fmt.Fprintln(os.Stderr, "Replays the given files, or the archived messages if no files are given.")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	log := logger.Setup()
+	ctx := logger.NewContext(context.Background(), log)
+
+	opts := replay.Options{
+		Recipient:      *recipient,
+		Queue:          *queue,
+		Failed:         *failed,
+		DryRun:         *dryRun,
+		OverrideQueue:  *overrideQueue,
+		OverrideAction: *overrideAction,
+	}
+	var err error
+	if opts.Since, err = parseTime(*since, false); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -since:", err)
+		return 2
+	}
+	if opts.Until, err = parseTime(*until, true); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -until:", err)
+		return 2
+	}
+
+	cfg, err := config.Load(*configfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loading configuration file %q: %s\n", *configfile, err)
+		return 1
+	}
+
+	rtClient, filters, err := setupClient(ctx, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "setting up RT client:", err)
+		return 1
+	}
+
+	var results []*replay.Result
+	if fs.NArg() == 0 {
+		if cfg.Archive == nil {
+			fmt.Fprintln(os.Stderr, "no files given and no archive configured")
+			return 2
+		}
+		a, err := archive.New(ctx, filters, cfg.Archive)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "opening archive:", err)
+			return 1
+		}
+		results, err = replay.ReplayArchive(ctx, filters, rtClient, a, opts)
+		// mark what was replayed before any error, too
+		if rerr := replay.Resolve(ctx, a, results); rerr != nil {
+			fmt.Fprintln(os.Stderr, "updating archive:", rerr)
+		}
+		if err != nil {
+			_ = replay.Report(os.Stdout, results)
+			fmt.Fprintln(os.Stderr, "reading archive:", err)
+			return 1
+		}
+	} else {
+		var msgs []*replay.Message
+		for _, file := range fs.Args() {
+			m, err := replay.ReadFile(file, *recipient)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			msgs = append(msgs, m...)
+		}
+		results = replay.Replay(ctx, filters, rtClient, msgs, opts)
+	}
+
+	if err := replay.Report(os.Stdout, results); err != nil {
+		return 1
+	}
+	for _, r := range results {
+		if r.Outcome != archive.Delivered && r.Outcome != replay.Skipped && r.Outcome != replay.DryRun {
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseTime parses an RFC 3339 time or a date. With endOfDay a date
+// means the end of that day.
+func parseTime(s string, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
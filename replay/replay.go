@@ -0,0 +1,309 @@
+// Package replay re-posts archived messages, or messages from .eml and
+// mbox files, to RT.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+)
+
+// Message is a message to replay.
+type Message struct {
+	Source    string // archive ID, or file name and position
+	Time      time.Time
+	Recipient string
+	Raw       []byte
+
+	// Record is the archive record of the message, if it came from
+	// the archive.
+	Record *archive.Record
+}
+
+// Options select the messages to replay and how.
+type Options struct {
+	Since, Until time.Time
+	Recipient    string
+	Queue        string
+
+	// Failed only replays archived messages that failed to post (the
+	// dead letters) and haven't been retried or discarded.
+	Failed bool
+
+	// DryRun reports what would be done without posting anything.
+	DryRun bool
+
+	// OverrideQueue posts all messages to this queue with
+	// OverrideAction (default "correspond").
+	OverrideQueue  string
+	OverrideAction string
+}
+
+// Result is the outcome of replaying a message.
+type Result struct {
+	Message *Message
+	Queue   string
+	Action  string
+	Outcome string // an archive outcome, "skipped" or "dry-run"
+	Ticket  string
+	Error   string
+}
+
+// Outcomes for messages that weren't posted.
+const (
+	Skipped = "skipped"
+	DryRun  = "dry-run"
+)
+
+// ReplayArchive replays the archived messages received between
+// opts.Since and opts.Until to client and returns the outcome for each of
+// them, like Replay. The records are filtered before their messages are
+// read, and each message is only read from the archive when it's posted
+// and isn't kept after.
+func ReplayArchive(ctx context.Context, client rt.Client, router filter.Router, a *archive.Archive, opts Options) ([]*Result, error) {
+	var results []*Result
+	err := a.Each(ctx, opts.Since, opts.Until, func(rec *archive.Record) error {
+		m := &Message{
+			Source:    rec.ID,
+			Time:      rec.Time,
+			Recipient: rec.Recipient,
+			Record:    rec,
+		}
+		res := route(router, m)
+		results = append(results, res)
+		if reason := opts.skip(m, res.Queue); reason != "" {
+			res.Outcome, res.Error = Skipped, reason
+			return nil
+		}
+		if !opts.DryRun {
+			raw, err := a.Message(ctx, rec)
+			if err != nil {
+				return fmt.Errorf("message %s: %w", rec.ID, err)
+			}
+			m.Raw = raw
+		}
+		post(ctx, client, res, opts)
+		m.Raw = nil
+		return nil
+	})
+	return results, err
+}
+
+// ReadFile reads the messages in an .eml or mbox file. The recipient of
+// each message is recipient if set, and otherwise taken from its
+// Delivered-To, X-Original-To or To header.
+func ReadFile(file, recipient string) ([]*Message, error) {
+	data, err := os.ReadFile(file) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	var raws [][]byte
+	if bytes.HasPrefix(data, []byte("From ")) {
+		raws = splitMbox(data)
+	} else {
+		raws = [][]byte{data}
+	}
+
+	var msgs []*Message
+	for i, raw := range raws {
+		m := &Message{
+			Source:    filepath.Base(file),
+			Recipient: recipient,
+			Raw:       raw,
+		}
+		if len(raws) > 1 {
+			m.Source = fmt.Sprintf("%s#%d", m.Source, i+1)
+		}
+		if hdr, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+			m.Time, _ = hdr.Header.Date()
+			if m.Recipient == "" {
+				m.Recipient = headerRecipient(hdr.Header)
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// splitMbox splits an mboxrd file into messages, removing the "From "
+// separator lines and unquoting ">From " lines.
+func splitMbox(data []byte) [][]byte {
+	var msgs [][]byte
+	var cur *bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), len(data)+1)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if cur != nil {
+				msgs = append(msgs, cur.Bytes())
+			}
+			cur = &bytes.Buffer{}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+			line = line[1:]
+		}
+		cur.Write(line)
+		cur.WriteByte('\n')
+	}
+	if cur != nil {
+		msgs = append(msgs, cur.Bytes())
+	}
+	// the line before each separator is a blank line belonging to the mbox
+	for i, m := range msgs {
+		msgs[i] = bytes.TrimSuffix(m, []byte("\n\n"))
+		if len(msgs[i]) < len(m) {
+			msgs[i] = append(msgs[i], '\n')
+		}
+	}
+	return msgs
+}
+
+func headerRecipient(h mail.Header) string {
+	for _, name := range []string{"Delivered-To", "X-Original-To", "To"} {
+		if addrs, err := h.AddressList(name); err == nil && len(addrs) > 0 {
+			return addrs[0].Address
+		}
+	}
+	return ""
+}
+
+// Replay posts the selected messages to client and returns the outcome
+// for each of them. router is used to find the queue of messages.
+func Replay(ctx context.Context, client rt.Client, router filter.Router, msgs []*Message, opts Options) []*Result {
+	var results []*Result
+	for _, m := range msgs {
+		res := route(router, m)
+		results = append(results, res)
+		if reason := opts.skip(m, res.Queue); reason != "" {
+			res.Outcome, res.Error = Skipped, reason
+			continue
+		}
+		post(ctx, client, res, opts)
+	}
+	return results
+}
+
+// route returns the result for m with the queue and action it was, or
+// would be, posted with.
+func route(router filter.Router, m *Message) *Result {
+	res := &Result{Message: m}
+	res.Queue, res.Action = router.Route(m.Recipient)
+	if m.Record != nil && m.Record.Queue != "" {
+		res.Queue, res.Action = m.Record.Queue, m.Record.Action
+	}
+	return res
+}
+
+// post posts the message of res to client and records the outcome.
+func post(ctx context.Context, client rt.Client, res *Result, opts Options) {
+	m := res.Message
+	if opts.OverrideQueue != "" {
+		res.Queue, res.Action = opts.OverrideQueue, opts.OverrideAction
+		if res.Action == "" {
+			res.Action = "correspond"
+		}
+		ctx = rt.WithRoute(ctx, res.Queue, res.Action)
+	}
+
+	if opts.DryRun {
+		res.Outcome = DryRun
+		return
+	}
+
+	env := &rt.Envelope{Provider: "replay"}
+	if m.Record != nil {
+		env.Provider, env.From = m.Record.Provider, m.Record.From
+	}
+	ctx = rt.NewContext(ctx, env)
+
+	receipt := &rt.Receipt{}
+	err := client.Postmail(rt.WithReceipt(ctx, receipt), m.Recipient, string(m.Raw))
+	res.Outcome = archive.Outcome(err)
+	res.Ticket = receipt.Ticket
+	if receipt.Queue != "" {
+		res.Queue, res.Action = receipt.Queue, receipt.Action
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+}
+
+// Resolve marks the archived dead letters delivered by a replay as
+// retried, so they aren't replayed again.
+func Resolve(ctx context.Context, a *archive.Archive, results []*Result) error {
+	for _, r := range results {
+		rec := r.Message.Record
+		if rec == nil || r.Outcome != archive.Delivered || !rec.DeadLetter() {
+			continue
+		}
+		rec.Resolution = archive.Retried
+		rec.Ticket = r.Ticket
+		if err := a.Update(ctx, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip returns why the message isn't replayed, or "" if it is.
+func (opts Options) skip(m *Message, queue string) string {
+	switch {
+	case m.Recipient == "":
+		return "no recipient"
+	case !opts.Since.IsZero() && !m.Time.IsZero() && m.Time.Before(opts.Since):
+		return "before since"
+	case !opts.Until.IsZero() && !m.Time.IsZero() && m.Time.After(opts.Until):
+		return "after until"
+	case opts.Recipient != "" && !strings.EqualFold(opts.Recipient, m.Recipient):
+		return "recipient doesn't match"
+	case opts.Queue != "" && opts.Queue != queue:
+		return "queue doesn't match"
+	case opts.Failed && m.Record != nil && !m.Record.DeadLetter():
+		return "not a dead letter"
+	}
+	return ""
+}
+
+// Report writes a table of the results and a summary of the outcomes.
+func Report(w io.Writer, results []*Result) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tRECIPIENT\tQUEUE\tACTION\tOUTCOME\tTICKET\tERROR")
+	counts := map[string]int{}
+	var order []string
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Message.Source, r.Message.Recipient, r.Queue, r.Action, r.Outcome, r.Ticket, r.Error)
+		if counts[r.Outcome] == 0 {
+			order = append(order, r.Outcome)
+		}
+		counts[r.Outcome]++
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	var summary []string
+	for _, o := range order {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[o], o))
+	}
+	_, err := fmt.Fprintf(w, "\n%d messages: %s\n", len(results), strings.Join(summary, ", "))
+	return err
+}
@@ -0,0 +1,173 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/archive"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+type staticRouter map[string]string
+
+func (r staticRouter) Route(recipient string) (string, string) {
+	return r[recipient], "correspond"
+}
+
+// recordingClient records the messages posted and the queue they were
+// routed to.
+type recordingClient struct {
+	posted []string
+	err    error
+}
+
+func (c *recordingClient) Postmail(ctx context.Context, recipient, message string) error {
+	queue, _, ok := rt.RouteFromContext(ctx)
+	if !ok {
+		queue = "mapped"
+	}
+	c.posted = append(c.posted, recipient+" "+queue+" "+rt.EnvelopeFromContext(ctx).Provider)
+	if r := rt.ReceiptFromContext(ctx); r != nil && c.err == nil {
+		r.Ticket = "7"
+	}
+	return c.err
+}
+
+const mbox = "From alice@example.com Mon Oct 19 10:00:00 2026\n" +
+	"From: alice@example.com\n" +
+	"To: help@example.com\n" +
+	"Date: Mon, 19 Oct 2026 10:00:00 +0000\n" +
+	"Subject: one\n" +
+	"\n" +
+	">From the start\n" +
+	">>From quoted\n" +
+	"\n" +
+	"From bob@example.com Mon Oct 19 11:00:00 2026\n" +
+	"From: bob@example.com\n" +
+	"Delivered-To: sales@example.com\n" +
+	"To: help@example.com\n" +
+	"Date: Mon, 19 Oct 2026 11:00:00 +0000\n" +
+	"Subject: two\n" +
+	"\n" +
+	"hi\n"
+
+func TestReadFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "inbox.mbox")
+	testutil.AssertNoError(t, os.WriteFile(file, []byte(mbox), 0o600))
+
+	msgs, err := ReadFile(file, "")
+	testutil.AssertNoError(t, err)
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	if msgs[0].Recipient != "help@example.com" || msgs[1].Recipient != "sales@example.com" {
+		t.Errorf("recipients %q, %q", msgs[0].Recipient, msgs[1].Recipient)
+	}
+	if !strings.HasSuffix(string(msgs[0].Raw), "\n\nFrom the start\n>From quoted\n") {
+		t.Errorf("first message = %q", msgs[0].Raw)
+	}
+	if msgs[0].Source != "inbox.mbox#1" || !msgs[1].Time.Equal(time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("second message %s at %s", msgs[1].Source, msgs[1].Time)
+	}
+
+	eml := filepath.Join(t.TempDir(), "message.eml")
+	testutil.AssertNoError(t, os.WriteFile(eml, []byte("To: help@example.com\n\nhello\n"), 0o600))
+	msgs, err = ReadFile(eml, "ops@example.com")
+	testutil.AssertNoError(t, err)
+	if len(msgs) != 1 || msgs[0].Recipient != "ops@example.com" || msgs[0].Source != "message.eml" {
+		t.Errorf("eml messages = %+v", msgs)
+	}
+}
+
+func TestReplayArchive(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	a, err := archive.New(ctx, &recordingClient{}, &config.Archive{Storage: config.Storage{Dir: dir}})
+	testutil.AssertNoError(t, err)
+
+	day := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	var records []*archive.Record
+	for i, rec := range []*archive.Record{
+		{Recipient: "help@example.com", Queue: "help", Action: "correspond", Outcome: archive.Failed, Provider: "ses"},
+		{Recipient: "help@example.com", Queue: "help", Action: "correspond", Outcome: archive.Rejected},
+		{Recipient: "help@example.com", Queue: "help", Action: "correspond", Outcome: archive.Delivered},
+		{Recipient: "sales@example.com", Queue: "sales", Action: "comment", Outcome: archive.Failed},
+		{Recipient: "help@example.com", Queue: "help", Action: "correspond", Outcome: archive.Failed},
+	} {
+		rec.Time = day.Add(time.Duration(i) * time.Hour)
+		testutil.AssertNoError(t, a.Save(ctx, rec, []byte("Subject: test\r\n\r\nbody")))
+		records = append(records, rec)
+	}
+	// the messages that are skipped aren't read
+	for _, rec := range records[1:] {
+		testutil.AssertNoError(t, os.Remove(filepath.Join(dir, rec.Message)))
+	}
+
+	client := &recordingClient{}
+	router := staticRouter{}
+	results, err := ReplayArchive(ctx, client, router, a, Options{Until: day.Add(210 * time.Minute), Failed: true, Queue: "help"})
+	testutil.AssertNoError(t, err)
+
+	outcomes := []string{}
+	for _, r := range results {
+		outcomes = append(outcomes, r.Outcome)
+	}
+	if strings.Join(outcomes, ",") != "delivered,skipped,skipped,skipped" {
+		t.Errorf("outcomes = %v", outcomes)
+	}
+	if len(client.posted) != 1 || client.posted[0] != "help@example.com mapped ses" {
+		t.Errorf("posted %v", client.posted)
+	}
+	if results[0].Ticket != "7" || results[0].Queue != "help" {
+		t.Errorf("result = %+v", results[0])
+	}
+	if results[1].Error != "not a dead letter" {
+		t.Errorf("rejected message result = %+v", results[1])
+	}
+
+	var buf bytes.Buffer
+	testutil.AssertNoError(t, Report(&buf, results))
+	if !strings.Contains(buf.String(), "4 messages: 1 delivered, 3 skipped") {
+		t.Errorf("report:\n%s", buf.String())
+	}
+}
+
+func TestReplayOptions(t *testing.T) {
+	ctx := context.Background()
+	msgs := []*Message{
+		{Source: "a", Recipient: "help@example.com", Raw: []byte("x")},
+		{Source: "b", Recipient: "sales@example.com", Raw: []byte("x")},
+		{Source: "c", Raw: []byte("x")},
+	}
+	router := staticRouter{"help@example.com": "help", "sales@example.com": "sales"}
+
+	client := &recordingClient{}
+	results := Replay(ctx, client, router, msgs, Options{DryRun: true, OverrideQueue: "triage"})
+	if len(client.posted) != 0 {
+		t.Errorf("dry run posted %v", client.posted)
+	}
+	if results[0].Outcome != DryRun || results[0].Queue != "triage" || results[2].Outcome != Skipped {
+		t.Errorf("dry run results %+v %+v", results[0], results[2])
+	}
+
+	results = Replay(ctx, client, router, msgs, Options{Recipient: "SALES@example.com", OverrideQueue: "triage", OverrideAction: "comment"})
+	if len(client.posted) != 1 || client.posted[0] != "sales@example.com triage replay" {
+		t.Errorf("posted %v", client.posted)
+	}
+	if results[1].Outcome != archive.Delivered || results[1].Action != "comment" {
+		t.Errorf("result %+v", results[1])
+	}
+
+	client.err = rt.Rejectf("blocked")
+	results = Replay(ctx, client, router, msgs[:1], Options{})
+	if results[0].Outcome != archive.Rejected || results[0].Error == "" {
+		t.Errorf("rejected result %+v", results[0])
+	}
+}
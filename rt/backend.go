@@ -0,0 +1,317 @@
+package rt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+)
+
+// posts counts the messages posted to each backend, keyed by
+// "backend:result" with result "ok" or "error".
+var posts = expvar.NewMap("rt_posts")
+
+// backend is an RT instance messages are posted to.
+type backend struct {
+	name    string
+	url     string
+	auth    *config.RTAuth
+	queues  AddressQueue
+	hclient *http.Client
+	retry   retry
+	breaker *breaker
+	replies *replies // nil if replies aren't looked for
+}
+
+func newBackend(name string, cfg *config.Backend) (*backend, error) {
+	switch cfg.Type {
+	case "", "mail-gateway":
+	default:
+		return nil, fmt.Errorf("backend %q: unknown type %q", name, cfg.Type)
+	}
+
+	if a := cfg.Auth; a != nil {
+		switch {
+		case a.Token != "" && (a.User != "" || a.Password != ""):
+			return nil, fmt.Errorf("backend %q: auth has both a token and a user and password", name)
+		case a.Header != "" && a.Value == "", a.Header == "" && a.Value != "":
+			return nil, fmt.Errorf("backend %q: auth needs both header and value", name)
+		}
+	}
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %w", name, err)
+	}
+	replies, err := newReplies(cfg.Replies)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %w", name, err)
+	}
+
+	netTransport := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout: cfg.ConnectTimeout.Or(5 * time.Second),
+		}).Dial,
+		TLSHandshakeTimeout: 5 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+	hclient := &http.Client{
+		Timeout:   cfg.Timeout.Or(10 * time.Second),
+		Transport: netTransport,
+	}
+	return &backend{
+		name:    name,
+		url:     cfg.URL,
+		auth:    cfg.Auth,
+		queues:  cfg.Queues,
+		hclient: hclient,
+		retry:   newRetry(cfg.Retry),
+		breaker: newBreaker(cfg.Breaker),
+		replies: replies,
+	}, nil
+}
+
+// newTLSConfig returns the TLS client configuration, or nil for the
+// defaults.
+func newTLSConfig(cfg *config.TLS) (*tls.Config, error) {
+	if cfg == nil || (cfg.CA == "" && cfg.Cert == "" && cfg.Key == "") {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CA != "" {
+		pem, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s has no certificates", cfg.CA)
+		}
+	}
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// authenticate adds the backend's credentials to the request.
+func (b *backend) authenticate(req *http.Request) {
+	a := b.auth
+	if a == nil {
+		return
+	}
+	switch {
+	case a.Token != "":
+		req.Header.Set("Authorization", "token "+string(a.Token))
+	case a.User != "" || a.Password != "":
+		req.SetBasicAuth(a.User, string(a.Password))
+	}
+	if a.Header != "" {
+		req.Header.Set(a.Header, string(a.Value))
+	}
+}
+
+// BackendStatus is the health of a backend, as seen from its circuit
+// breaker.
+type BackendStatus struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Breaker string `json:"breaker"` // BreakerClosed, BreakerOpen, ...
+
+	// Failures is the number of consecutive failed posts.
+	Failures int `json:"failures"`
+	// RetryAt is when an open breaker lets a post through again.
+	RetryAt time.Time `json:"retry-at,omitzero"`
+}
+
+// Status returns the status of the backends, the default one first.
+func (rt *RT) Status() []BackendStatus {
+	status := make([]BackendStatus, 0, len(rt.backends))
+	for _, b := range rt.backends {
+		state, failures, until := b.breaker.status()
+		status = append(status, BackendStatus{
+			Name:     b.name,
+			URL:      b.url,
+			Breaker:  state,
+			Failures: failures,
+			RetryAt:  until,
+		})
+	}
+	return status
+}
+
+// Ping checks that the named backend can be reached, with a HEAD
+// request to the root of its URL's host. Any answer but a proxy's 502,
+// 503 or 504 will do. It's an error if the backend's circuit breaker is
+// open.
+func (rt *RT) Ping(ctx context.Context, name string) error {
+	b, ok := rt.byName[name]
+	if !ok {
+		return fmt.Errorf("no backend %q", name)
+	}
+	if state, _, _ := b.breaker.status(); state == BreakerOpen {
+		return fmt.Errorf("circuit breaker open")
+	}
+	u, err := url.Parse(b.url)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid url %q", b.url)
+	}
+	root := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, root.String(), nil)
+	if err != nil {
+		return err
+	}
+	b.authenticate(req)
+	resp, err := b.hclient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// rule is a route sending recipients to a backend.
+type rule struct {
+	domains   []string
+	addresses AddressQueue // the addresses, for matching with MatchQueue
+	backend   *backend
+	queue     string
+}
+
+func newRule(cfg *config.Route, backends map[string]*backend) (*rule, error) {
+	b, ok := backends[cfg.Backend]
+	if !ok {
+		return nil, fmt.Errorf("route to unknown backend %q", cfg.Backend)
+	}
+	if len(cfg.Domains) == 0 && len(cfg.Addresses) == 0 {
+		return nil, fmt.Errorf("route to backend %q has no domains or addresses", cfg.Backend)
+	}
+	r := &rule{backend: b, queue: cfg.Queue, addresses: AddressQueue{}}
+	for _, d := range cfg.Domains {
+		r.domains = append(r.domains, strings.ToLower(strings.TrimPrefix(d, "@")))
+	}
+	for _, a := range cfg.Addresses {
+		r.addresses[strings.ToLower(a)] = cfg.Backend
+	}
+	return r, nil
+}
+
+// match reports whether the recipient matches the rule, and how.
+func (r *rule) match(recipient string) (Match, bool) {
+	if m := MatchQueue(r.addresses, recipient); m.Queue != "" {
+		return m, true
+	}
+	_, domain, ok := strings.Cut(strings.ToLower(recipient), "@")
+	if !ok {
+		return Match{}, false
+	}
+	for _, d := range r.domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			action := "correspond"
+			if local, _, _ := strings.Cut(recipient, "@"); strings.HasSuffix(strings.ToLower(local), "-comment") {
+				action = "comment"
+			}
+			return Match{Action: action, Target: "@" + d, Rule: "domain"}, true
+		}
+	}
+	return Match{}, false
+}
+
+// setupBackends creates the default backend (from rt-url and queues)
+// and the configured ones, and the routing rules.
+func (rt *RT) setupBackends(cfg *config.Config) error {
+	rt.byName = map[string]*backend{}
+	if cfg.RTUrl != "" || len(cfg.Queues) > 0 || len(cfg.Backends) == 0 {
+		if _, ok := cfg.Backends[config.DefaultBackend]; ok {
+			return fmt.Errorf("backend %q is configured with rt-url and queues", config.DefaultBackend)
+		}
+		b, err := newBackend(config.DefaultBackend, &config.Backend{
+			URL:     cfg.RTUrl,
+			Auth:    cfg.RTAuth,
+			TLS:     cfg.RTTLS,
+			Retry:   cfg.RTRetry,
+			Breaker: cfg.RTBreaker,
+			Replies: cfg.RTReplies,
+			Queues:  cfg.Queues,
+		})
+		if err != nil {
+			return err
+		}
+		rt.backends = append(rt.backends, b)
+		rt.byName[b.name] = b
+	}
+
+	names := make([]string, 0, len(cfg.Backends))
+	for name := range cfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := newBackend(name, cfg.Backends[name])
+		if err != nil {
+			return err
+		}
+		rt.backends = append(rt.backends, b)
+		rt.byName[name] = b
+	}
+
+	for _, rc := range cfg.Routes {
+		r, err := newRule(rc, rt.byName)
+		if err != nil {
+			return err
+		}
+		rt.rules = append(rt.rules, r)
+	}
+	return nil
+}
+
+// resolve returns the backend and queue for the recipient: from the
+// first matching route, or else from the queues of the first backend
+// (the default one, then by name) that has the address. If nothing
+// matches, the queue is empty and the backend is the default one, if
+// there is one.
+func (rt *RT) resolve(recipient string) (*backend, Match) {
+	for _, r := range rt.rules {
+		m, ok := r.match(recipient)
+		if !ok {
+			continue
+		}
+		if r.queue != "" {
+			m.Queue = r.queue
+			m.Rule = "route " + m.Rule
+		} else {
+			m = MatchQueue(r.backend.queues, recipient)
+		}
+		m.Backend = r.backend.name
+		return r.backend, m
+	}
+	for _, b := range rt.backends {
+		if m := MatchQueue(b.queues, recipient); m.Queue != "" {
+			m.Backend = b.name
+			return b, m
+		}
+	}
+	b := rt.byName[config.DefaultBackend]
+	m := Match{Action: "correspond"}
+	if b != nil {
+		m.Backend = b.name
+	}
+	return b, m
+}
@@ -0,0 +1,131 @@
+package rt
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+	BreakerDisabled = "disabled"
+)
+
+// breaker fails posts to a backend right away after consecutive
+// failures, until the cooldown has passed. Then one post is let through
+// (half-open): if it succeeds the breaker closes, otherwise it opens
+// again.
+type breaker struct {
+	threshold int // failures opening the breaker; 0 disables it
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int // consecutive
+	until    time.Time
+}
+
+func newBreaker(cfg *config.Breaker) *breaker {
+	b := &breaker{threshold: 5, cooldown: 30 * time.Second, now: time.Now, state: BreakerClosed}
+	if cfg != nil {
+		switch {
+		case cfg.Failures < 0:
+			b.threshold = 0
+			b.state = BreakerDisabled
+		case cfg.Failures > 0:
+			b.threshold = cfg.Failures
+		}
+		b.cooldown = cfg.Cooldown.Or(b.cooldown)
+	}
+	return b
+}
+
+// allow reports whether a post may be attempted.
+func (b *breaker) allow() bool {
+	if b.threshold == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Before(b.until) {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		// a post is already checking whether RT is back
+		return false
+	}
+	return true
+}
+
+// record records the result of a post allowed by allow: ok is false
+// if RT couldn't be reached or had a temporary failure.
+func (b *breaker) record(ok bool) {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.until = b.now().Add(b.cooldown)
+	}
+}
+
+// status returns the breaker's state, its consecutive failures and,
+// when open, when it lets a post through again.
+func (b *breaker) status() (state string, failures int, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		until = b.until
+	}
+	return b.state, b.failures, until
+}
+
+// retry is how failed posts are retried.
+type retry struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newRetry(cfg *config.Retry) retry {
+	r := retry{attempts: 3, backoff: 200 * time.Millisecond, maxBackoff: 2 * time.Second}
+	if cfg != nil {
+		if cfg.Attempts > 0 {
+			r.attempts = cfg.Attempts
+		}
+		r.backoff = cfg.Backoff.Or(r.backoff)
+		r.maxBackoff = cfg.MaxBackoff.Or(r.maxBackoff)
+	}
+	return r
+}
+
+// wait returns the time to wait before the retry following attempt
+// (counting from 1): the backoff doubled for each earlier retry, capped,
+// and jittered between half and all of that so posts failing together
+// don't retry together.
+func (r retry) wait(attempt int) time.Duration {
+	d := r.backoff
+	for i := 1; i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, r.maxBackoff)
+	return d/2 + rand.N(d/2+1) //nolint:gosec
+}
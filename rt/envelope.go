@@ -0,0 +1,101 @@
+package rt
+
+import "context"
+
+// Envelope holds what the email provider told us about a message's
+// delivery, beyond the raw MIME content.
+type Envelope struct {
+	Provider string // name of the provider that delivered the message
+	From     string // envelope sender (MAIL FROM)
+	RemoteIP string // IP address of the sending MTA, if known
+
+	// SpamScore is the provider's spam score, if it supplied one.
+	SpamScore *float64
+	// SpamVerdict is the provider's spam classification: "spam", "ham"
+	// or empty if unknown.
+	SpamVerdict string
+	// VirusVerdict is the provider's virus scan result: "infected",
+	// "clean" or empty if unknown.
+	VirusVerdict string
+
+	// SPF, DKIM and DMARC results ("pass", "fail", ...) as reported by
+	// the provider, or as evaluated by rt-mail once verification ran.
+	SPF   string
+	DKIM  string
+	DMARC string
+}
+
+type envelopeKey struct{}
+
+// NewContext returns a context carrying the message envelope.
+func NewContext(ctx context.Context, env *Envelope) context.Context {
+	return context.WithValue(ctx, envelopeKey{}, env)
+}
+
+// EnvelopeFromContext returns the envelope stored in ctx, or an empty
+// envelope if there isn't one.
+func EnvelopeFromContext(ctx context.Context) *Envelope {
+	if env, ok := ctx.Value(envelopeKey{}).(*Envelope); ok && env != nil {
+		return env
+	}
+	return &Envelope{}
+}
+
+type route struct {
+	queue  string
+	action string
+}
+
+type routeKey struct{}
+
+// WithRoute returns a context that makes Postmail deliver to queue with
+// action ("correspond" or "comment") instead of the queue mapped to the
+// recipient address.
+func WithRoute(ctx context.Context, queue, action string) context.Context {
+	if action == "" {
+		action = "correspond"
+	}
+	return context.WithValue(ctx, routeKey{}, route{queue: queue, action: action})
+}
+
+// RouteFromContext returns the queue and action set with WithRoute.
+func RouteFromContext(ctx context.Context) (queue, action string, ok bool) {
+	r, ok := ctx.Value(routeKey{}).(route)
+	return r.queue, r.action, ok
+}
+
+// Receipt records where Postmail delivered a message.
+type Receipt struct {
+	Backend string
+	Queue   string
+	Action  string
+	Ticket  string // ticket ID reported by RT, if any
+}
+
+type receiptKey struct{}
+
+// WithReceipt returns a context in which Postmail records the backend,
+// queue, action and ticket of the delivery in r.
+func WithReceipt(ctx context.Context, r *Receipt) context.Context {
+	return context.WithValue(ctx, receiptKey{}, r)
+}
+
+// ReceiptFromContext returns the receipt set with WithReceipt, or nil.
+func ReceiptFromContext(ctx context.Context) *Receipt {
+	r, _ := ctx.Value(receiptKey{}).(*Receipt)
+	return r
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the ID of the HTTP request
+// that delivered the message.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,126 @@
+package rt
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+)
+
+// busy counts the posts refused at a concurrency limit, keyed by
+// "global" or the queue.
+var busy = expvar.NewMap("rt_busy")
+
+// limiter bounds the posts in progress, over all queues and per queue.
+type limiter struct {
+	global     chan struct{} // nil if unlimited
+	wait       time.Duration
+	retryAfter time.Duration
+
+	defaultMax int // the "*" limit, 0 if unlimited
+
+	mu     sync.Mutex
+	queues map[string]chan struct{}
+}
+
+func newLimiter(cfg *config.Concurrency) (*limiter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	l := &limiter{
+		wait:       cfg.Wait.Or(2 * time.Second),
+		retryAfter: cfg.RetryAfter.Or(30 * time.Second),
+		queues:     map[string]chan struct{}{},
+	}
+	if cfg.Max < 0 {
+		return nil, fmt.Errorf("concurrency: max must not be negative")
+	}
+	if cfg.Max > 0 {
+		l.global = make(chan struct{}, cfg.Max)
+	}
+	for queue, n := range cfg.Queues {
+		switch {
+		case n < 0:
+			return nil, fmt.Errorf("concurrency: limit for queue %q must not be negative", queue)
+		case n == 0:
+		case queue == "*":
+			l.defaultMax = n
+		default:
+			l.queues[queue] = make(chan struct{}, n)
+		}
+	}
+	return l, nil
+}
+
+// queue returns the semaphore of the queue, or nil if it's unlimited.
+func (l *limiter) queue(name string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.queues[name]
+	if !ok && l.defaultMax > 0 {
+		sem = make(chan struct{}, l.defaultMax)
+		l.queues[name] = sem
+	}
+	return sem
+}
+
+// acquire waits for a slot for posting to the queue, first the queue's
+// and then the global one. It returns the function releasing them, or
+// an error if no slot freed up in time.
+func (l *limiter) acquire(ctx context.Context, queue string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	var held []chan struct{}
+	release = func() {
+		for _, sem := range held {
+			<-sem
+		}
+	}
+	for _, s := range []struct {
+		name string
+		sem  chan struct{}
+	}{{queue, l.queue(queue)}, {"global", l.global}} {
+		if s.sem == nil {
+			continue
+		}
+		select {
+		case s.sem <- struct{}{}:
+			held = append(held, s.sem)
+		case <-timer.C:
+			release()
+			busy.Add(s.name, 1)
+			return nil, &Error{
+				Busy:       true,
+				RetryAfter: l.retryAfter,
+				msg:        fmt.Sprintf("too many messages being posted to RT (%s limit)", s.name),
+			}
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// RetryAfter sets the Retry-After header if err is from posting being
+// at a concurrency limit, and reports whether it was. Providers answer
+// such errors with 429 (or 503) so the provider backs off.
+func RetryAfter(w http.ResponseWriter, err error) bool {
+	var rtErr *Error
+	if !errors.As(err, &rtErr) || !rtErr.Busy {
+		return false
+	}
+	seconds := int((rtErr.RetryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	return true
+}
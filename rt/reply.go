@@ -0,0 +1,137 @@
+package rt
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"go.askask.com/rt-mail/config"
+)
+
+// replies finds the ticket a message replies to.
+type replies struct {
+	subjectTag *regexp.Regexp
+	messageID  *regexp.Regexp // nil without an organization
+	queue      string
+}
+
+func newReplies(cfg *config.Replies) (*replies, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	r := &replies{queue: cfg.Queue}
+	if r.queue == "" {
+		r.queue = "General"
+	}
+
+	tag := cfg.SubjectTag
+	switch {
+	case tag != "":
+	case cfg.RTName != "":
+		tag = `\[` + regexp.QuoteMeta(cfg.RTName) + ` #(\d+)\]`
+	default:
+		return nil, fmt.Errorf("replies: rt-name or subject-tag is required")
+	}
+	var err error
+	if r.subjectTag, err = regexp.Compile(`(?i)` + tag); err != nil {
+		return nil, fmt.Errorf("replies: subject-tag: %w", err)
+	}
+	if r.subjectTag.NumSubexp() < 1 {
+		return nil, fmt.Errorf("replies: subject-tag has no group for the ticket number")
+	}
+
+	// RT's Message-IDs are
+	// <rt-$VERSION-$PID-$TIME-$RAND.$TICKET-$SCRIP-$SENT@$Organization>
+	if cfg.Organization != "" {
+		r.messageID = regexp.MustCompile(`(?i)<rt-[^<>@]+?-\d+-\d+-\d+\.(\d+)-\d+-\d+@` +
+			regexp.QuoteMeta(cfg.Organization) + `>`)
+	}
+	return r, nil
+}
+
+// ticket returns the number of the ticket the message replies to, or
+// "" if it doesn't look like a reply to one: the ticket in the subject
+// tag, or else the one in the most recent RT Message-ID it refers to.
+func (r *replies) ticket(message string) string {
+	if r == nil {
+		return ""
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(message))
+	if err != nil {
+		return ""
+	}
+
+	subject := msg.Header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	if m := r.subjectTag.FindStringSubmatch(subject); m != nil {
+		if ticket := ticketNumber(m[1]); ticket != "" {
+			return ticket
+		}
+	}
+
+	if r.messageID == nil {
+		return ""
+	}
+	if m := r.messageID.FindStringSubmatch(msg.Header.Get("In-Reply-To")); m != nil {
+		return ticketNumber(m[1])
+	}
+	// References lists the thread oldest first
+	if m := r.messageID.FindAllStringSubmatch(msg.Header.Get("References"), -1); m != nil {
+		return ticketNumber(m[len(m)-1][1])
+	}
+	return ""
+}
+
+// ticketNumber returns n without leading zeros, or "" if it isn't a
+// ticket number ("0").
+func ticketNumber(n string) string {
+	return strings.TrimLeft(n, "0")
+}
+
+// reply returns the backend and ticket the message replies to, trying
+// the backends configured to find replies in order.
+func (rt *RT) reply(message string) (*backend, string) {
+	for _, b := range rt.backends {
+		if ticket := b.replies.ticket(message); ticket != "" {
+			return b, ticket
+		}
+	}
+	return nil, ""
+}
+
+// route returns the backend, queue, action and ticket for a message to
+// recipient: the queue the recipient maps to, or for a reply to an
+// address without a queue, the replies queue of the ticket's backend.
+func (rt *RT) route(recipient, message string) (*backend, string, string, string) {
+	b, m := rt.resolve(recipient)
+	if m.Queue != "" {
+		if b == nil {
+			return nil, m.Queue, m.Action, ""
+		}
+		return b, m.Queue, m.Action, b.replies.ticket(message)
+	}
+	rb, ticket := rt.reply(message)
+	if ticket == "" {
+		return b, "", m.Action, ""
+	}
+	action := "correspond"
+	if local, _, _ := strings.Cut(strings.ToLower(recipient), "@"); strings.HasSuffix(local, "-comment") {
+		action = "comment"
+	}
+	return rb, rb.replies.queue, action, ticket
+}
+
+// ReplyRoute returns the queue and action a reply to recipient, an
+// address without a queue, is posted with, or "" if the message isn't a
+// reply to a ticket or recipient has a queue.
+func (rt *RT) ReplyRoute(recipient, message string) (queue, action string) {
+	if _, m := rt.resolve(recipient); m.Queue != "" {
+		return "", ""
+	}
+	_, queue, action, _ = rt.route(recipient, message)
+	return queue, action
+}
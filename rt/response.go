@@ -0,0 +1,212 @@
+package rt
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Result classifies how RT handled a message.
+type Result int
+
+const (
+	// Success means RT accepted the message.
+	Success Result = iota
+	// Permanent means RT refused the message, and posting it again
+	// won't help; for example the sender may not create tickets.
+	Permanent
+	// Temporary means posting the message failed but may succeed
+	// later, like when RT is down or overloaded.
+	Temporary
+	// AuthFailure means RT (or a proxy in front of it) refused
+	// rt-mail's credentials.
+	AuthFailure
+)
+
+func (r Result) String() string {
+	switch r {
+	case Success:
+		return "success"
+	case Permanent:
+		return "permanent"
+	case Temporary:
+		return "temporary"
+	case AuthFailure:
+		return "auth"
+	}
+	return "result(" + strconv.Itoa(int(r)) + ")"
+}
+
+// Response is a parsed RT mail gateway (or REST 1.0) response.
+type Response struct {
+	Result Result
+	Status int    // HTTP status, or the REST status line's if there is one
+	Ticket string // ticket the message was added to, if RT said
+	Detail string // RT's explanation of a failure
+}
+
+var (
+	// "RT/4.4.4 200 Ok", the status line of REST 1.0 responses
+	restStatus = regexp.MustCompile(`^RT/\S+ (\d{3})\b\s*(.*)$`)
+	// "# Ticket 123 created." and "Ticket: 123"
+	ticketLine = regexp.MustCompile(`^(?:# Ticket (\d+) (?:created|updated)|Ticket: *(\d+))`)
+)
+
+// authFailures are what RT says when it doesn't accept the credentials.
+var authFailures = []string{
+	"credentials required",
+	"your username or password is incorrect",
+	"not authorized",
+}
+
+// ParseResponse classifies RT's response to posting a message, given
+// its HTTP status and body.
+//
+// The mail gateway answers "ok" on the first line, followed by details
+// like "Ticket: 123", or reports an error on one line as
+// "not ok - <error>" or "temporary failure - <error>"; REST 1.0
+// prefixes a status line like "RT/4.4.4 200 Ok" and reports
+// "# Ticket 123 created.". "not ok" is a permanent failure (the sender
+// may not create tickets, say). Temporary failures, authentication
+// failures, server errors and responses that aren't RT's (an error page
+// from a proxy) can be retried.
+func ParseResponse(status int, body string) Response {
+	resp := Response{Status: status}
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+
+	// skip leading blank lines and the REST status line
+	rest := false
+	i := 0
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	if i < len(lines) {
+		if m := restStatus.FindStringSubmatch(strings.TrimSpace(lines[i])); m != nil {
+			resp.Status, _ = strconv.Atoi(m[1])
+			resp.Detail = m[2]
+			rest = true
+			i++
+			for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+				i++
+			}
+		}
+	}
+	lines = lines[i:]
+
+	first := ""
+	if len(lines) > 0 {
+		first = strings.TrimSpace(lines[0])
+	}
+	lower := strings.ToLower(first)
+
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden,
+		resp.Status == http.StatusUnauthorized || resp.Status == http.StatusForbidden:
+		resp.Result = AuthFailure
+		if resp.Detail == "" {
+			resp.Detail = http.StatusText(resp.Status)
+		}
+		return resp
+	case status == http.StatusRequestEntityTooLarge:
+		resp.Result = Permanent
+		resp.Detail = http.StatusText(status)
+		return resp
+	case status > 299 || resp.Status > 299:
+		resp.Result = Temporary
+		if resp.Detail == "" {
+			resp.Detail = http.StatusText(resp.Status)
+		}
+		return resp
+	}
+
+	switch {
+	case lower == "ok":
+		resp.Result = Success
+	case hasStatus(lower, "temporary failure"):
+		resp.Result = Temporary
+		resp.Detail = errorDetail(first, lines)
+		return resp
+	case hasStatus(lower, "not ok"):
+		resp.Detail = errorDetail(first, lines)
+		if containsAny(strings.ToLower(resp.Detail), authFailures) {
+			resp.Result = AuthFailure
+		} else {
+			resp.Result = Permanent
+		}
+		return resp
+	case rest:
+		// REST 1.0 success: "RT/4.4.4 200 Ok" and "# Ticket 123 created."
+		resp.Result = Success
+	default:
+		resp.Result = Temporary
+		resp.Detail = "unexpected response: " + firstLine(body)
+		return resp
+	}
+
+	resp.Detail = ""
+	for _, line := range lines {
+		if m := ticketLine.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			resp.Ticket = m[1] + m[2]
+			break
+		}
+	}
+	return resp
+}
+
+// Err returns nil for a successful response, or the error to return
+// from Postmail.
+func (r Response) Err() error {
+	if r.Result == Success {
+		return nil
+	}
+	e := &Error{msg: "RT " + r.Result.String() + " failure"}
+	if r.Detail != "" {
+		e.msg += ": " + r.Detail
+	}
+	switch r.Result {
+	case Permanent:
+		e.Rejected = true
+	case AuthFailure:
+		e.Auth = true
+	}
+	return e
+}
+
+// hasStatus reports whether the first line is the status, alone or
+// followed by " - <error>".
+func hasStatus(first, status string) bool {
+	return first == status || strings.HasPrefix(first, status+" ")
+}
+
+// errorDetail returns the error from "not ok - <error>", or the lines
+// after the first if the first is only the status.
+func errorDetail(first string, lines []string) string {
+	if _, detail, ok := strings.Cut(first, " - "); ok {
+		return strings.TrimSpace(detail)
+	}
+	if len(lines) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.Join(lines[1:], "\n"))
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) > 100 {
+		s = s[:100]
+	}
+	return strings.TrimSpace(s)
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package rt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.askask.com/rt-mail/config"
+)
+
+// Match describes how a recipient address maps to a backend and queue.
+type Match struct {
+	Queue  string `json:"queue"`
+	Action string `json:"action"` // "correspond" or "comment"
+
+	// Target is the key in the queues configuration (or the domain or
+	// address of a route) that matched and Rule how it matched:
+	// "address", "local part", "comment address", "comment local part"
+	// or "domain", prefixed with "route " for routes setting the queue.
+	Target string `json:"target,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+
+	Backend string `json:"backend,omitempty"`
+}
+
+// MatchQueue maps the recipient address to a queue. The full address is
+// tried before the local part, and for each an exact target before the
+// "-comment" variants of the targets. The queue is empty if nothing
+// matched.
+func MatchQueue(queues AddressQueue, email string) Match {
+	email = strings.ToLower(email)
+
+	idx := strings.Index(email, "@")
+	if idx < 1 {
+		return Match{Action: "correspond"}
+	}
+
+	local := email[0:idx]
+
+	for _, address := range []struct{ addr, rule string }{{email, "address"}, {local, "local part"}} {
+		if queue, ok := queues[address.addr]; ok {
+			return Match{Queue: queue, Action: "correspond", Target: address.addr, Rule: address.rule}
+		}
+		for target, queue := range queues {
+			if commentAddress(target) == address.addr {
+				return Match{Queue: queue, Action: "comment", Target: target, Rule: "comment " + address.rule}
+			}
+		}
+	}
+
+	return Match{Action: "correspond"}
+}
+
+// RouteEntry is an entry of the routing table.
+type RouteEntry struct {
+	Backend        string `json:"backend"`
+	Target         string `json:"target"`
+	Queue          string `json:"queue"`
+	CommentAddress string `json:"comment_address"`
+}
+
+// Routes returns the routing table: the queues of each backend sorted
+// by target.
+func (rt *RT) Routes() []RouteEntry {
+	var routes []RouteEntry
+	for _, b := range rt.backends {
+		start := len(routes)
+		for target, queue := range b.queues {
+			routes = append(routes, RouteEntry{Backend: b.name, Target: target, Queue: queue, CommentAddress: commentAddress(target)})
+		}
+		sort.Slice(routes[start:], func(i, j int) bool { return routes[start+i].Target < routes[start+j].Target })
+	}
+	return routes
+}
+
+// Problems checks the queues of the backends with CheckQueues, and
+// reports backends without a URL, routes to backends without queues and
+// targets in more than one backend.
+func (rt *RT) Problems() []Problem {
+	var problems []Problem
+	add := func(severity, format string, a ...any) {
+		problems = append(problems, Problem{Severity: severity, Message: fmt.Sprintf(format, a...)})
+	}
+
+	seen := map[string]string{}
+	for _, b := range rt.backends {
+		if b.url == "" {
+			if b.name == config.DefaultBackend {
+				add("error", "rt-url is not set")
+			} else {
+				add("error", "backend %q has no url", b.name)
+			}
+		}
+		for _, p := range CheckQueues(b.queues) {
+			if b.name != config.DefaultBackend {
+				p.Message = fmt.Sprintf("backend %q: %s", b.name, p.Message)
+			}
+			problems = append(problems, p)
+		}
+
+		targets := make([]string, 0, len(b.queues))
+		for target := range b.queues {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			if other, ok := seen[target]; ok {
+				add("warning", "target %q is in the queues of backends %q and %q: without a route, %q is used",
+					target, other, b.name, other)
+				continue
+			}
+			seen[target] = b.name
+		}
+	}
+
+	for i, r := range rt.rules {
+		if r.queue == "" && len(r.backend.queues) == 0 {
+			add("error", "route %d sets no queue and backend %q has no queues", i+1, r.backend.name)
+		}
+	}
+	return problems
+}
+
+// commentAddress returns the "-comment" variant of a target.
+func commentAddress(target string) string {
+	if idx := strings.Index(target, "@"); idx > 0 {
+		return target[0:idx] + "-comment" + target[idx:]
+	}
+	return target + "-comment"
+}
+
+// Problem is an issue found in the queues configuration.
+type Problem struct {
+	Severity string `json:"severity"` // "error" or "warning"
+	Message  string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return p.Severity + ": " + p.Message
+}
+
+// CheckQueues reports targets that never match, duplicate targets,
+// targets overlapping each other and targets shadowing the "-comment"
+// address of another target.
+func CheckQueues(queues AddressQueue) []Problem {
+	var problems []Problem
+	add := func(severity, format string, a ...any) {
+		problems = append(problems, Problem{Severity: severity, Message: fmt.Sprintf(format, a...)})
+	}
+
+	targets := make([]string, 0, len(queues))
+	for target := range queues {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	byLower := map[string][]string{}
+	for _, target := range targets {
+		lower := strings.ToLower(target)
+		byLower[lower] = append(byLower[lower], target)
+
+		if queues[target] == "" {
+			add("error", "target %q has no queue", target)
+		}
+		switch {
+		case target == "" || strings.HasPrefix(target, "@"):
+			add("error", "target %q has no local part and never matches", target)
+		case lower != target:
+			add("error", "target %q has upper case letters and never matches (addresses are compared in lower case)", target)
+		}
+	}
+	lowers := make([]string, 0, len(byLower))
+	for lower := range byLower {
+		lowers = append(lowers, lower)
+	}
+	sort.Strings(lowers)
+	for _, lower := range lowers {
+		if dups := byLower[lower]; len(dups) > 1 {
+			add("error", "targets %s only differ in case", strings.Join(quoteAll(dups), ", "))
+		}
+	}
+
+	for _, target := range targets {
+		if strings.ToLower(target) != target {
+			continue
+		}
+		queue := queues[target]
+
+		if shadowed, ok := shadowsComment(queues, target); ok {
+			add("warning", "target %q shadows the comment address of %q: it maps to queue %q as correspond instead of queue %q as comment",
+				target, shadowed, queue, queues[shadowed])
+		}
+
+		local, domain, ok := strings.Cut(target, "@")
+		if !ok || domain == "" {
+			continue
+		}
+		if lq, exists := queues[local]; exists && lq != queue {
+			add("warning", "targets %q and %q overlap: mail to %s goes to queue %q, not %q",
+				target, local, target, queue, lq)
+		}
+	}
+
+	return problems
+}
+
+// shadowsComment returns the target whose "-comment" address is
+// matched by target instead.
+func shadowsComment(queues AddressQueue, target string) (string, bool) {
+	local, domain, hasDomain := strings.Cut(target, "@")
+	base, ok := strings.CutSuffix(local, "-comment")
+	if !ok || base == "" {
+		return "", false
+	}
+	candidates := []string{base}
+	if hasDomain {
+		candidates = []string{base + "@" + domain, base}
+	}
+	for _, c := range candidates {
+		if _, exists := queues[c]; exists {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+func quoteAll(list []string) []string {
+	quoted := make([]string, len(list))
+	for i, s := range list {
+		quoted[i] = fmt.Sprintf("%q", s)
+	}
+	return quoted
+}
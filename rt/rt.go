@@ -2,170 +2,331 @@ package rt
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/config"
 )
 
 // Client is an interface for posting messages to request tracker
 type Client interface {
-	Postmail(recipient string, message string) error
+	Postmail(ctx context.Context, recipient string, message string) error
 }
 
-// RT is the client for posting messages to request tracker
-type RT struct {
-	hclient *http.Client
-	config  *rtconfig
+// DefaultMaxMessageSize is the largest message accepted when no size
+// limit is configured.
+const DefaultMaxMessageSize = 50 << 20
+
+// MaxMessageSize returns size, or DefaultMaxMessageSize if size isn't set.
+func MaxMessageSize(size int64) int64 {
+	if size <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return size
 }
 
-// AddressQueue contains a Address to Queue mapping
-type AddressQueue map[string]string
+// FormMemory is the memory used for parsing a provider's multipart
+// request; larger file parts are written to temporary files.
+const FormMemory = 32 << 20
+
+// TooLarge reports whether err is from a request over its
+// http.MaxBytesReader limit, or with form fields too large to parse in
+// FormMemory. Providers answer it with 413.
+func TooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge) || errors.Is(err, multipart.ErrMessageTooLarge)
+}
 
-type rtconfig struct {
-	Queues AddressQueue `json:"queues"`
-	RTUrl  string       `json:"rt-url"`
+// RT is the client for posting messages to request tracker. Messages
+// are posted to one of the configured RT instances (backends).
+type RT struct {
+	config   *config.Config
+	backends []*backend // the default backend first, then by name
+	byName   map[string]*backend
+	rules    []*rule
+	limiter  *limiter // nil if posts aren't limited
 }
 
+// AddressQueue contains a Address to Queue mapping
+type AddressQueue = config.AddressQueue
+
 // New configures a new RT client with the specified configuration file
 func New(configfile string) (*RT, error) {
 	cfg, err := loadConfig(configfile)
 	if err != nil {
 		return nil, fmt.Errorf("loading configuration file '%s': %s", configfile, err)
 	}
-
-	netTransport := &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout: 5 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout: 5 * time.Second,
-	}
-	hclient := &http.Client{
-		Timeout:   time.Second * 10,
-		Transport: netTransport,
-	}
-
-	return &RT{hclient: hclient, config: cfg}, nil
+	return NewFromConfig(cfg)
 }
 
-func loadConfig(file string) (*rtconfig, error) {
-	b, err := os.ReadFile(file) //nolint:gosec
-	if err != nil {
+// NewFromConfig configures a new RT client from an already loaded configuration
+func NewFromConfig(cfg *config.Config) (*RT, error) {
+	rt := &RT{config: cfg}
+	switch cfg.RecipientField {
+	case "queue", "action", "message", "ticket":
+		return nil, fmt.Errorf("recipient-field %q is used by the mail gateway", cfg.RecipientField)
+	}
+	if err := rt.setupBackends(cfg); err != nil {
 		return nil, err
 	}
-
-	cfg := rtconfig{}
-
-	err = json.Unmarshal(b, &cfg)
+	limiter, err := newLimiter(cfg.Concurrency)
 	if err != nil {
 		return nil, err
 	}
-	return &cfg, nil
+	rt.limiter = limiter
+	return rt, nil
 }
 
-func (rt *RT) addressToQueueAction(email string) (string, string) {
-	email = strings.ToLower(email)
-
-	idx := strings.Index(email, "@")
-	if idx < 1 {
-		return "", "correspond"
-	}
-
-	local := email[0:idx]
+func loadConfig(file string) (*config.Config, error) {
+	return config.Load(file)
+}
 
-	for _, address := range []string{email, local} {
-		for target, queue := range rt.config.Queues {
-			// log.Printf("testing address address='%s' target='%s' queue='%s'",
-			// 	address, target, queue)
+// Route returns the queue and action ("correspond" or "comment") the
+// recipient address maps to. The queue is empty if the address isn't
+// configured.
+func (rt *RT) Route(recipient string) (queue, action string) {
+	return rt.addressToQueueAction(recipient)
+}
 
-			if address == target {
-				return queue, "correspond"
-			}
-			if idx = strings.Index(target, "@"); idx > 0 {
-				target = target[0:idx] + "-comment" + target[idx:]
-			} else {
-				target = target + "-comment"
-			}
-			if address == target {
-				return queue, "comment"
-			}
-		}
-	}
+// Match returns how the recipient address maps to a backend and queue.
+func (rt *RT) Match(recipient string) Match {
+	_, m := rt.resolve(recipient)
+	return m
+}
 
-	return "", "correspond"
+func (rt *RT) addressToQueueAction(email string) (string, string) {
+	_, m := rt.resolve(email)
+	return m.Queue, m.Action
 }
 
 // Error provides a custom error type for the RT client
 type Error struct {
 	msg      string
 	NotFound bool // Set if the queue wasn't found
+	Rejected bool // Set if the message was refused, by a filter or by RT
+	Auth     bool // Set if RT refused the credentials
+	Busy     bool // Set if too many messages were being posted or sent
+
+	// RetryAfter is how long the provider should wait before retrying
+	// a Busy error.
+	RetryAfter time.Duration
+}
+
+// Rejectf returns an Error for a message that was deliberately refused
+// and shouldn't be retried by the provider.
+func Rejectf(format string, a ...any) *Error {
+	return &Error{Rejected: true, msg: fmt.Sprintf(format, a...)}
+}
+
+// Busyf returns an Error telling the provider to retry the message
+// after retryAfter.
+func Busyf(retryAfter time.Duration, format string, a ...any) *Error {
+	return &Error{Busy: true, RetryAfter: retryAfter, msg: fmt.Sprintf(format, a...)}
 }
 
 func (e Error) Error() string {
 	if e.NotFound {
 		return fmt.Sprintf("%s (notfound=true)", e.msg)
 	}
+	if e.Rejected {
+		return fmt.Sprintf("%s (rejected=true)", e.msg)
+	}
+	if e.Auth {
+		return fmt.Sprintf("%s (auth=true)", e.msg)
+	}
+	if e.Busy {
+		return fmt.Sprintf("%s (busy=true)", e.msg)
+	}
 	return e.msg
 }
 
 // Postmail sends the message to the RT queue matching the specified recipient
-func (rt *RT) Postmail(recipient string, message string) error {
-	ctx := context.Background()
-	log := logger.FromContext(ctx)
+func (rt *RT) Postmail(ctx context.Context, recipient string, message string) error {
+	// replies go to their ticket, unless a filter rerouted them (to
+	// quarantine, say)
+	b, queue, action, ticket := rt.route(recipient, message)
+	if q, a, ok := RouteFromContext(ctx); ok {
+		b, _ = rt.resolve(recipient)
+		queue, action, ticket = q, a, ""
+	}
 
-	queue, action := rt.addressToQueueAction(recipient)
 	if len(queue) == 0 {
 		return &Error{
 			NotFound: true,
 			msg:      fmt.Sprintf("Queue not found for %q (returning 404)", recipient),
 		}
 	}
+	if b == nil {
+		return &Error{
+			NotFound: true,
+			msg:      fmt.Sprintf("No backend for %q (returning 404)", recipient),
+		}
+	}
+
+	log := logger.FromContext(ctx).With("backend", b.name)
+	ctx = logger.NewContext(ctx, log)
+
+	receipt := ReceiptFromContext(ctx)
+	if receipt != nil {
+		receipt.Backend, receipt.Queue, receipt.Action = b.name, queue, action
+	}
+
+	if id := RequestIDFromContext(ctx); id != "" && rt.config.RequestIDHeader {
+		message = addHeader(message, RequestIDHeader, id)
+	}
+
+	release, err := rt.limiter.acquire(ctx, queue)
+	if err != nil {
+		log.WarnContext(ctx, "not posting to RT", "queue", queue, "recipient", recipient, "error", err)
+		return err
+	}
+	defer release()
 
 	form := url.Values{
-		"queue":  []string{queue},
-		"action": []string{action},
+		"queue":   []string{queue},
+		"action":  []string{action},
+		"message": []string{message},
 	}
+	if field := rt.config.RecipientField; field != "" {
+		form.Set(field, recipient)
+	}
+	if ticket != "" {
+		log.InfoContext(ctx, "posting reply to RT ticket", "ticket", ticket)
+		form.Set("ticket", ticket)
+	}
+
+	err = b.postmail(ctx, recipient, form, receipt)
+	if err != nil {
+		posts.Add(b.name+":error", 1)
+		return err
+	}
+	posts.Add(b.name+":ok", 1)
+	return nil
+}
+
+// RequestIDHeader is the header added to messages with the ID of the
+// request that delivered them, if configured.
+const RequestIDHeader = "X-RT-Mail-Request-ID"
+
+// addHeader adds a header field at the top of the message, with the
+// message's line ending.
+func addHeader(message, name, value string) string {
+	return name + ": " + value + LineEnding(message) + message
+}
+
+// LineEnding returns the line ending of the message, "\r\n" or "\n",
+// judging by its first line.
+func LineEnding[T ~string | ~[]byte](message T) string {
+	for i := 0; i < len(message); i++ {
+		if message[i] == '\n' {
+			if i > 0 && message[i-1] == '\r' {
+				return "\r\n"
+			}
+			break
+		}
+	}
+	return "\n"
+}
+
+// postmail posts the form with the message to the backend's mail
+// gateway, retrying failures that happened before RT could have
+// accepted it.
+func (b *backend) postmail(ctx context.Context, recipient string, form url.Values, receipt *Receipt) error {
+	log := logger.FromContext(ctx)
 
 	log.InfoContext(ctx, "posting to RT queue",
-		"queue", queue,
-		"action", action,
+		"queue", form.Get("queue"),
+		"action", form.Get("action"),
 		"recipient", recipient,
 	)
 
-	form.Add("message", message)
+	body := form.Encode()
 
-	resp, err := rt.hclient.PostForm(
-		rt.config.RTUrl,
-		form,
-	)
+	for attempt := 1; ; attempt++ {
+		if !b.breaker.allow() {
+			return &Error{msg: fmt.Sprintf("RT backend %q is unavailable (circuit breaker open)", b.name)}
+		}
+		result, retryable, err := b.post(ctx, body)
+		b.breaker.record(err == nil && result.Result != Temporary)
+		if err == nil {
+			if result.Result == AuthFailure {
+				log.ErrorContext(ctx, "RT refused the credentials; check rt-auth", "detail", result.Detail)
+			}
+			err = result.Err()
+		}
+		if err == nil {
+			if receipt != nil {
+				receipt.Ticket = result.Ticket
+			}
+			return nil
+		}
+		if !retryable || attempt >= b.retry.attempts {
+			return err
+		}
+
+		wait := b.retry.wait(attempt)
+		log.WarnContext(ctx, "retrying RT post", "attempt", attempt, "wait", wait, "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// post makes one attempt at posting the form. It returns the parsed
+// response (or the error if there was none) and whether the attempt can
+// be retried without RT possibly getting the message twice: the request
+// wasn't sent, or a proxy said RT is unavailable.
+func (b *backend) post(ctx context.Context, form string) (resp Response, retryable bool, err error) {
+	log := logger.FromContext(ctx)
+
+	var wrote atomic.Bool
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				wrote.Store(true)
+			}
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, strings.NewReader(form))
 	if err != nil {
-		return fmt.Errorf("postform err: %s", err)
+		return Response{}, false, fmt.Errorf("postform err: %s", err)
 	}
-	body, err := io.ReadAll(resp.Body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	b.authenticate(req)
+
+	hresp, err := b.hclient.Do(req)
 	if err != nil {
-		return fmt.Errorf("Error reading RT response: %s", err)
+		return Response{}, !wrote.Load() && ctx.Err() == nil, fmt.Errorf("postform err: %s", err)
+	}
+	body, err := io.ReadAll(hresp.Body)
+	_ = hresp.Body.Close()
+	if err != nil {
+		return Response{}, false, fmt.Errorf("Error reading RT response: %s", err)
 	}
-	_ = resp.Body.Close()
 
 	log.DebugContext(ctx, "RT response",
-		"status_code", resp.StatusCode,
+		"status_code", hresp.StatusCode,
 		"body", string(body),
 	)
 
-	if strings.Contains(string(body), "failure") {
-		return fmt.Errorf("RT failure")
-	}
-
-	if resp.StatusCode > 299 {
-		return fmt.Errorf("status code %d (>299)", resp.StatusCode)
+	switch hresp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		retryable = true
 	}
-
-	return nil
+	return ParseResponse(hresp.StatusCode, string(body)), retryable, nil
 }
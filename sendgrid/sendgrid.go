@@ -1,20 +1,33 @@
 package sendgrid
 
 import (
+	"cmp"
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"go.ntppool.org/common/logger"
 
 	"go.askask.com/rt-mail/rt"
 )
 
+// DefaultPath is the prefix of the SendGrid routes.
+const DefaultPath = "/sendgrid"
+
 type Sendgrid struct {
 	RT rt.Client
+
+	// MaxSize is the largest request accepted, rt.DefaultMaxMessageSize
+	// if zero.
+	MaxSize int64
+
+	// Path is the prefix of the routes, DefaultPath if empty.
+	Path string
 }
 
 func (sg *Sendgrid) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/sendgrid/mx", sg.ReceiveHandler)
+	mux.HandleFunc(strings.TrimSuffix(cmp.Or(sg.Path, DefaultPath), "/")+"/mx", sg.ReceiveHandler)
 }
 
 type Envelope struct {
@@ -33,9 +46,14 @@ func (sg *Sendgrid) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.DebugContext(ctx, "received POST request", "path", r.URL.String())
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024*50)
+	maxSize := rt.MaxMessageSize(sg.MaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 	defer func() { _ = r.Body.Close() }()
-	_ = r.ParseMultipartForm(64 << 20)
+	if err := r.ParseMultipartForm(rt.FormMemory); err != nil && rt.TooLarge(err) {
+		log.WarnContext(ctx, "request too large", "limit", maxSize, "error", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 
 	form := r.PostForm
 	envelopeData := form.Get("envelope")
@@ -71,12 +89,24 @@ func (sg *Sendgrid) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	env := &rt.Envelope{
+		Provider: "sendgrid",
+		From:     envelope.From,
+		RemoteIP: form.Get("sender_ip"),
+	}
+	if score, err := strconv.ParseFloat(form.Get("spam_score"), 64); err == nil {
+		env.SpamScore = &score
+	}
+	env.SPF = strings.ToLower(form.Get("SPF"))
+	env.DKIM = dkimResult(form.Get("dkim"))
+	ctx = rt.NewContext(ctx, env)
+
 	allNotFound := true
 
 	for _, email := range envelope.To {
 		log.InfoContext(ctx, "processing sendgrid webhook", "recipient", email)
 
-		err := sg.RT.Postmail(email, body)
+		err := sg.RT.Postmail(ctx, email, body)
 		if err != nil {
 			log.ErrorContext(ctx, "failed to post to RT", "error", err, "recipient", email)
 			if err, ok := err.(*rt.Error); ok {
@@ -84,10 +114,18 @@ func (sg *Sendgrid) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 					log.WarnContext(ctx, "recipient address not configured", "recipient", email)
 					continue
 				}
-				w.WriteHeader(http.StatusServiceUnavailable)
+				if err.Rejected {
+					allNotFound = false
+					continue
+				}
+			}
+			// temporary and authentication failures are retried
+			if rt.RetryAfter(w, err) {
+				w.WriteHeader(http.StatusTooManyRequests)
 				return
 			}
-			continue
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
 		}
 
 		log.InfoContext(ctx, "successfully posted to RT", "recipient", email)
@@ -102,3 +140,24 @@ func (sg *Sendgrid) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// dkimResult reduces SendGrid's dkim field ("{@example.com : pass}") to a
+// single result, "pass" if any signature passed.
+func dkimResult(field string) string {
+	field = strings.Trim(field, "{} ")
+	if field == "" {
+		return ""
+	}
+	result := ""
+	for _, sig := range strings.Split(field, ",") {
+		_, r, ok := strings.Cut(sig, ":")
+		if !ok {
+			continue
+		}
+		result = strings.ToLower(strings.TrimSpace(r))
+		if result == "pass" {
+			break
+		}
+	}
+	return result
+}
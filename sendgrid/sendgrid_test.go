@@ -8,8 +8,10 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"go.askask.com/rt-mail/config"
 	"go.askask.com/rt-mail/rt"
 	"go.askask.com/rt-mail/testutil"
 )
@@ -74,6 +76,24 @@ func TestSendgridReceiveHandler_MultipleRecipients(t *testing.T) {
 	}
 }
 
+func TestSendgridReceiveHandler_TooLarge(t *testing.T) {
+	sg := &Sendgrid{RT: &testutil.MockRTClient{}, MaxSize: 1000}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("envelope", `{"to":["test@example.com"],"from":"sender@example.com"}`)
+	_ = writer.WriteField("email", strings.Repeat("x", 2000))
+	_ = writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/sendgrid/mx", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	sg.ReceiveHandler(rr, req)
+
+	testutil.AssertStatusCode(t, rr.Code, http.StatusRequestEntityTooLarge)
+}
+
 func TestSendgridReceiveHandler_Integration(t *testing.T) {
 	rtServer := testutil.NewMockRTServer(t)
 	defer rtServer.Close()
@@ -101,3 +121,42 @@ func TestSendgridReceiveHandler_Integration(t *testing.T) {
 
 	testutil.AssertStatusCode(t, rr.Code, http.StatusNoContent)
 }
+
+func TestSendgridReceiveHandler_RTFailure(t *testing.T) {
+	tests := []struct {
+		body string
+		want int
+	}{
+		{"not ok - Permission Denied\n", http.StatusNoContent},
+		{"temporary failure - Couldn't write message to database\n", http.StatusServiceUnavailable},
+		{"RT/4.4.4 401 Credentials required\n", http.StatusServiceUnavailable},
+		{"<html>Service Unavailable</html>", http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		rtServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, test.body)
+		}))
+		rtClient, err := rt.NewFromConfig(&config.Config{
+			RTUrl:  rtServer.URL,
+			Queues: rt.AddressQueue{"test@example.com": "test-queue"},
+		})
+		testutil.AssertNoError(t, err)
+
+		sg := &Sendgrid{RT: rtClient}
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		_ = writer.WriteField("envelope", `{"to":["test@example.com"],"from":"sender@example.com"}`)
+		_ = writer.WriteField("email", "Test message")
+		_ = writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/sendgrid/mx", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		rr := httptest.NewRecorder()
+		sg.ReceiveHandler(rr, req)
+		rtServer.Close()
+
+		testutil.AssertStatusCode(t, rr.Code, test.want)
+	}
+}
@@ -1,11 +1,13 @@
 package ses
 
 import (
+	"cmp"
 	"context"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,6 +15,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -39,8 +42,8 @@ var (
 // Must be sns.<region>.amazonaws.com
 var snsHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com$`)
 
-// maxEmailSize is the maximum email size to fetch from S3 (50MB).
-const maxEmailSize = 50 * 1024 * 1024
+// maxEmailSize is the default maximum email size to fetch from S3.
+const maxEmailSize = rt.DefaultMaxMessageSize
 
 // SNSMessage represents an AWS SNS message envelope.
 type SNSMessage struct {
@@ -67,7 +70,12 @@ type SESNotification struct {
 			BucketName string `json:"bucketName"`
 			ObjectKey  string `json:"objectKey"`
 		} `json:"action"`
-		Recipients []string `json:"recipients"`
+		Recipients   []string `json:"recipients"`
+		SpamVerdict  Verdict  `json:"spamVerdict"`
+		VirusVerdict Verdict  `json:"virusVerdict"`
+		SPFVerdict   Verdict  `json:"spfVerdict"`
+		DKIMVerdict  Verdict  `json:"dkimVerdict"`
+		DMARCVerdict Verdict  `json:"dmarcVerdict"`
 	} `json:"receipt"`
 	Mail struct {
 		MessageID   string   `json:"messageId"`
@@ -76,16 +84,33 @@ type SESNotification struct {
 	} `json:"mail"`
 }
 
+// Verdict is the result of one of the checks SES runs on received mail.
+type Verdict struct {
+	Status string `json:"status"` // PASS, FAIL, GRAY or PROCESSING_FAILED
+}
+
+// DefaultPath is the path of the SES route.
+const DefaultPath = "/ses"
+
 // SES handles AWS SES webhook requests via SNS.
 type SES struct {
 	RT         rt.Client
 	httpClient *http.Client
 	S3Client   *s3.Client
 	TopicARN   string
+
+	// MaxSize is the largest email fetched from S3, maxEmailSize if zero.
+	MaxSize int64
+
+	// Path is the path of the route, DefaultPath if empty.
+	Path string
+
+	// bucket is the S3 bucket of the last notification, for Ping.
+	bucket atomic.Pointer[string]
 }
 
 // New creates a new SES webhook handler.
-func New(rtClient *rt.RT, topicARN string) (*SES, error) {
+func New(rtClient rt.Client, topicARN string) (*SES, error) {
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("loading AWS config: %w", err)
@@ -103,7 +128,7 @@ func New(rtClient *rt.RT, topicARN string) (*SES, error) {
 
 // RegisterRoutes registers the SES handler routes.
 func (s *SES) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/ses", s.Handler)
+	mux.HandleFunc(strings.TrimSuffix(cmp.Or(s.Path, DefaultPath), "/"), s.Handler)
 }
 
 // Handler processes an SNS POST request containing SES events.
@@ -248,9 +273,15 @@ func (s *SES) handleNotification(ctx context.Context, w http.ResponseWriter, msg
 		return
 	}
 
+	s.bucket.Store(&bucket)
 	rawEmail, err := s.fetchEmailFromS3(ctx, bucket, key)
+	if errors.Is(err, errTooLarge) {
+		log.WarnContext(ctx, "SES: email too large", "bucket", bucket, "key", key, "limit", rt.MaxMessageSize(s.MaxSize))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		log.WarnContext(ctx, "SES: failed to fetch email from S3 (bucket=%s, key=%s)", "value", bucket, key, err)
+		log.WarnContext(ctx, "SES: failed to fetch email from S3", "bucket", bucket, "key", key, "error", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
@@ -263,16 +294,40 @@ func (s *SES) handleNotification(ctx context.Context, w http.ResponseWriter, msg
 		return
 	}
 
+	env := &rt.Envelope{
+		Provider: "ses",
+		From:     sesNotif.Mail.Source,
+	}
+	switch sesNotif.Receipt.SpamVerdict.Status {
+	case "FAIL":
+		env.SpamVerdict = "spam"
+	case "PASS":
+		env.SpamVerdict = "ham"
+	}
+	switch sesNotif.Receipt.VirusVerdict.Status {
+	case "FAIL":
+		env.VirusVerdict = "infected"
+	case "PASS":
+		env.VirusVerdict = "clean"
+	}
+	env.SPF = authVerdict(sesNotif.Receipt.SPFVerdict)
+	env.DKIM = authVerdict(sesNotif.Receipt.DKIMVerdict)
+	env.DMARC = authVerdict(sesNotif.Receipt.DMARCVerdict)
+	ctx = rt.NewContext(ctx, env)
+
 	var lastErr error
 	var notFoundCount int
 	for _, recipient := range recipients {
-		err := s.RT.Postmail(recipient, string(rawEmail))
+		err := s.RT.Postmail(ctx, recipient, string(rawEmail))
 		if err != nil {
 			log.ErrorContext(ctx, "SES: failed to post to RT", "recipient", recipient, "error", err)
 			if rtErr, ok := err.(*rt.Error); ok && rtErr.NotFound {
 				notFoundCount++
 				continue
 			}
+			if rtErr, ok := err.(*rt.Error); ok && rtErr.Rejected {
+				continue
+			}
 			lastErr = err
 		}
 	}
@@ -283,8 +338,10 @@ func (s *SES) handleNotification(ctx context.Context, w http.ResponseWriter, msg
 		return
 	}
 
-	// If any non-404 error occurred, return 503 to trigger SNS retry
+	// If any non-404 error occurred, return 503 to trigger SNS retry,
+	// also at concurrency limits since SNS retries server errors
 	if lastErr != nil {
+		rt.RetryAfter(w, lastErr)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
@@ -292,6 +349,44 @@ func (s *SES) handleNotification(ctx context.Context, w http.ResponseWriter, msg
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// authVerdict maps an SES authentication verdict to an
+// Authentication-Results result.
+func authVerdict(v Verdict) string {
+	switch v.Status {
+	case "PASS":
+		return "pass"
+	case "FAIL":
+		return "fail"
+	case "GRAY":
+		return "none"
+	case "PROCESSING_FAILED":
+		return "temperror"
+	}
+	return ""
+}
+
+// Ping checks that S3 can be used: that AWS credentials are available
+// and, once a notification named the bucket messages are stored in, that
+// the bucket can be accessed.
+func (s *SES) Ping(ctx context.Context) error {
+	if creds := s.S3Client.Options().Credentials; creds != nil {
+		if _, err := creds.Retrieve(ctx); err != nil {
+			return fmt.Errorf("AWS credentials: %w", err)
+		}
+	}
+	bucket := s.bucket.Load()
+	if bucket == nil {
+		return nil
+	}
+	if _, err := s.S3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: bucket}); err != nil {
+		return fmt.Errorf("S3 bucket %s: %w", *bucket, err)
+	}
+	return nil
+}
+
+// errTooLarge is returned for emails in S3 larger than MaxSize.
+var errTooLarge = errors.New("email exceeds size limit")
+
 // fetchEmailFromS3 retrieves the raw email content from S3.
 func (s *SES) fetchEmailFromS3(ctx context.Context, bucket, key string) ([]byte, error) {
 	resp, err := s.S3Client.GetObject(ctx, &s3.GetObjectInput{
@@ -303,15 +398,17 @@ func (s *SES) fetchEmailFromS3(ctx context.Context, bucket, key string) ([]byte,
 	}
 	defer func() { _ = resp.Body.Close() }()
 
+	maxSize := rt.MaxMessageSize(s.MaxSize)
+
 	// Limit read size to prevent memory exhaustion
-	limitedReader := io.LimitReader(resp.Body, maxEmailSize+1)
+	limitedReader := io.LimitReader(resp.Body, maxSize+1)
 	data, err := io.ReadAll(limitedReader)
 	if err != nil {
 		return nil, fmt.Errorf("read S3 object: %w", err)
 	}
 
-	if len(data) > maxEmailSize {
-		return nil, fmt.Errorf("email exceeds size limit (%d bytes)", maxEmailSize)
+	if int64(len(data)) > maxSize {
+		return nil, errTooLarge
 	}
 
 	return data, nil
@@ -364,6 +461,17 @@ func (s *SES) verifySignature(ctx context.Context, msg *SNSMessage) error {
 	return nil
 }
 
+// FlushCertCache removes all cached SNS signing certificates, so they're
+// fetched again for the next message. It returns the number removed.
+func FlushCertCache() int {
+	certCacheMu.Lock()
+	defer certCacheMu.Unlock()
+
+	n := len(certCache)
+	certCache = make(map[string]certCacheEntry)
+	return n
+}
+
 // getCertificate retrieves a certificate from cache or fetches it from the URL.
 func (s *SES) getCertificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
 	now := time.Now()
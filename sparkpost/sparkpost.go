@@ -1,10 +1,13 @@
 package sparkpost
 
 import (
+	"cmp"
+	"crypto/subtle"
 	"encoding/json"
 	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 
 	"go.askask.com/rt-mail/rt"
 	"go.ntppool.org/common/logger"
@@ -12,12 +15,30 @@ import (
 	sparkevents "github.com/SparkPost/gosparkpost/events"
 )
 
+// DefaultPath is the prefix of the SparkPost routes.
+const DefaultPath = "/spark"
+
 type SparkPost struct {
 	RT rt.Client
+
+	// MaxSize is the largest request accepted, rt.DefaultMaxMessageSize
+	// if zero.
+	MaxSize int64
+
+	// Path is the prefix of the routes, DefaultPath if empty.
+	Path string
+
+	// Token is the relay webhook's authentication token. If set,
+	// relayed messages must carry it.
+	Token string
+}
+
+func (sp *SparkPost) path() string {
+	return strings.TrimSuffix(cmp.Or(sp.Path, DefaultPath), "/")
 }
 
 func (sp *SparkPost) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/spark", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(sp.path(), func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodHead:
 			headHandler(w, r)
@@ -27,7 +48,7 @@ func (sp *SparkPost) RegisterRoutes(mux *http.ServeMux) {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
-	mux.HandleFunc("/spark/mx", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(sp.path()+"/mx", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			sp.RelayHandler(w, r)
 		} else {
@@ -42,11 +63,16 @@ func (sp *SparkPost) EventHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.DebugContext(ctx, "received POST request", "path", r.URL.String())
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024*50)
+	maxSize := rt.MaxMessageSize(sp.MaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 	defer func() { _ = r.Body.Close() }()
-	_ = r.ParseMultipartForm(64 << 20)
+	if err := r.ParseMultipartForm(rt.FormMemory); err != nil && rt.TooLarge(err) {
+		log.WarnContext(ctx, "request too large", "limit", maxSize, "error", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 
-	if r.URL.Path == "/spark/mx" {
+	if r.URL.Path == sp.path()+"/mx" {
 		msg, err := io.ReadAll(r.Body)
 		if err != nil {
 			log.ErrorContext(ctx, "failed to read body", "error", err)
@@ -83,9 +109,20 @@ func (sp *SparkPost) RelayHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.DebugContext(ctx, "received POST request", "path", r.URL.String())
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024*50)
+	if sp.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-MessageSystems-Webhook-Token")), []byte(sp.Token)) != 1 {
+		log.WarnContext(ctx, "invalid sparkpost webhook token")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	maxSize := rt.MaxMessageSize(sp.MaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 	defer func() { _ = r.Body.Close() }()
-	_ = r.ParseMultipartForm(64 << 20)
+	if err := r.ParseMultipartForm(rt.FormMemory); err != nil && rt.TooLarge(err) {
+		log.WarnContext(ctx, "request too large", "limit", maxSize, "error", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 
 	var msgWrapper []struct {
 		Msys map[string]json.RawMessage `json:"msys"`
@@ -93,6 +130,11 @@ func (sp *SparkPost) RelayHandler(w http.ResponseWriter, r *http.Request) {
 
 	dec := json.NewDecoder(r.Body)
 	err := dec.Decode(&msgWrapper)
+	if rt.TooLarge(err) {
+		log.WarnContext(ctx, "request too large", "limit", maxSize)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.ErrorContext(ctx, "failed to parse JSON", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -123,7 +165,12 @@ func (sp *SparkPost) RelayHandler(w http.ResponseWriter, r *http.Request) {
 			),
 		)
 
-		err = sp.RT.Postmail(m.To, m.Content.Email)
+		mctx := rt.NewContext(ctx, &rt.Envelope{
+			Provider: "sparkpost",
+			From:     m.From,
+		})
+
+		err = sp.RT.Postmail(mctx, m.To, m.Content.Email)
 		if err != nil {
 			log.ErrorContext(ctx, "failed to post to RT", "error", err, "recipient", m.To)
 			if err, ok := err.(*rt.Error); ok {
@@ -131,6 +178,13 @@ func (sp *SparkPost) RelayHandler(w http.ResponseWriter, r *http.Request) {
 					w.WriteHeader(http.StatusNotFound)
 					return
 				}
+				if err.Rejected {
+					continue
+				}
+			}
+			if rt.RetryAfter(w, err) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
 			}
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Dir stores files in a local directory.
+type Dir struct {
+	Path string
+
+	// BaseURL is the URL the directory is served from. If empty, file://
+	// URLs are returned.
+	BaseURL string
+}
+
+// NewDir returns a store for the directory path, creating it if needed.
+func NewDir(path, baseURL string) (*Dir, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0o750); err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	return &Dir{Path: abs, BaseURL: baseURL}, nil
+}
+
+// file returns the path of the file for key.
+func (d *Dir) file(key string) (string, error) {
+	rel := filepath.FromSlash(key)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return filepath.Join(d.Path, rel), nil
+}
+
+// Put writes data to the file for key.
+func (d *Dir) Put(_ context.Context, key, _ string, data []byte) error {
+	file, err := d.file(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o750); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+
+	// write to a temporary file first so readers never see a partial file
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("storage: %w", err)
+	}
+	return nil
+}
+
+// URL returns BaseURL joined with key, or a file:// URL.
+func (d *Dir) URL(_ context.Context, key string) (string, error) {
+	file, err := d.file(key)
+	if err != nil {
+		return "", err
+	}
+	if d.BaseURL != "" {
+		return joinURL(d.BaseURL, key), nil
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(file)}
+	return u.String(), nil
+}
+
+// Get reads the file for key.
+func (d *Dir) Get(_ context.Context, key string) ([]byte, error) {
+	file, err := d.file(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(file) //nolint:gosec
+}
+
+// List walks the directory for files with keys starting with prefix.
+func (d *Dir) List(_ context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(d.Path, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.Path, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if e.IsDir() {
+			// skip directories that can't contain matching keys
+			if !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, ".tmp") {
+			return nil
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Delete removes the file for key and the directories left empty.
+func (d *Dir) Delete(_ context.Context, key string) error {
+	file, err := d.file(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	for dir := filepath.Dir(file); dir != d.Path && strings.HasPrefix(dir, d.Path); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"go.askask.com/rt-mail/config"
+)
+
+// S3 stores files in an S3 bucket.
+type S3 struct {
+	Client  *s3.Client
+	Bucket  string
+	Prefix  string
+	BaseURL string
+}
+
+// NewS3 returns a store for the bucket configured by cfg. Links use
+// baseURL; without it the store has no links.
+func NewS3(ctx context.Context, cfg *config.S3, baseURL string) (*S3, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	return newS3(awsCfg, cfg, baseURL)
+}
+
+func newS3(awsCfg aws.Config, cfg *config.S3, baseURL string) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("storage: s3 bucket not configured")
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+			// S3 compatible services don't all support the
+			// checksums the SDK adds by default
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		}
+		o.UsePathStyle = cfg.PathStyle
+	})
+
+	return &S3{
+		Client:  client,
+		Bucket:  cfg.Bucket,
+		Prefix:  cfg.Prefix,
+		BaseURL: baseURL,
+	}, nil
+}
+
+func (s *S3) objectKey(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+	return path.Join(s.Prefix, key)
+}
+
+// Put uploads data to the bucket.
+func (s *S3) Put(ctx context.Context, key, contentType string, data []byte) error {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(s.objectKey(key)),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if _, err := s.Client.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("S3 PutObject: %w", err)
+	}
+	return nil
+}
+
+// URL returns BaseURL joined with the object key. Presigned URLs aren't
+// used as they expire (within 7 days, or hours with temporary
+// credentials), and the links are kept in tickets for good.
+func (s *S3) URL(_ context.Context, key string) (string, error) {
+	if s.BaseURL == "" {
+		return "", errors.New("storage: no url configured for the s3 bucket")
+	}
+	return joinURL(s.BaseURL, s.objectKey(key)), nil
+}
+
+// Get downloads the object for key.
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("S3 GetObject: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return io.ReadAll(resp.Body)
+}
+
+// List lists the objects with keys starting with prefix.
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	listPrefix := s.objectKey(prefix)
+	if s.Prefix != "" && prefix == "" {
+		listPrefix = strings.TrimSuffix(s.Prefix, "/") + "/"
+	}
+
+	var objects []Object
+	p := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(listPrefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("S3 ListObjectsV2: %w", err)
+		}
+		for _, o := range page.Contents {
+			key := aws.ToString(o.Key)
+			if s.Prefix != "" {
+				key = strings.TrimPrefix(key, strings.TrimSuffix(s.Prefix, "/")+"/")
+			}
+			objects = append(objects, Object{
+				Key:      key,
+				Size:     aws.ToInt64(o.Size),
+				Modified: aws.ToTime(o.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// Delete removes the object for key.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("S3 DeleteObject: %w", err)
+	}
+	return nil
+}
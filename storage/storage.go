@@ -0,0 +1,60 @@
+// Package storage stores files in a local directory or an S3 bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+)
+
+// Store stores files by key. Keys are slash separated paths.
+type Store interface {
+	// Put stores data under key.
+	Put(ctx context.Context, key, contentType string, data []byte) error
+
+	// URL returns the URL the file stored under key can be fetched from.
+	URL(ctx context.Context, key string) (string, error)
+
+	// Get returns the file stored under key.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// List returns the files with keys starting with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]Object, error)
+
+	// Delete removes the file stored under key.
+	Delete(ctx context.Context, key string) error
+}
+
+// Object describes a stored file.
+type Object struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// New returns the store configured by cfg.
+func New(ctx context.Context, cfg *config.Storage) (Store, error) {
+	switch {
+	case cfg.S3 != nil && cfg.Dir != "":
+		return nil, errors.New("storage: both dir and s3 are configured")
+	case cfg.S3 != nil:
+		return NewS3(ctx, cfg.S3, cfg.URL)
+	case cfg.Dir != "":
+		return NewDir(cfg.Dir, cfg.URL)
+	}
+	return nil, errors.New("storage: dir or s3 must be configured")
+}
+
+// joinURL appends the escaped key to base.
+func joinURL(base, key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + path.Join(parts...)
+}
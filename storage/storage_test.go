@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/testutil"
+)
+
+func TestDir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	d, err := NewDir(dir, "https://files.example.com/rt/")
+	testutil.AssertNoError(t, err)
+
+	testutil.AssertNoError(t, d.Put(ctx, "2026/10/19/abc/report q1.pdf", "application/pdf", []byte("pdf")))
+
+	data, err := os.ReadFile(filepath.Join(dir, "2026", "10", "19", "abc", "report q1.pdf"))
+	testutil.AssertNoError(t, err)
+	if string(data) != "pdf" {
+		t.Errorf("stored %q", data)
+	}
+
+	url, err := d.URL(ctx, "2026/10/19/abc/report q1.pdf")
+	testutil.AssertNoError(t, err)
+	if url != "https://files.example.com/rt/2026/10/19/abc/report%20q1.pdf" {
+		t.Errorf("URL = %q", url)
+	}
+
+	if err := d.Put(ctx, "../escape", "", nil); err == nil {
+		t.Error("expected error for key outside the directory")
+	}
+
+	testutil.AssertNoError(t, d.Put(ctx, "2026/10/20/def/b.txt", "text/plain", []byte("b")))
+	objects, err := d.List(ctx, "2026/10/2")
+	testutil.AssertNoError(t, err)
+	if len(objects) != 1 || objects[0].Key != "2026/10/20/def/b.txt" || objects[0].Size != 1 {
+		t.Errorf("listed %+v", objects)
+	}
+	data, err = d.Get(ctx, "2026/10/20/def/b.txt")
+	testutil.AssertNoError(t, err)
+	if string(data) != "b" {
+		t.Errorf("got %q", data)
+	}
+	testutil.AssertNoError(t, d.Delete(ctx, "2026/10/20/def/b.txt"))
+	if _, err := os.Stat(filepath.Join(dir, "2026", "10", "20")); !os.IsNotExist(err) {
+		t.Error("empty directories not removed")
+	}
+
+	d.BaseURL = ""
+	url, err = d.URL(ctx, "a/b.txt")
+	testutil.AssertNoError(t, err)
+	if !strings.HasPrefix(url, "file://") || !strings.HasSuffix(url, "/a/b.txt") {
+		t.Errorf("file URL = %q", url)
+	}
+}
+
+// fakeS3 is a minimal S3 compatible server storing objects in memory.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]string
+	types   map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = string(body)
+		f.types[r.URL.Path] = r.Header.Get("Content-Type")
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		bucket := strings.Trim(r.URL.Path, "/")
+		prefix := "/" + bucket + "/" + r.URL.Query().Get("prefix")
+		var keys []string
+		for p := range f.objects {
+			if strings.HasPrefix(p, prefix) {
+				keys = append(keys, p)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "<ListBucketResult><Name>%s</Name><IsTruncated>false</IsTruncated><KeyCount>%d</KeyCount>", bucket, len(keys))
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2026-10-19T12:00:00.000Z</LastModified></Contents>",
+				strings.TrimPrefix(k, "/"+bucket+"/"), len(f.objects[k]))
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == http.MethodGet:
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		fmt.Fprint(w, obj)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestS3(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeS3{objects: map[string]string{}, types: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	awsCfg := aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+	}
+	s, err := newS3(awsCfg, &config.S3{
+		Bucket:    "attachments",
+		Prefix:    "rt-mail",
+		Endpoint:  server.URL,
+		PathStyle: true,
+	}, "")
+	testutil.AssertNoError(t, err)
+
+	testutil.AssertNoError(t, s.Put(ctx, "2026/10/19/abc/a.pdf", "application/pdf", []byte("pdf data")))
+
+	if got := fake.objects["/attachments/rt-mail/2026/10/19/abc/a.pdf"]; got != "pdf data" {
+		t.Errorf("stored objects %v", fake.objects)
+	}
+	if got := fake.types["/attachments/rt-mail/2026/10/19/abc/a.pdf"]; got != "application/pdf" {
+		t.Errorf("content type %q", got)
+	}
+
+	if _, err := s.URL(ctx, "2026/10/19/abc/a.pdf"); err == nil {
+		t.Error("URL without a base URL: no error")
+	}
+	s.BaseURL = "https://files.example.com/"
+	url, err := s.URL(ctx, "2026/10/19/abc/a.pdf")
+	testutil.AssertNoError(t, err)
+	if url != "https://files.example.com/rt-mail/2026/10/19/abc/a.pdf" {
+		t.Errorf("URL = %q", url)
+	}
+
+	testutil.AssertNoError(t, s.Put(ctx, "2026/10/20/def/b.txt", "text/plain", []byte("b")))
+	objects, err := s.List(ctx, "2026/10/")
+	testutil.AssertNoError(t, err)
+	if len(objects) != 2 || objects[0].Key != "2026/10/19/abc/a.pdf" || objects[0].Size != 8 {
+		t.Errorf("listed %+v", objects)
+	}
+
+	data, err := s.Get(ctx, "2026/10/20/def/b.txt")
+	testutil.AssertNoError(t, err)
+	if string(data) != "b" {
+		t.Errorf("got %q", data)
+	}
+
+	testutil.AssertNoError(t, s.Delete(ctx, "2026/10/20/def/b.txt"))
+	if _, err := s.Get(ctx, "2026/10/20/def/b.txt"); err == nil {
+		t.Error("object not deleted")
+	}
+
+	s.BaseURL = "https://cdn.example.com"
+	url, err = s.URL(ctx, "2026/10/19/abc/a.pdf")
+	testutil.AssertNoError(t, err)
+	if url != "https://cdn.example.com/rt-mail/2026/10/19/abc/a.pdf" {
+		t.Errorf("URL = %q", url)
+	}
+}
+
+func TestNew(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, &config.Storage{}); err == nil {
+		t.Error("expected error without a backend")
+	}
+	if _, err := New(ctx, &config.Storage{Dir: t.TempDir(), S3: &config.S3{Bucket: "b"}}); err == nil {
+		t.Error("expected error with two backends")
+	}
+	st, err := New(ctx, &config.Storage{Dir: t.TempDir()})
+	testutil.AssertNoError(t, err)
+	if _, ok := st.(*Dir); !ok {
+		t.Errorf("got %T, want *Dir", st)
+	}
+}
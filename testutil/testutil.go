@@ -1,6 +1,7 @@
 package testutil
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -11,7 +12,7 @@ type MockRTClient struct {
 	PostmailFunc func(recipient string, message string) error
 }
 
-func (m *MockRTClient) Postmail(recipient string, message string) error {
+func (m *MockRTClient) Postmail(ctx context.Context, recipient string, message string) error {
 	if m.PostmailFunc != nil {
 		return m.PostmailFunc(recipient, message)
 	}
@@ -0,0 +1,141 @@
+// Package trace adds headers to messages telling RT staff how they were
+// delivered: by which provider, to which envelope recipient and queue,
+// and through which rt-mail node.
+package trace
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.askask.com/rt-mail/auth"
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+)
+
+// Header names.
+const (
+	Received  = "Received"
+	Provider  = "X-RT-Mail-Provider"
+	Recipient = "X-RT-Mail-Recipient"
+	Queue     = "X-RT-Mail-Queue"
+	Backend   = "X-RT-Mail-Backend"
+
+	DeliveredTo = "Delivered-To"
+	OriginalTo  = "X-Original-To"
+)
+
+// headers maps the names used in the configuration to the headers.
+var headers = map[string]string{
+	"received":  Received,
+	"provider":  Provider,
+	"recipient": Recipient,
+	"queue":     Queue,
+	"backend":   Backend,
+
+	"delivered-to": DeliveredTo,
+	"original-to":  OriginalTo,
+}
+
+// defaults are the headers added if none are configured. Delivered-To
+// and X-Original-To are left out as they may already be in the message
+// from the provider's or the sender's own delivery.
+var defaults = []string{Received, Provider, Recipient, Queue, Backend}
+
+// Matcher maps a recipient to its backend and queue, as *rt.RT does.
+type Matcher interface {
+	filter.Router
+	Match(recipient string) rt.Match
+}
+
+// Filter adds the trace headers. It should run after the filters that
+// may reroute the message, so the queue is the one it's posted to.
+type Filter struct {
+	matcher Matcher
+	node    string
+	enabled map[string]bool // by header
+	now     func() time.Time
+}
+
+// New returns the filter configured by cfg.
+func New(cfg *config.Trace, matcher Matcher) (*Filter, error) {
+	f := &Filter{matcher: matcher, node: cfg.Node, enabled: map[string]bool{}, now: time.Now}
+	if f.node == "" {
+		f.node, _ = os.Hostname()
+	}
+	if len(cfg.Headers) == 0 {
+		for _, h := range defaults {
+			f.enabled[h] = true
+		}
+	}
+	for _, name := range cfg.Headers {
+		h, ok := headers[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown header %q", name)
+		}
+		f.enabled[h] = true
+	}
+	return f, nil
+}
+
+// Filter adds the headers above the existing ones, leaving out any the
+// message's DKIM signatures cover, so the signatures still verify.
+func (f *Filter) Filter(ctx context.Context, msg *filter.Message) error {
+	m := f.matcher.Match(msg.Recipient)
+	queue := msg.QueueFor(f.matcher)
+	provider := msg.Envelope.Provider
+
+	signed := auth.SignedHeaders(msg.Raw)
+	eol := msg.EOL()
+	add := func(name, value string) {
+		if !f.enabled[name] || value == "" {
+			return
+		}
+		if signed[strings.ToLower(name)] {
+			log := logger.FromContext(ctx)
+			log.DebugContext(ctx, "not adding header covered by DKIM signature", "header", name)
+			return
+		}
+		msg.AddHeader(name, sanitize(value, eol))
+	}
+
+	add(Received, f.received(ctx, provider, msg.Recipient, eol))
+	add(Provider, provider)
+	add(Recipient, msg.Recipient)
+	add(Queue, queue)
+	add(Backend, m.Backend)
+	add(DeliveredTo, msg.Recipient)
+	add(OriginalTo, msg.Recipient)
+	return nil
+}
+
+// received returns the Received header for rt-mail's hop, folded with
+// the line ending eol.
+func (f *Filter) received(ctx context.Context, provider, recipient, eol string) string {
+	var sb strings.Builder
+	if provider != "" {
+		sb.WriteString("from " + provider + " ")
+	}
+	sb.WriteString("by " + f.node + " (rt-mail) with HTTP")
+	if id := rt.RequestIDFromContext(ctx); id != "" {
+		sb.WriteString(" id " + id)
+	}
+	if recipient != "" {
+		sb.WriteString(eol + "\tfor <" + recipient + ">")
+	}
+	sb.WriteString("; " + f.now().Format(time.RFC1123Z))
+	return sb.String()
+}
+
+// sanitize keeps values from ending the header field early, except for
+// folding with the line ending eol, as received does.
+func sanitize(value, eol string) string {
+	value = strings.ReplaceAll(value, eol+"\t", "\x00")
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	return strings.ReplaceAll(value, "\x00", eol+"\t")
+}
@@ -0,0 +1,117 @@
+package trace
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.askask.com/rt-mail/config"
+	"go.askask.com/rt-mail/filter"
+	"go.askask.com/rt-mail/rt"
+	"go.askask.com/rt-mail/testutil"
+)
+
+type staticMatcher map[string]rt.Match
+
+func (m staticMatcher) Match(recipient string) rt.Match {
+	return m[recipient]
+}
+
+func (m staticMatcher) Route(recipient string) (string, string) {
+	return m[recipient].Queue, m[recipient].Action
+}
+
+// post runs message through a filter client with f and returns what
+// would be posted to RT.
+func post(t *testing.T, ctx context.Context, f *Filter, recipient, message string) string {
+	t.Helper()
+	var posted string
+	client, err := filter.New(&testutil.MockRTClient{PostmailFunc: func(_ string, message string) error {
+		posted = message
+		return nil
+	}}, &config.Filters{})
+	testutil.AssertNoError(t, err)
+	client.Use(f)
+	testutil.AssertNoError(t, client.Postmail(ctx, recipient, message))
+	return posted
+}
+
+func TestFilter(t *testing.T) {
+	matcher := staticMatcher{"help@example.com": {Queue: "Help", Backend: "main"}}
+	f, err := New(&config.Trace{Node: "gw1.example.net"}, matcher)
+	testutil.AssertNoError(t, err)
+	f.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	ctx := rt.NewContext(context.Background(), &rt.Envelope{Provider: "mailgun"})
+	ctx = rt.WithRequestID(ctx, "abc123")
+	message := "From: alice@example.org\r\nSubject: hi\r\n\r\nbody\r\n"
+
+	got := post(t, ctx, f, "help@example.com", message)
+	want := "Received: from mailgun by gw1.example.net (rt-mail) with HTTP id abc123\r\n" +
+		"\tfor <help@example.com>; Wed, 01 May 2024 12:00:00 +0000\r\n" +
+		"X-RT-Mail-Provider: mailgun\r\n" +
+		"X-RT-Mail-Recipient: help@example.com\r\n" +
+		"X-RT-Mail-Queue: Help\r\n" +
+		"X-RT-Mail-Backend: main\r\n" + message
+	if got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+
+	t.Run("LF line endings", func(t *testing.T) {
+		lf := strings.ReplaceAll(message, "\r\n", "\n")
+		got := post(t, ctx, f, "help@example.com", lf)
+		if want := strings.ReplaceAll(want, "\r\n", "\n"); got != want {
+			t.Errorf("got\n%q\nwant\n%q", got, want)
+		}
+	})
+
+	t.Run("selected headers", func(t *testing.T) {
+		f, err := New(&config.Trace{Headers: []string{"recipient", "Queue"}}, matcher)
+		testutil.AssertNoError(t, err)
+		got := post(t, ctx, f, "help@example.com", message)
+		want := "X-RT-Mail-Recipient: help@example.com\r\nX-RT-Mail-Queue: Help\r\n" + message
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("envelope recipient", func(t *testing.T) {
+		f, err := New(&config.Trace{Headers: []string{"delivered-to", "original-to"}}, matcher)
+		testutil.AssertNoError(t, err)
+		got := post(t, ctx, f, "help@example.com", message)
+		want := "Delivered-To: help@example.com\r\nX-Original-To: help@example.com\r\n" + message
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unknown header", func(t *testing.T) {
+		if _, err := New(&config.Trace{Headers: []string{"subject"}}, matcher); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("signed headers", func(t *testing.T) {
+		f, err := New(&config.Trace{Headers: []string{"provider", "queue"}}, matcher)
+		testutil.AssertNoError(t, err)
+		signed := "DKIM-Signature: v=1; a=rsa-sha256; d=example.org; s=s1;\r\n" +
+			"\th=from:subject:x-rt-mail-provider; bh=x; b=y\r\n" + message
+		got := post(t, ctx, f, "help@example.com", signed)
+		if want := "X-RT-Mail-Queue: Help\r\n" + signed; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestSanitize(t *testing.T) {
+	if got := sanitize("a\r\nB: c\nd", "\r\n"); strings.ContainsAny(got, "\r\n") {
+		t.Errorf("sanitize left a line break: %q", got)
+	}
+	if got, want := sanitize("a\r\n\tb", "\r\n"), "a\r\n\tb"; got != want {
+		t.Errorf("sanitize(folded) = %q, want %q", got, want)
+	}
+	if got, want := sanitize("a\n\tb\r\n\tc", "\n"), "a\n\tb \n\tc"; got != want {
+		t.Errorf("sanitize(folded with LF) = %q, want %q", got, want)
+	}
+}